@@ -0,0 +1,71 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+// The default number of nodes in each slab allocated by an arena.
+const default_slab_len = 4096;
+
+// A source of tree nodes that hands out the elements of large slabs (see
+// WithArena()).  A nil arena allocates each node individually.
+type arena struct {
+	slab_len int;
+	// the unused part of the current slab
+	free []ll_rb_node;
+	// the number of slabs allocated
+	slabs int;
+};
+
+// WithArena(slab_len) makes the set allocate its tree nodes slab_len at a
+// time (4096 if slab_len isn't positive) rather than individually.  This
+// suits sets that are built, read and then discarded as a whole: building
+// them takes far fewer allocations and, as the garbage collector frees the
+// slabs as a whole, dropping them is cheaper too.  The node of a removed
+// member is cleared (so that it doesn't keep the member alive) but its space
+// is not reused and a slab is only freed once no node in it is in use so
+// sets that are heavily modified should not use this option.  Clear() and DrainSorted() abandon the set's slabs.  Nodes made by
+// Copy(), the operations that build new sets and by modifications of trees
+// shared by SnapshotIter() are allocated individually.
+func WithArena(slab_len int) Option {
+	return func(set *Set) {
+		set.arena = new_arena(slab_len);
+	};
+};
+
+func new_arena(slab_len int) *arena {
+	if slab_len <= 0 {
+		slab_len = default_slab_len;
+	};
+	return &arena{slab_len: slab_len};
+};
+
+func (this *arena) new_node() (node *ll_rb_node) {
+	if this == nil {
+		return new(ll_rb_node);
+	};
+	if len(this.free) == 0 {
+		this.free = make([]ll_rb_node, this.slab_len);
+		this.slabs++;
+	};
+	node = &this.free[0];
+	this.free = this.free[1:];
+	return;
+};
+
+// release clears node, which has just been unlinked from the tree, so that
+// the slab holding it doesn't keep its item alive.  A node made before the
+// set's current generation may still be in use by a snapshot (see thaw()) so
+// it is left alone.
+func (this *arena) release(node *ll_rb_node, generation uint) {
+	if this != nil && node.generation == generation {
+		*node = ll_rb_node{};
+	};
+};
+
+// renew returns a new empty arena with the same slab length (or nil).
+func (this *arena) renew() *arena {
+	if this == nil {
+		return nil;
+	};
+	return new_arena(this.slab_len);
+};
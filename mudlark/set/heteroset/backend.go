@@ -0,0 +1,277 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"fmt";
+	"os";
+)
+
+// Backend is a strategy for keeping a set's tree balanced (see
+// WithBackend()).  Finding, traversing, ranking and selecting members and
+// cursors only need an ordered binary tree whose nodes record the sizes of
+// their subtrees so they are common to all backends.  A backend supplies the
+// operations that change the shape of the tree and the check of its own
+// invariants.
+type Backend interface {
+	// insert item returning the new root and the instance it replaced (as
+	// for insert())
+	insert(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item);
+	// delete item (which must be present) returning the new root (as for
+	// delete())
+	delete(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool);
+	// build a tree from items which must be in strictly ascending order
+	build(items []Item, arena *arena) *ll_rb_node;
+	// check the balance invariants and the subtree sizes returning the
+	// number of nodes
+	check(root *ll_rb_node) (uint, os.Error);
+	String() string;
+};
+
+type llrb_backend struct{};
+
+type avl_backend struct{};
+
+var (
+	// 2-3 left leaning red black trees (the default)
+	LLRB Backend = llrb_backend{};
+	// AVL trees, which are more strictly balanced than red black trees (so
+	// look ups visit fewer nodes) at the cost of more rotations when the set
+	// is modified
+	AVL Backend = avl_backend{};
+);
+
+// WithBackend(backend) makes the set use backend to balance its tree.  The
+// choice doesn't affect the results of any method.  Copies of the set and
+// sets made from it by methods such as SplitAt() use the same backend and
+// those made by functions of several sets (e.g. Union()) use the backend of
+// their first argument.
+func WithBackend(backend Backend) Option {
+	return func(set *Set) {
+		set.backend = backend;
+	};
+};
+
+// tree returns the set's backend.
+func (this *Set) tree() Backend {
+	if this.backend == nil {
+		return LLRB;
+	};
+	return this.backend;
+};
+
+func (this llrb_backend) insert(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item) {
+	root, previous := insert(root, item, compare, generation, sum, visits, arena);
+	root.red = false;
+	return root, previous;
+};
+
+func (this llrb_backend) delete(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool) {
+	root, deleted := delete(root, item, compare, generation, sum, visits, arena);
+	if root != nil {
+		root.red = false;
+	};
+	return root, deleted;
+};
+
+func (this llrb_backend) build(items []Item, arena *arena) *ll_rb_node {
+	root, _ := build_balanced(items, arena);
+	return root;
+};
+
+func (this llrb_backend) check(root *ll_rb_node) (uint, os.Error) {
+	if is_red(root) {
+		return 0, os.NewError("heteroset: red root");
+	};
+	_, count, err := check_colours(root);
+	return count, err;
+};
+
+func (this llrb_backend) String() string { return "LLRB"; };
+
+// An AVL node's aux is the height of the subtree rooted at it.
+func avl_height(node *ll_rb_node) int {
+	if node == nil {
+		return 0;
+	};
+	return int(node.aux);
+};
+
+func avl_update(node *ll_rb_node) {
+	node.aux = int32(max(avl_height(node.left), avl_height(node.right)) + 1);
+	update_size(node);
+};
+
+// As for rotate_left() and rotate_right() node must already have been thawed.
+func avl_rotate_left(node *ll_rb_node, generation uint) *ll_rb_node {
+	tmp := thaw(node.right, generation);
+	node.right = tmp.left;
+	tmp.left = node;
+	avl_update(node);
+	avl_update(tmp);
+	return tmp;
+};
+
+func avl_rotate_right(node *ll_rb_node, generation uint) *ll_rb_node {
+	tmp := thaw(node.left, generation);
+	node.left = tmp.right;
+	tmp.right = node;
+	avl_update(node);
+	avl_update(tmp);
+	return tmp;
+};
+
+// Restore the balance of the (thawed) node whose subtrees' heights differ by
+// at most two and return the root of the rebalanced subtree.
+func avl_rebalance(node *ll_rb_node, generation uint) *ll_rb_node {
+	avl_update(node);
+	switch balance := avl_height(node.left) - avl_height(node.right); {
+	case balance > 1:
+		if avl_height(node.left.left) < avl_height(node.left.right) {
+			node.left = avl_rotate_left(thaw(node.left, generation), generation);
+		};
+		return avl_rotate_right(node, generation);
+	case balance < -1:
+		if avl_height(node.right.right) < avl_height(node.right.left) {
+			node.right = avl_rotate_right(thaw(node.right, generation), generation);
+		};
+		return avl_rotate_left(node, generation);
+	};
+	return node;
+};
+
+func avl_insert(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item) {
+	if node == nil {
+		node = new_ll_rb_node(item, generation, arena);
+		node.red = false;
+		node.aux = 1;
+		rehash(node, sum);
+		return node, nil;
+	};
+	count_visit(visits);
+	node = thaw(node, generation);
+	var previous Item;
+	switch cmp := compare(node.item, item); {
+	case cmp > 0:
+		node.left, previous = avl_insert(node.left, item, compare, generation, sum, visits, arena);
+	case cmp < 0:
+		node.right, previous = avl_insert(node.right, item, compare, generation, sum, visits, arena);
+	default:
+		previous = node.item;
+		node.item = item;
+		rehash(node, sum);
+	};
+	return avl_rebalance(node, generation), previous;
+};
+
+func avl_delete_left_most(node *ll_rb_node, generation uint, visits *uint64, arena *arena) *ll_rb_node {
+	count_visit(visits);
+	if node.left == nil {
+		right := node.right;
+		arena.release(node, generation);
+		return right;
+	};
+	node = thaw(node, generation);
+	node.left = avl_delete_left_most(node.left, generation, visits, arena);
+	return avl_rebalance(node, generation);
+};
+
+func avl_delete(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool) {
+	if node == nil {
+		return nil, false;
+	};
+	count_visit(visits);
+	var deleted bool;
+	switch cmp := compare(node.item, item); {
+	case cmp > 0:
+		var left *ll_rb_node;
+		if left, deleted = avl_delete(node.left, item, compare, generation, sum, visits, arena); !deleted {
+			return node, false;
+		};
+		node = thaw(node, generation);
+		node.left = left;
+	case cmp < 0:
+		var right *ll_rb_node;
+		if right, deleted = avl_delete(node.right, item, compare, generation, sum, visits, arena); !deleted {
+			return node, false;
+		};
+		node = thaw(node, generation);
+		node.right = right;
+	default:
+		unhash(node, sum);
+		if node.left == nil || node.right == nil {
+			child := node.left;
+			if child == nil {
+				child = node.right;
+			};
+			arena.release(node, generation);
+			return child, true;
+		};
+		node = thaw(node, generation);
+		left_most := node.right;
+		for left_most.left != nil {
+			left_most = left_most.left;
+		};
+		node.item, node.hash = left_most.item, left_most.hash;
+		node.right = avl_delete_left_most(node.right, generation, visits, arena);
+		deleted = true;
+	};
+	return avl_rebalance(node, generation), deleted;
+};
+
+func avl_build(items []Item, arena *arena) (node *ll_rb_node) {
+	if len(items) == 0 {
+		return nil;
+	};
+	mid := len(items) / 2;
+	node = arena.new_node();
+	node.item = items[mid];
+	node.left = avl_build(items[0:mid], arena);
+	node.right = avl_build(items[mid + 1:], arena);
+	avl_update(node);
+	return;
+};
+
+func check_heights(node *ll_rb_node) (count uint, err os.Error) {
+	if node == nil {
+		return 0, nil;
+	};
+	lcount, err := check_heights(node.left);
+	if err != nil {
+		return;
+	};
+	rcount, err := check_heights(node.right);
+	if err != nil {
+		return;
+	};
+	lh, rh := avl_height(node.left), avl_height(node.right);
+	if lh - rh > 1 || rh - lh > 1 {
+		return 0, os.NewError(fmt.Sprintf("heteroset: unbalanced heights (%v and %v) below %v", lh, rh, node.item));
+	};
+	if avl_height(node) != max(lh, rh) + 1 {
+		return 0, os.NewError(fmt.Sprintf("heteroset: height %v but %v below %v", avl_height(node), max(lh, rh) + 1, node.item));
+	};
+	if node.size != lcount + rcount + 1 {
+		return 0, os.NewError(fmt.Sprintf("heteroset: size %v but %v nodes below %v", node.size, lcount + rcount + 1, node.item));
+	};
+	return node.size, nil;
+};
+
+func (this avl_backend) insert(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item) {
+	return avl_insert(root, item, compare, generation, sum, visits, arena);
+};
+
+func (this avl_backend) delete(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool) {
+	return avl_delete(root, item, compare, generation, sum, visits, arena);
+};
+
+func (this avl_backend) build(items []Item, arena *arena) *ll_rb_node {
+	return avl_build(items, arena);
+};
+
+func (this avl_backend) check(root *ll_rb_node) (uint, os.Error) {
+	return check_heights(root);
+};
+
+func (this avl_backend) String() string { return "AVL"; };
@@ -0,0 +1,57 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"reflect";
+);
+
+// Builder collects Items for a Set that groups its members by type in the
+// order in which the types were first added to the Builder (rather than the
+// usual order of types).  It must be created using NewBuilder().
+type Builder struct {
+	items []Item;
+	// the position of each type in the order of first appearance
+	ranks map[reflect.Type]int;
+};
+
+// NewBuilder makes an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{ranks: make(map[reflect.Type]int)};
+};
+
+// Add item to the items for the set.  Nil items are ignored.
+func (this *Builder) Add(item Item) {
+	if is_nil(item) {
+		return;
+	};
+	t := reflect.Typeof(item);
+	if _, seen := this.ranks[t]; !seen {
+		this.ranks[t] = len(this.ranks);
+	};
+	this.items = append(this.items, item);
+};
+
+// Build returns a Set containing the items added so far whose types are
+// ordered by when they were first added (and, within a type, as usual).  As
+// for Add() a later item replaces an earlier equal one.  Types that weren't
+// seen by the Builder follow those that were.  The order is applied with
+// WithOrder() so the caveats described there apply.
+func (this *Builder) Build() *Set {
+	ranks := make(map[reflect.Type]int, len(this.ranks));
+	for t, rank := range this.ranks {
+		ranks[t] = rank;
+	};
+	rank := func(item Item) int {
+		if rank, seen := ranks[reflect.Typeof(item)]; seen {
+			return rank;
+		};
+		return len(ranks);
+	};
+	set := Make(WithOrder(func(a, b Item) bool { return rank(a) < rank(b); }, nil));
+	for _, item := range this.items {
+		set.Add(item);
+	};
+	return set;
+};
@@ -0,0 +1,164 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+// Cursor is a position within a Set (in the order used by Iter()) that can
+// be moved in either direction.  Stepping off either end of the set leaves
+// the cursor invalid until it is repositioned with First(), Last() or
+// Seek().  Any modification of the set invalidates its cursors.
+type Cursor struct {
+	set *Set;
+	// the path from the root to the current node (empty if invalid)
+	path []*ll_rb_node;
+};
+
+// Cursor returns a new Cursor positioned at the first member of the set.
+func (this *Set) Cursor() (cursor *Cursor) {
+	cursor = &Cursor{set: this};
+	cursor.First();
+	return;
+};
+
+func (this *Cursor) push_left_spine(node *ll_rb_node) {
+	for ; node != nil; node = node.left {
+		this.path = append(this.path, node);
+	};
+};
+
+func (this *Cursor) push_right_spine(node *ll_rb_node) {
+	for ; node != nil; node = node.right {
+		this.path = append(this.path, node);
+	};
+};
+
+func (this *Cursor) top() *ll_rb_node {
+	return this.path[len(this.path) - 1];
+};
+
+// Valid reports whether the cursor is positioned at a member of the set.
+func (this *Cursor) Valid() bool {
+	return len(this.path) > 0;
+};
+
+// Item returns the member of the set at the cursor's position.
+func (this *Cursor) Item() (item Item, valid bool) {
+	if valid = this.Valid(); valid {
+		item = this.top().item;
+	};
+	return;
+};
+
+// Move to the first member of the set and report whether there is one.
+func (this *Cursor) First() bool {
+	this.path = this.path[0:0];
+	this.push_left_spine(this.set.root);
+	return this.Valid();
+};
+
+// Move to the last member of the set and report whether there is one.
+func (this *Cursor) Last() bool {
+	this.path = this.path[0:0];
+	this.push_right_spine(this.set.root);
+	return this.Valid();
+};
+
+// Move to the next member of the set and report whether there is one.
+func (this *Cursor) Next() bool {
+	if !this.Valid() {
+		return false;
+	};
+	node := this.top();
+	if node.right != nil {
+		this.push_left_spine(node.right);
+		return true;
+	};
+	// climb until we arrive from a left child
+	for {
+		this.path = this.path[0:len(this.path) - 1];
+		if !this.Valid() {
+			return false;
+		};
+		parent := this.top();
+		if parent.left == node {
+			return true;
+		};
+		node = parent;
+	};
+	return false;
+};
+
+// Move to the previous member of the set and report whether there is one.
+func (this *Cursor) Prev() bool {
+	if !this.Valid() {
+		return false;
+	};
+	node := this.top();
+	if node.left != nil {
+		this.push_right_spine(node.left);
+		return true;
+	};
+	// climb until we arrive from a right child
+	for {
+		this.path = this.path[0:len(this.path) - 1];
+		if !this.Valid() {
+			return false;
+		};
+		parent := this.top();
+		if parent.right == node {
+			return true;
+		};
+		node = parent;
+	};
+	return false;
+};
+
+// Seek moves the cursor to the first member of the set that is equal to or
+// follows item (in the order used by Iter()) and reports whether there is
+// one.
+func (this *Cursor) Seek(item Item) bool {
+	this.path = this.path[0:0];
+	if is_nil(item) {
+		return false;
+	};
+	item = this.set.normal(item);
+	// length of the path to the last node where the search went left
+	var keep int;
+	compare := this.set.comparator();
+	for node := this.set.root; node != nil; {
+		this.path = append(this.path, node);
+		switch cmp := compare(node.item, item); {
+		case cmp > 0:
+			keep = len(this.path);
+			node = node.left;
+		case cmp < 0:
+			node = node.right;
+		default:
+			return true;
+		};
+	};
+	this.path = this.path[0:keep];
+	return this.Valid();
+};
+
+// SeekFrom returns a sequence of the members of the set (in the order used by
+// Iter()) starting with the first that is equal to or follows item, or with
+// the first member if item is nil.  Finding the start takes O(log n) time so
+// it is suitable for paging through a large set.  The set must not be
+// modified while the sequence is in use.
+func (this *Set) SeekFrom(item Item) Seq {
+	return func(yield func(item Item) bool) {
+		cursor := &Cursor{set: this};
+		var valid bool;
+		if is_nil(item) {
+			valid = cursor.First();
+		} else {
+			valid = cursor.Seek(item);
+		};
+		for ; valid; valid = cursor.Next() {
+			if current, _ := cursor.Item(); !yield(current) {
+				return;
+			};
+		};
+	};
+};
@@ -0,0 +1,156 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+// The path from the root to the node at which the last look up ended (see
+// WithFinger()).  For each node on the path lo and hi are the indices (in
+// path) of the nearest ancestors that bound its subtree from below and above
+// (-1 if there is no such ancestor).
+type finger struct {
+	// the set's root and version when the path was recorded
+	root *ll_rb_node;
+	version uint64;
+	path []*ll_rb_node;
+	lo, hi []int;
+};
+
+// WithFinger() makes the set remember where its last look up (by Has(),
+// Find(), HasSafe(), Successor(), Predecessor(), Remove() etc.) ended and start the next one from the nearest node
+// on the path to that point whose subtree's range includes the item being
+// looked for rather than from the root.  When successive look ups are for
+// items that are close together in the set's order this reduces a look up
+// from O(log n) to O(log d) where d is the distance (in members) between
+// them.  For scattered look ups it costs a few extra comparisons.  Modifying
+// the set makes it start again from the root.  Since look ups record their
+// path a set using this option can't be read by several goroutines at once.
+func WithFinger() Option {
+	return func(set *Set) {
+		set.finger = new(finger);
+	};
+};
+
+func (this *finger) push(node *ll_rb_node, lo, hi int) {
+	this.path = append(this.path, node);
+	this.lo = append(this.lo, lo);
+	this.hi = append(this.hi, hi);
+};
+
+// finger_descend is the search for item starting from the finger.  It leaves
+// the path ending at the last node visited and returns the result of
+// comparing that node's item with item (0 if the set is empty).  The member
+// being compared is always compare's first argument.
+func (this *Set) finger_descend(item Item, compare func(a, b Item) int) (cmp int) {
+	f := this.finger;
+	start := 0;
+	if f.root == this.root && f.version == this.version && len(f.path) > 0 {
+		// climb until a subtree's range includes item (the root's always
+		// does) comparing item with each bound at most once
+		lo_index, hi_index := -1, -1;
+		var lo_ok, hi_ok bool;
+		for start = len(f.path) - 1; start > 0; start-- {
+			if lo := f.lo[start]; lo >= 0 {
+				if lo != lo_index {
+					lo_index, lo_ok = lo, compare(f.path[lo].item, item) < 0;
+				};
+				if !lo_ok {
+					continue;
+				};
+			};
+			if hi := f.hi[start]; hi >= 0 {
+				if hi != hi_index {
+					hi_index, hi_ok = hi, compare(f.path[hi].item, item) > 0;
+				};
+				if !hi_ok {
+					continue;
+				};
+			};
+			break;
+		};
+	} else {
+		f.root, f.version = this.root, this.version;
+		f.path, f.lo, f.hi = f.path[0:0], f.lo[0:0], f.hi[0:0];
+		if this.root == nil {
+			return;
+		};
+		f.push(this.root, -1, -1);
+	};
+	f.path, f.lo, f.hi = f.path[0:start + 1], f.lo[0:start + 1], f.hi[0:start + 1];
+	for node := f.path[start]; ; {
+		count_visit(this.visits);
+		i := len(f.path) - 1;
+		switch cmp = compare(node.item, item); {
+		case cmp > 0:
+			if node = node.left; node == nil {
+				return;
+			};
+			f.push(node, f.lo[i], i);
+		case cmp < 0:
+			if node = node.right; node == nil {
+				return;
+			};
+			f.push(node, i, f.hi[i]);
+		default:
+			return;
+		};
+	};
+	return;
+};
+
+// finger_find is find() starting from the finger.
+func (this *Set) finger_find(item Item, compare func(a, b Item) int) (instance Item, found bool) {
+	if cmp := this.finger_descend(item, compare); cmp == 0 && len(this.finger.path) > 0 {
+		return this.finger.path[len(this.finger.path) - 1].item, true;
+	};
+	return;
+};
+
+// finger_successor is the search for Successor() starting from the finger.
+// Where the search ends either gives the answer or the answer is the
+// nearest ancestor that bounds the end's subtree from above.
+func (this *Set) finger_successor(item Item, compare func(a, b Item) int) (successor Item, found bool) {
+	f := this.finger;
+	cmp := this.finger_descend(item, compare);
+	if len(f.path) == 0 {
+		return;
+	};
+	last := len(f.path) - 1;
+	switch node := f.path[last]; {
+	case cmp > 0:
+		return node.item, true;
+	case cmp == 0 && node.right != nil:
+		node = node.right;
+		for node.left != nil {
+			node = node.left;
+		};
+		return node.item, true;
+	};
+	if hi := f.hi[last]; hi >= 0 {
+		return f.path[hi].item, true;
+	};
+	return;
+};
+
+// finger_predecessor is the mirror image of finger_successor().
+func (this *Set) finger_predecessor(item Item, compare func(a, b Item) int) (predecessor Item, found bool) {
+	f := this.finger;
+	cmp := this.finger_descend(item, compare);
+	if len(f.path) == 0 {
+		return;
+	};
+	last := len(f.path) - 1;
+	switch node := f.path[last]; {
+	case cmp < 0:
+		return node.item, true;
+	case cmp == 0 && node.left != nil:
+		node = node.left;
+		for node.right != nil {
+			node = node.right;
+		};
+		return node.item, true;
+	};
+	if lo := f.lo[last]; lo >= 0 {
+		return f.path[lo].item, true;
+	};
+	return;
+};
@@ -12,7 +12,16 @@
 // being inserted do not have to be of the same type.)
 package heteroset;
 
-import "reflect";
+import (
+	"container/heap";
+	"fmt";
+	"math";
+	"os";
+	"rand";
+	"reflect";
+	"sort";
+	"sync";
+)
 
 // The type of potential set items must implement this interface and must
 // satisfy the following formal requirements (where a, b and c are all
@@ -21,26 +30,132 @@ import "reflect";
 //	 a.Precedes(b) && b.Precedes(c) implies a.Precedes(c)
 //	 !a.Precedes(b) && !b.Precedes(a) implies a == b
 // This method will only be used when reflect.Typeof() the calling object
-// matches reflect.Typeof() of other.
+// matches reflect.Typeof() of other.  A nil Item can't be a member of a Set
+// and nor can a nil pointer (whose Precedes() would usually panic).  The
+// methods that take a single item treat both the same way: Add() and
+// Remove() ignore them, look ups fail and the error returning variants
+// return ErrNilItem.
 type Item interface {
 	Precedes(other interface{}) bool;
 };
 
+// Errors returned by the error returning variants of the Set methods.
+var (
+	ErrNilItem = os.NewError("heteroset: nil item");
+	ErrIncomparable = os.NewError("heteroset: Precedes() panicked");
+	ErrFull = os.NewError("heteroset: set is full");
+);
+
+// CompareError describes a panic raised by Precedes() while comparing A
+// and B.  Err is always ErrIncomparable.
+type CompareError struct {
+	Err os.Error;
+	A, B Item;
+	Panic interface{};
+};
+
+func (this *CompareError) String() string {
+	return fmt.Sprintf("%v comparing %v and %v: %v", this.Err, this.A, this.B, this.Panic);
+};
+
+// Items may optionally implement this interface to supply the hash used by
+// Set.Hash().  Items that are equal must return equal hashes.
+type Hasher interface {
+	Hash() uint64;
+};
+
+// Items may optionally implement this interface to be copied by
+// Set.DeepClone().  The clone must be equal to (neither precede nor follow)
+// the original.
+type Cloner interface {
+	CloneItem() Item;
+};
+
 // LLRB tree node
 type ll_rb_node struct {
 	item Item;
 	left, right *ll_rb_node;
 	red bool;
+	// used by backends other than LLRB: the height of the subtree rooted at
+	// this node for AVL and the node's random priority for the treap
+	aux int32;
+	// the number of nodes in the subtree rooted at this node
+	size uint;
+	// the owning set's generation when the node was made (see thaw())
+	generation uint;
+	// the item's contribution to the set's checksum (see WithChecksum())
+	hash uint64;
+};
+
+// Whether item is to be treated as a nil Item: nil itself, a nil pointer or
+// a Time{}.  The package's own item types are checked without reflect (which
+// allocates) as they are the common case.
+func is_nil(item Item) bool {
+	switch t := item.(type) {
+	case nil:
+		return true;
+	case Int, String, Float64, Bytes:
+		return false;
+	case Time:
+		return t.Time == nil;
+	};
+	if v, ok := reflect.NewValue(item).(*reflect.PtrValue); ok {
+		return v.IsNil();
+	};
+	return false;
 };
 
-func new_ll_rb_node(item Item) *ll_rb_node {
-	node := new(ll_rb_node);
+func new_ll_rb_node(item Item, generation uint, arena *arena) *ll_rb_node {
+	node := arena.new_node();
 	node.item = item;
 	node.red = true;
+	node.size = 1;
+	node.generation = generation;
 	return node;
 };
 
+// Nodes made before the set's current generation may be shared with a
+// snapshot (see SnapshotIter()) or with another set (see the treap backend)
+// so they must be copied rather than modified.
+// The functions below that restructure the tree only modify the node passed
+// to them (which the caller must already have thawed) and the children that
+// they thaw themselves.
+// Generations are handed out by new_generation() so that no two sets that
+// share nodes ever have the same one.
+var (
+	generations_lock sync.Mutex;
+	last_generation uint;
+);
+
+func new_generation() uint {
+	generations_lock.Lock();
+	defer generations_lock.Unlock();
+	last_generation++;
+	return last_generation;
+};
+
+func thaw(node *ll_rb_node, generation uint) *ll_rb_node {
+	if node == nil || node.generation == generation {
+		return node;
+	};
+	clone := *node;
+	clone.generation = generation;
+	return &clone;
+};
+
+func size(node *ll_rb_node) uint {
+	if node == nil {
+		return 0;
+	};
+	return node.size;
+};
+
+func update_size(node *ll_rb_node) {
+	node.size = size(node.left) + size(node.right) + 1;
+};
+
 func min(a, b int) int { if a < b { return a }; return b; };
+func max(a, b int) int { if a > b { return a }; return b; };
 
 func cmp_string(a, b string) int {
 	for i, lim := 0, min(len(a), len(b)); i < lim; i++ {
@@ -53,6 +168,32 @@ func cmp_string(a, b string) int {
 	return len(a) - len(b);
 };
 
+// Distinct types that cmp_type() can't tell apart by description (e.g. types
+// with the same name declared in different functions) are ordered by the
+// order in which it first encountered them.
+var (
+	type_ranks_lock sync.Mutex;
+	type_ranks = make(map[reflect.Type]int);
+);
+
+func type_rank(t reflect.Type) int {
+	type_ranks_lock.Lock();
+	defer type_ranks_lock.Unlock();
+	rank, ok := type_ranks[t];
+	if !ok {
+		rank = len(type_ranks);
+		type_ranks[t] = rank;
+	};
+	return rank;
+};
+
+// Items of different types are ordered by package path, then by type name
+// and then by the type's full string (which distinguishes unnamed types such
+// as pointers for which both the package path and name are empty).  Should
+// all three match (e.g. types with the same name declared in different
+// functions or in different packages with the same path) the types' ranks
+// decide so that Precedes() is never called with an argument of a type
+// other than its receiver's.
 func cmp_type(a, b interface{}) int {
 	ta := reflect.Typeof(a);
 	tb := reflect.Typeof(b);
@@ -62,144 +203,366 @@ func cmp_type(a, b interface{}) int {
 	if cp := cmp_string(ta.PkgPath(), tb.PkgPath()); cp != 0 {
 		return cp;
 	};
-	return cmp_string(ta.Name(), tb.Name());
+	if cn := cmp_string(ta.Name(), tb.Name()); cn != 0 {
+		return cn;
+	};
+	if cs := cmp_string(ta.String(), tb.String()); cs != 0 {
+		return cs;
+	};
+	return type_rank(ta) - type_rank(tb);
 };
 
-func (this *ll_rb_node) compare_item(item Item) int {
-	if ct := cmp_type(this.item, item); ct != 0 {
+func compare_items(a, b Item) int {
+	if ct := cmp_type(a, b); ct != 0 {
 		return ct;
 	};
-	if this.item.Precedes(item) {
+	if a.Precedes(b) {
 		return -1;
-	} else if item.Precedes(this.item) {
+	} else if b.Precedes(a) {
 		return 1;
 	};
 	return 0;
 };
 
+// CheckComparator checks that Precedes() honours the contract documented
+// for Item on every pair and triple of same typed items in the sample i.e.
+// that it is irreflexive, antisymmetric and transitive and that equivalence
+// (neither item preceding the other) is transitive.  It returns an error
+// describing the first violation found (or nil).  As every triple is
+// examined the sample should be kept small.
+func CheckComparator(items []Item) os.Error {
+	violation := func(format string, args ...interface{}) os.Error {
+		return os.NewError("heteroset: " + fmt.Sprintf(format, args...));
+	};
+	equivalent := func(a, b Item) bool {
+		return !a.Precedes(b) && !b.Precedes(a);
+	};
+	for _, a := range items {
+		if is_nil(a) {
+			continue;
+		};
+		if a.Precedes(a) {
+			return violation("%v precedes itself", a);
+		};
+		for _, b := range items {
+			if is_nil(b) || cmp_type(a, b) != 0 {
+				continue;
+			};
+			if a.Precedes(b) && b.Precedes(a) {
+				return violation("%v and %v precede each other", a, b);
+			};
+			for _, c := range items {
+				if is_nil(c) || cmp_type(a, c) != 0 {
+					continue;
+				};
+				if a.Precedes(b) && b.Precedes(c) && !a.Precedes(c) {
+					return violation("%v precedes %v precedes %v but %v does not precede %v", a, b, c, a, c);
+				};
+				if equivalent(a, b) && equivalent(b, c) && !equivalent(a, c) {
+					return violation("%v equals %v equals %v but %v does not equal %v", a, b, c, a, c);
+				};
+			};
+		};
+	};
+	return nil;
+};
+
+
+const (
+	fnv_offset64 = 14695981039346656037;
+	fnv_prime64 = 1099511628211;
+);
+
+// 64 bit FNV-1a hash of data
+func fnv64a(data []byte) uint64 {
+	hash := uint64(fnv_offset64);
+	for _, c := range data {
+		hash ^= uint64(c);
+		hash *= fnv_prime64;
+	};
+	return hash;
+};
+
+// Items that don't implement Hasher are hashed using a binary encoding of
+// their type and value (see encode_value()).
+func hash_item(item Item) uint64 {
+	if hasher, ok := item.(Hasher); ok {
+		return hasher.Hash();
+	};
+	data := []byte(reflect.Typeof(item).String());
+	return fnv64a(encode_value(data, reflect.NewValue(item), make(map[uintptr]bool)));
+};
+
+func append_uint64(data []byte, x uint64) []byte {
+	for i := uint(0); i < 64; i += 8 {
+		data = append(data, byte(x >> i));
+	};
+	return data;
+};
+
+// Append a binary encoding of value to data.  The encoding doesn't depend on
+// where the value is stored: pointers are followed (those in seen having
+// already been encoded) and only the lengths of maps are encoded as the
+// order of their entries isn't fixed.  Channels and functions contribute
+// nothing but whether they are nil.
+func encode_value(data []byte, value reflect.Value, seen map[uintptr]bool) []byte {
+	switch v := value.(type) {
+	case nil:
+		data = append(data, 0);
+	case *reflect.BoolValue:
+		if v.Get() {
+			data = append(data, 1);
+		} else {
+			data = append(data, 0);
+		};
+	case *reflect.IntValue:
+		data = append_uint64(data, uint64(v.Get()));
+	case *reflect.UintValue:
+		data = append_uint64(data, v.Get());
+	case *reflect.UintptrValue:
+		data = append_uint64(data, uint64(v.Get()));
+	case *reflect.FloatValue:
+		data = append_uint64(data, math.Float64bits(v.Get()));
+	case *reflect.ComplexValue:
+		data = append_uint64(data, math.Float64bits(real(v.Get())));
+		data = append_uint64(data, math.Float64bits(imag(v.Get())));
+	case *reflect.StringValue:
+		data = append_uint64(data, uint64(len(v.Get())));
+		data = append(data, []byte(v.Get())...);
+	case *reflect.PtrValue:
+		if v.IsNil() {
+			data = append(data, 0);
+		} else if seen[v.Get()] {
+			data = append(data, 2);
+		} else {
+			seen[v.Get()] = true;
+			data = encode_value(append(data, 1), v.Elem(), seen);
+		};
+	case *reflect.InterfaceValue:
+		if v.IsNil() {
+			data = append(data, 0);
+		} else {
+			data = append(data, []byte(v.Elem().Type().String())...);
+			data = encode_value(append(data, 1), v.Elem(), seen);
+		};
+	case *reflect.ArrayValue:
+		for i := 0; i < v.Len(); i++ {
+			data = encode_value(data, v.Elem(i), seen);
+		};
+	case *reflect.SliceValue:
+		data = append_uint64(data, uint64(v.Len()));
+		for i := 0; i < v.Len(); i++ {
+			data = encode_value(data, v.Elem(i), seen);
+		};
+	case *reflect.StructValue:
+		for i := 0; i < v.NumField(); i++ {
+			data = encode_value(data, v.Field(i), seen);
+		};
+	case *reflect.MapValue:
+		data = append_uint64(data, uint64(v.Len()));
+	case *reflect.ChanValue:
+		if v.IsNil() {
+			data = append(data, 0);
+		} else {
+			data = append(data, 1);
+		};
+	case *reflect.FuncValue:
+		if v.IsNil() {
+			data = append(data, 0);
+		} else {
+			data = append(data, 1);
+		};
+	};
+	return data;
+};
+
+// Replace node's contribution to the running checksum *sum (if sum isn't nil)
+// with the hash of its item.
+func rehash(node *ll_rb_node, sum *uint64) {
+	if sum != nil {
+		*sum ^= node.hash;
+		node.hash = hash_item(node.item);
+		*sum ^= node.hash;
+	};
+};
+
+// Take node's contribution out of the running checksum *sum (if sum isn't
+// nil).
+func unhash(node *ll_rb_node, sum *uint64) {
+	if sum != nil {
+		*sum ^= node.hash;
+	};
+};
+
 func is_red(node *ll_rb_node) bool { return node != nil && node.red; };
 
-func flip_colours(node *ll_rb_node) {
+func flip_colours(node *ll_rb_node, generation uint) {
+	node.left = thaw(node.left, generation);
+	node.right = thaw(node.right, generation);
 	node.red = !node.red;
 	node.left.red = !node.left.red;
 	node.right.red = !node.right.red;
 };
 
-func rotate_left(node *ll_rb_node) *ll_rb_node {
-	tmp := node.right;
+// This is a variable so that tests can substitute a faulty version.
+var rotate_left = func(node *ll_rb_node, generation uint) *ll_rb_node {
+	tmp := thaw(node.right, generation);
 	node.right = tmp.left;
 	tmp.left = node;
 	tmp.red = node.red;
 	node.red = true;
+	tmp.size = node.size;
+	update_size(node);
 	return tmp;
 };
 
-func rotate_right(node *ll_rb_node) *ll_rb_node {
-	tmp := node.left;
+func rotate_right(node *ll_rb_node, generation uint) *ll_rb_node {
+	tmp := thaw(node.left, generation);
 	node.left = tmp.right;
 	tmp.right = node;
 	tmp.red = node.red;
 	node.red = true;
+	tmp.size = node.size;
+	update_size(node);
 	return tmp;
 };
 
-func fix_up(node *ll_rb_node) *ll_rb_node {
+func fix_up(node *ll_rb_node, generation uint) *ll_rb_node {
 	if is_red(node.right) && !is_red(node.left) {
-		node = rotate_left(node);
+		node = rotate_left(node, generation);
 	};
 	if is_red(node.left) && is_red(node.left.left) {
-		node = rotate_right(node);
+		node = rotate_right(node, generation);
 	};
 	if is_red(node.left) && is_red(node.right) {
-		flip_colours(node);
+		flip_colours(node, generation);
 	};
+	update_size(node);
 	return node;
 };
 
-func insert(node *ll_rb_node, item Item) (*ll_rb_node, bool) {
+// Insert item returning the new root and the instance replaced by item (nil
+// if item was inserted).  If sum isn't nil it is the running checksum (see
+// WithChecksum()) and the nodes' contributions to it are kept up to date.  If
+// visits isn't nil it is incremented for each node visited (see
+// NewInstrumented()) and similarly for the other searches.  The new node (if
+// any) is allocated from arena (see WithArena()).
+func insert(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item) {
 	if node == nil {
-		return new_ll_rb_node(item), true;
+		node = new_ll_rb_node(item, generation, arena);
+		rehash(node, sum);
+		return node, nil;
 	};
-	inserted := false;
-	switch cmp := node.compare_item(item); {
+	count_visit(visits);
+	node = thaw(node, generation);
+	var previous Item;
+	switch cmp := compare(node.item, item); {
 	case cmp > 0:
-		node.left, inserted = insert(node.left, item);
+		node.left, previous = insert(node.left, item, compare, generation, sum, visits, arena);
 	case cmp < 0:
-		node.right, inserted = insert(node.right, item);
+		node.right, previous = insert(node.right, item, compare, generation, sum, visits, arena);
 	default:
 		// overwrite the existing equivalent item so that Sets are useful
 		// with (key, value) items
+		previous = node.item;
 		node.item = item;
+		rehash(node, sum);
 	};
-	return fix_up(node), inserted;
+	return fix_up(node, generation), previous;
 };
 
-func move_red_left(node *ll_rb_node) *ll_rb_node {
-	flip_colours(node);
+func move_red_left(node *ll_rb_node, generation uint) *ll_rb_node {
+	flip_colours(node, generation);
 	if (is_red(node.right.left)) {
-		node.right = rotate_right(node.right);
-		node = rotate_left(node);
-		flip_colours(node);
+		node.right = rotate_right(node.right, generation);
+		node = rotate_left(node, generation);
+		flip_colours(node, generation);
 	};
 	return node;
 };
 
-func move_red_right(node *ll_rb_node) *ll_rb_node {
-	flip_colours(node);
+func move_red_right(node *ll_rb_node, generation uint) *ll_rb_node {
+	flip_colours(node, generation);
 	if (is_red(node.left.left)) {
-		node = rotate_right(node);
-		flip_colours(node);
+		node = rotate_right(node, generation);
+		flip_colours(node, generation);
 	};
 	return node;
 };
 
-func delete_left_most(node *ll_rb_node) *ll_rb_node {
+func delete_left_most(node *ll_rb_node, generation uint, visits *uint64, arena *arena) *ll_rb_node {
+	count_visit(visits);
 	if node.left == nil {
+		arena.release(node, generation);
 		return nil;
 	};
+	node = thaw(node, generation);
 	if !is_red(node.left) && !is_red(node.left.left) {
-		node = move_red_left(node);
+		node = move_red_left(node, generation);
 	};
-	node.left = delete_left_most(node.left);
-	return fix_up(node);
+	node.left = delete_left_most(node.left, generation, visits, arena);
+	return fix_up(node, generation);
 };
 
-func delete(node *ll_rb_node, item Item) (*ll_rb_node, bool) {
+// As for insert(), sum (if not nil) is the running checksum and visits (if
+// not nil) counts the nodes visited.  The node unlinked from the tree is
+// released to arena (see WithArena()).
+func delete(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool) {
 	var deleted bool;
-	if node.compare_item(item) > 0 {
+	count_visit(visits);
+	node = thaw(node, generation);
+	if compare(node.item, item) > 0 {
 		if !is_red(node.left) && !is_red(node.left.left) {
-			node = move_red_left(node);
+			node = move_red_left(node, generation);
 		};
-		node.left, deleted = delete(node.left, item);
+		node.left, deleted = delete(node.left, item, compare, generation, sum, visits, arena);
 	} else {
 		if is_red(node.left) {
-			node = rotate_right(node);
+			node = rotate_right(node, generation);
 		};
-		if node.compare_item(item) == 0 && node.right == nil {
+		if compare(node.item, item) == 0 && node.right == nil {
+			unhash(node, sum);
+			arena.release(node, generation);
 			return nil, true;
 		};
 		if !is_red(node.right) && !is_red(node.right.left) {
-			node = move_red_right(node);
+			node = move_red_right(node, generation);
 		};
-		if node.compare_item(item) == 0 {
+		if compare(node.item, item) == 0 {
+			unhash(node, sum);
 			left_most := node.right;
 			for left_most.left != nil {
 				left_most = left_most.left;
 			};
-			node.item = left_most.item;
-			node.right = delete_left_most(node.right);
+			node.item, node.hash = left_most.item, left_most.hash;
+			node.right = delete_left_most(node.right, generation, visits, arena);
 			deleted = true;
 		} else {
-			node.right, deleted = delete(node.right, item);
+			node.right, deleted = delete(node.right, item, compare, generation, sum, visits, arena);
 		};
 	};
-	return fix_up(node), deleted;
+	return fix_up(node, generation), deleted;
 };
 
 // Iteration using recursion is safe because the depth of the tree should never
 // be greater than 2Log2(N) where N is the number of nodes in the tree and
 // (in general) will be approximately Log2(N).
 
+func find(node *ll_rb_node, item Item, compare func(a, b Item) int, visits *uint64) (instance Item, found bool) {
+	for node != nil {
+		count_visit(visits);
+		switch cmp := compare(node.item, item); {
+		case cmp > 0:
+			node = node.left;
+		case cmp < 0:
+			node = node.right;
+		default:
+			return node.item, true;
+		};
+	};
+	return;
+};
+
 func iterate_inorder(node *ll_rb_node, c chan<- Item) {
 	if node == nil {
 		return;
@@ -214,11 +577,181 @@ func iterate(node *ll_rb_node, c chan<- Item) {
 	close(c);
 };
 
+func check_colours(node *ll_rb_node) (black_height int, count uint, err os.Error) {
+	if node == nil {
+		return 0, 0, nil;
+	};
+	if is_red(node.right) {
+		return 0, 0, os.NewError(fmt.Sprintf("heteroset: red right link below %v", node.item));
+	};
+	if is_red(node) && is_red(node.left) {
+		return 0, 0, os.NewError(fmt.Sprintf("heteroset: consecutive red links below %v", node.item));
+	};
+	lbh, lcount, err := check_colours(node.left);
+	if err != nil {
+		return;
+	};
+	rbh, rcount, err := check_colours(node.right);
+	if err != nil {
+		return;
+	};
+	if lbh != rbh {
+		return 0, 0, os.NewError(fmt.Sprintf("heteroset: unequal black heights (%v and %v) below %v", lbh, rbh, node.item));
+	};
+	if node.size != lcount + rcount + 1 {
+		return 0, 0, os.NewError(fmt.Sprintf("heteroset: size %v but %v nodes below %v", node.size, lcount + rcount + 1, node.item));
+	};
+	if !node.red {
+		lbh++;
+	};
+	return lbh, lcount + rcount + 1, nil;
+};
+
+func check_order(node *ll_rb_node, last Item, compare func(a, b Item) int) (Item, os.Error) {
+	if node == nil {
+		return last, nil;
+	};
+	last, err := check_order(node.left, last, compare);
+	if err != nil {
+		return nil, err;
+	};
+	if last != nil && compare(node.item, last) <= 0 {
+		return nil, os.NewError(fmt.Sprintf("heteroset: %v is out of order after %v", node.item, last));
+	};
+	return check_order(node.right, node.item, compare);
+};
+
+// If not nil this is called for each node visited by inorder() and
+// reverse_inorder() so that tests can check that traversals stop early.
+var visit_hook func(node *ll_rb_node);
+
+// In order traversal that stops as soon as fn returns false (in which case
+// false is returned).
+func inorder(node *ll_rb_node, fn func(Item) bool) bool {
+	if node == nil {
+		return true;
+	};
+	if visit_hook != nil {
+		visit_hook(node);
+	};
+	return inorder(node.left, fn) && fn(node.item) && inorder(node.right, fn);
+};
+
+// As inorder() but from last to first.
+func reverse_inorder(node *ll_rb_node, fn func(Item) bool) bool {
+	if node == nil {
+		return true;
+	};
+	if visit_hook != nil {
+		visit_hook(node);
+	};
+	return reverse_inorder(node.right, fn) && fn(node.item) && reverse_inorder(node.left, fn);
+};
+
+func walk(node *ll_rb_node, depth int, fn func(Item, int, bool)) {
+	if node == nil {
+		return;
+	};
+	walk(node.left, depth + 1, fn);
+	fn(node.item, depth, node.red);
+	walk(node.right, depth + 1, fn);
+};
+
+// Call Precedes() both ways on a pair of items of the same type converting
+// any panic into a *CompareError.
+func protected_compare(a, b Item) (err os.Error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = &CompareError{ErrIncomparable, a, b, x};
+		};
+	}();
+	a.Precedes(b);
+	b.Precedes(a);
+	return;
+};
+
+// Build a balanced tree from items which must be in strictly ascending order.
+// The black height of the tree is also returned.  The left subtree of each
+// node is the same size as or one bigger than the right subtree and the only
+// time that this makes their black heights differ is when the left subtree
+// is perfect in which case its root is coloured red.  The nodes are allocated
+// from arena (see WithArena()).
+func build_balanced(items []Item, arena *arena) (node *ll_rb_node, black_height int) {
+	if len(items) == 0 {
+		return nil, 0;
+	};
+	mid := len(items) / 2;
+	node = arena.new_node();
+	node.item = items[mid];
+	var lbh int;
+	node.left, lbh = build_balanced(items[0:mid], arena);
+	node.right, black_height = build_balanced(items[mid + 1:], arena);
+	if lbh > black_height {
+		node.left.red = true;
+	};
+	node.size = uint(len(items));
+	black_height++;
+	return;
+};
+
+// Return the item at position i (counting from 0 in the order used by Iter())
+// in the tree rooted at node which must have more than i nodes.
+func select_item(node *ll_rb_node, i uint) Item {
+	for {
+		switch left := size(node.left); {
+		case i < left:
+			node = node.left;
+		case i > left:
+			i -= left + 1;
+			node = node.right;
+		default:
+			return node.item;
+		};
+	};
+	return nil;
+};
+
+// Return the number of items in the tree rooted at node that precede item.
+func rank(node *ll_rb_node, item Item, compare func(a, b Item) int) (r uint) {
+	for node != nil {
+		if compare(node.item, item) < 0 {
+			r += size(node.left) + 1;
+			node = node.right;
+		} else {
+			node = node.left;
+		};
+	};
+	return;
+};
+
+func strictly_ascending(items []Item) bool {
+	for i := 1; i < len(items); i++ {
+		if compare_items(items[i - 1], items[i]) >= 0 {
+			return false;
+		};
+	};
+	return true;
+};
+
+func dump(node *ll_rb_node, indent string) string {
+	if node == nil {
+		return "";
+	};
+	colour := "black";
+	if node.red {
+		colour = "red";
+	};
+	return dump(node.right, indent + "    ") + fmt.Sprintf("%s%v (%s)\n", indent, node.item, colour) + dump(node.left, indent + "    ");
+};
+
 func copy(node *ll_rb_node) *ll_rb_node {
 	if node == nil { return nil; };
 	clone := new(ll_rb_node);
 	clone.item = node.item;
 	clone.red = node.red;
+	clone.size = node.size;
+	clone.aux = node.aux;
+	clone.hash = node.hash;
 	clone.left = copy(node.left);
 	clone.right = copy(node.right);
 	return clone;
@@ -228,147 +761,2128 @@ func copy(node *ll_rb_node) *ll_rb_node {
 // interface. Instances of Set must be created using New()
 // before use.  E.g.:
 //	var s Set = heteroset.New(item1, ....)
+// *Set itself implements Item so sets may be members of sets (but see
+// Precedes() for why they must not then be changed).
 type Set struct {
 	root *ll_rb_node;
 	count uint;
+	self_check func(this *Set, op string, item Item);
+	auditing bool;
+	audit_log []MutationEvent;
+	// incremented by every change of membership (see Version())
+	version uint64;
+	// nil unless BeginJournal() has been called
+	journal *journal;
+	// see WithOnInsert() and WithOnDelete()
+	on_insert, on_delete func(item Item);
+	in_callback bool;
+	// the maximum number of members (0 for no limit)
+	max_len uint;
+	// see WithValidator()
+	validator func(item Item) os.Error;
+	// see WithNormalizer()
+	normalizer func(item Item) Item;
+	// nil unless WithArena() has been used
+	arena *arena;
+	// nil for the default (see WithBackend())
+	backend Backend;
+	// see WithSliceCache()
+	caching bool;
+	cached SetSlice;
+	// see WithOrder() (nil for the default order and equality)
+	compare func(a, b Item) int;
+	equal func(a, b Item) bool;
+	// see WithFallbackOrder()
+	fallback func(a, b Item) int;
+	// identify the Options that set compare and fallback so that sets
+	// sharing an order can be recognised (see in_step())
+	compare_id, fallback_id *int;
+	// see WithChecksum()
+	checksumming bool;
+	checksum uint64;
+	// nil unless WithNegativeCache() has been used
+	negative *negative_cache;
+	// nil unless WithFinger() has been used
+	finger *finger;
+	// nil unless made by NewInstrumented() (visits points into stats)
+	stats *Stats;
+	visits *uint64;
+	// incremented by SnapshotIter() so that the nodes it shares are copied
+	// rather than modified
+	generation uint;
+	// usage counters (see PublishExpvar()) which are only changed atomically
+	inserts, deletes, failed_finds, iterators uint64;
+	// whether PublishExpvar() has been called and the length and height it
+	// publishes as of the last change (also only accessed atomically)
+	published bool;
+	length, height uint64;
 };
 
-// Make a Set. The optional Item parameters will be used to initialize the set's
-// contents.
-func New(items ...Item) (set *Set) {
+// Option is the type of the configuration options accepted by Make().
+type Option func(set *Set);
+
+// Make an empty Set configured by the given options.  E.g.:
+//	var s Set = heteroset.Make(heteroset.WithSelfCheck(true))
+func Make(options ...Option) (set *Set) {
 	set = new(Set);
-	for _, item := range items {
-		set.Add(item);
+	for _, option := range options {
+		option(set);
 	};
 	return;
 };
 
-// Len returns the number of items in the set.
-func (this *Set) Cardinality() uint {
-	return this.count;
+func self_check(this *Set, op string, item Item) {
+	if err := this.CheckInvariants(); err != nil {
+		panic(fmt.Sprintf("%v after %s(%v):\n%s", err, op, item, dump(this.root, "")));
+	};
 };
 
-// Make a copy of this set.
-func (this *Set) Copy() (set *Set) {
-	set = new(Set);
-	set.root = copy(this.root);
-	set.count = this.count;
-	return;
+// WithSelfCheck(true) causes the set to check its internal invariants after
+// every Add() or Remove() and to panic (with a dump of the tree) if they have
+// been violated.  This is expensive and is intended for use during
+// development.  When it is off the only cost is a nil check.
+func WithSelfCheck(on bool) Option {
+	return func(set *Set) {
+		if on {
+			set.self_check = self_check;
+		} else {
+			set.self_check = nil;
+		};
+	};
 };
 
-// Find an instance equal to item in the set.
-// This function is useful in the case where the item has a (key, value)
-// structure and only the key is used for implementing Precedes() for using
-// a Set as a look up table.
-func (this *Set) Find(item Item) (instance Item, found bool) {
-	if this.count == 0 {
-		return;
+// WithOnInsert(fn) causes fn to be called with each item inserted into the
+// set (but not with items that replace an equal item already present).  The
+// callback is made once the set is in a consistent state so it may query the
+// set but it must not modify it: doing so causes a panic.  Copies made with
+// Copy() don't inherit the callback.
+func WithOnInsert(fn func(item Item)) Option {
+	return func(set *Set) {
+		set.on_insert = fn;
 	};
-	for node := this.root; node != nil && !found; {
-		switch cmp := node.compare_item(item); {
-		case cmp > 0:
-			node = node.left;
-		case cmp < 0:
-			node = node.right;
-		default:
-			found = true;
-			instance = node.item;
-		};
+};
+
+// WithOnDelete(fn) causes fn to be called with the instance of each item
+// removed from the set by Remove() or Clear() (or any other method that
+// removes items).  As for WithOnInsert() the callback must not modify the
+// set.
+func WithOnDelete(fn func(item Item)) Option {
+	return func(set *Set) {
+		set.on_delete = fn;
 	};
-	return;
 };
 
-// Is there an instance equal to item in the set.
-func (this *Set) Has(item Item) (has bool) {
-	_, has = this.Find(item);
-	return;
+// WithSliceCache() makes the set keep the slice built by ToSlice() until
+// the set is next modified so that repeated calls are cheap.  This suits
+// sets that are read far more often than they are modified.
+func WithSliceCache() Option {
+	return func(set *Set) {
+		set.caching = true;
+	};
 };
 
-// Add an item to the set.
-// If an Item equal to item is already present in the set it is overwritten.
-// This makes sets useful in the case where the items have a (key, value)
-// structure and only the key is used for implementing Precedes() for use as a
-// look up table.
-func (this *Set) Add(item Item) {
-	var inserted bool;
-	this.root, inserted = insert(this.root, item);
-	if inserted {
-		this.count++;
+// WithChecksum() makes the set keep a running checksum of its contents (see
+// Checksum()) which is updated as members are inserted, replaced or removed
+// instead of being recomputed.  Each member's hash is recorded when it is
+// inserted so that the same value is taken back out when it is removed.
+// The hashes are updated as the nodes are inserted or removed so this costs
+// only the hashing of the items although DeleteRange() always removes items
+// individually.
+func WithChecksum() Option {
+	return func(set *Set) {
+		set.checksumming = true;
 	};
-	this.root.red = false;
 };
 
-// Remove item from the set.
-func (this *Set) Remove(item Item) {
-	var deleted bool;
-	this.root, deleted = delete(this.root, item);
-	if deleted {
-		this.count--;
+// running_checksum returns the checksum to be updated by insert() and
+// delete() or nil if the set doesn't keep one.
+func (this *Set) running_checksum() *uint64 {
+	if this.checksumming {
+		return &this.checksum;
 	};
-	this.root.red = false;
+	return nil;
 };
 
-// Iterate over the set members in arbitrary type order and in order within type.
-func (this *Set) Iter() <-chan Item {
-	c := make(chan Item);
-	go iterate(this.root, c);
-	return c;
+// Checksum returns the same value as Hash() computed for the set's contents
+// as they were when added.  If the set was made with WithChecksum() this
+// takes O(1) time otherwise it is computed by Hash().
+func (this *Set) Checksum() uint64 {
+	if this.checksumming {
+		return this.checksum;
+	};
+	return this.Hash();
 };
 
-// Iterate asynchronously over the set members in arbitrary type order and in
-// order within type. This method uses more memory than Iter() and is only
-// recommended for use when circumstances preclude the use of Iter().
-func (this *Set) IterAsync() <-chan Item {
-	c := make(chan Item, this.count);
-	iterate(this.root, c);
-	return c;
+// WithMaxLen(n) limits the set to at most n members.  Once the set is full
+// Add() refuses (returning false) to insert new items although it will still
+// replace items that are already present.  Use AddChecked() to distinguish
+// refusal from the item already being present.  WithMaxLen(0) removes the
+// limit.
+func WithMaxLen(n uint) Option {
+	return func(set *Set) {
+		set.max_len = n;
+	};
 };
 
-func in_size_order(setA, setB *Set) (smallest, other *Set) {
-	if setA.Cardinality() < setB.Cardinality() {
-		smallest, other = setA, setB;
-	} else {
-		smallest, other = setB, setA;
+// WithValidator(fn) makes the set check each item with fn before inserting
+// it.  An item for which fn returns an error is not inserted: Add() and
+// AddReportingPrevious() drop it (leaving the set unchanged) while
+// AddChecked() and AddSafe() return the error and ApplyPatch() returns it
+// without making any change.  Sets made from the set (e.g. by Copy()) don't
+// inherit the validator.
+func WithValidator(fn func(item Item) os.Error) Option {
+	return func(set *Set) {
+		set.validator = fn;
 	};
-	return;
 };
 
-// Disjoint returns true if setA and setB have no members in common
-func Disjoint(setA, setB *Set) bool {
-	smallest, other := in_size_order(setA, setB);
-	for item := range smallest.Iter() {
-		if other.Has(item) {
-			return false;
-		};
+func (this *Set) validate(item Item) os.Error {
+	if this.validator == nil {
+		return nil;
 	};
-	return true;
+	return this.validator(item);
 };
 
-// Intersect returns true if setA and setB have at least one member common
-func Intersect(setA, setB *Set) bool {
-	smallest, other := in_size_order(setA, setB);
-	for item := range smallest.Iter() {
-		if other.Has(item) {
-			return true;
-		};
+// WithNormalizer(fn) makes the set replace each item given to it by fn(item)
+// before comparing it with the members: the normalized instance is the one
+// stored by Add() and the one searched for by Find(), Has(), Remove() etc.
+// and the bounds used by Successor(), Predecessor(), DeleteRange() and
+// Cursor.Seek() are normalized too.  E.g. to ignore case:
+//	set := heteroset.Make(heteroset.WithNormalizer(func(item heteroset.Item) heteroset.Item {
+//		if s, ok := item.(heteroset.String); ok {
+//			return heteroset.String(strings.ToLower(string(s)));
+//		};
+//		return item;
+//	}))
+// fn is never given a nil item.  It must be pure and idempotent (normalizing
+// a normalized item must return an equal item) as some operations apply it
+// more than once.  Copies of the set use the same normalizer.
+func WithNormalizer(fn func(item Item) Item) Option {
+	return func(set *Set) {
+		set.normalizer = fn;
 	};
-	return false;
 };
 
-// Subset returns true if every member of setA is also member of setB
-//	Intersection(setA, setB) == setA
-func Subset(setA, setB *Set) bool {
-	if setA.Cardinality() > setB.Cardinality() { return false; };
-	for item := range setA.Iter() {
-		if !setB.Has(item) {
-			return false;
+func (this *Set) normal(item Item) Item {
+	if this.normalizer == nil || is_nil(item) {
+		return item;
+	};
+	return this.normalizer(item);
+};
+
+// WithOrder(less, equal) makes the set keep its members in the order given
+// by less (with items that less doesn't order being ordered as usual) and
+// treat items as equal (for Add(), Find(), Remove() etc.) when equal says
+// so.  If equal is nil then items are equal when they have the same
+// position in the order.  E.g. to keep events in time order but with only
+// one event per ID:
+//	set := heteroset.Make(heteroset.WithOrder(by_time, same_id))
+// The functions must be consistent: less must be a strict weak ordering,
+// equal must be an equivalence relation and two items that neither less nor
+// Precedes() can order must be equal.  If equal is given it can't be used to
+// guide the search of the tree so Add(), Find() and Remove() take O(n) time.
+// The set algebra functions and the other functions that combine or compare
+// sets use the order and equality of their first argument (see in_step())
+// and their results have the same order and equality.  They can only walk
+// the sets in step if they were made with the same Option and equal is nil
+// and otherwise look members up instead.  Only the SetSlice returned by
+// ToSlice() sorts with the default order.
+func WithOrder(less, equal func(a, b Item) bool) Option {
+	id := new(int);
+	return func(set *Set) {
+		set.compare, set.compare_id = nil, nil;
+		if less != nil {
+			set.compare_id = id;
+			set.compare = func(a, b Item) int {
+				if less(a, b) {
+					return -1;
+				} else if less(b, a) {
+					return 1;
+				};
+				return compare_items(a, b);
+			};
 		};
+		set.equal = equal;
 	};
-	return true;
 };
 
-// ProperSubset returns true if every member of setA is also member of setB
-// and they are not equal
+// WithFallbackOrder(fallback) makes the set order two items with fallback
+// (which must return a negative, zero or positive int as a precedes, equals
+// or follows b) if comparing them with Precedes() (or the less function
+// given to WithOrder()) panics.  This keeps the set usable with items whose
+// Precedes() can't handle all values e.g. because a field may be missing.
+// The combined order must still satisfy the requirements documented for
+// Item so fallback should agree with Precedes() where that works.  The
+// functions that combine or compare sets use the fallback of their first
+// argument as part of its order (see in_step()) and their results keep it.
+func WithFallbackOrder(fallback func(a, b Item) int) Option {
+	id := new(int);
+	return func(set *Set) {
+		set.fallback, set.fallback_id = fallback, id;
+	};
+};
+
+// comparator returns the function used to order the set's tree.
+func (this *Set) comparator() func(a, b Item) int {
+	compare := compare_items;
+	if this.compare != nil {
+		compare = this.compare;
+	};
+	if this.stats != nil {
+		uncounted := compare;
+		compare = func(a, b Item) int {
+			this.stats.Comparisons++;
+			return uncounted(a, b);
+		};
+	};
+	if this.fallback == nil {
+		return compare;
+	};
+	return func(a, b Item) (cmp int) {
+		defer func() {
+			if x := recover(); x != nil {
+				cmp = this.fallback(a, b);
+			};
+		}();
+		return compare(a, b);
+	};
+};
+
+// Equivalent returns true if the set considers a and b to be equal i.e. if
+// adding b to a set containing a would replace a rather than insert b.  This
+// uses the functions given to WithOrder() and WithNormalizer() (if any).
+func (this *Set) Equivalent(a, b Item) bool {
+	a, b = this.normal(a), this.normal(b);
+	if this.equal != nil {
+		return this.equal(a, b);
+	};
+	return this.comparator()(a, b) == 0;
+};
+
+// lookup returns the member of the set equal to item (if any) without
+// updating the usage counters.
+func (this *Set) lookup(item Item) (instance Item, found bool) {
+	item = this.normal(item);
+	if this.definitely_absent(item) {
+		return;
+	};
+	if this.equal == nil {
+		if this.finger != nil {
+			return this.finger_find(item, this.comparator());
+		};
+		return find(this.root, item, this.comparator(), this.visits);
+	};
+	inorder(this.root, func(member Item) bool {
+		if this.equal(member, item) {
+			instance, found = member, true;
+		};
+		return !found;
+	});
+	return;
+};
+
+func (this *Set) check_not_in_callback(op string) {
+	if this.in_callback {
+		panic(fmt.Sprintf("heteroset: %s() called by an OnInsert/OnDelete callback", op));
+	};
+};
+
+func (this *Set) callback(fn func(item Item), item Item) {
+	this.in_callback = true;
+	defer func() { this.in_callback = false; }();
+	fn(item);
+};
+
+// Make a Set. The optional Item parameters will be used to initialize the set's
+// contents.
+func New(items ...Item) (set *Set) {
+	set = new(Set);
+	for _, item := range items {
+		set.Add(item);
+	};
+	return;
+};
+
+// NewFromChannel makes a Set containing the Items received from c until it
+// is closed.  As for Add(), nil Items are ignored.
+func NewFromChannel(c <-chan Item) (set *Set) {
+	set = New();
+	for item := range c {
+		set.Add(item);
+	};
+	return;
+};
+
+// Seq is a sequence of Items: calling it calls yield with each item in turn
+// until yield returns false or the sequence is exhausted.
+type Seq func(yield func(item Item) bool);
+
+// Collect makes a Set containing the Items in seq.  As for Add(), nil Items
+// are ignored and later duplicates replace earlier ones.
+func Collect(seq Seq) (set *Set) {
+	set = New();
+	seq(func(item Item) bool {
+		set.Add(item);
+		return true;
+	});
+	return;
+};
+
+// FromSortInterface makes a Set containing the Items returned by get(i) for
+// each i in [0, data.Len()).  If the Items are already in order (as used by
+// Iter()) the set is built directly in linear time.
+func FromSortInterface(data sort.Interface, get func(i int) Item) (set *Set) {
+	items := make(SetSlice, 0, data.Len());
+	for i := 0; i < data.Len(); i++ {
+		if item := get(i); !is_nil(item) {
+			items = append(items, item);
+		};
+	};
+	if !strictly_ascending(items) {
+		return New(items...);
+	};
+	return from_ascending(items);
+};
+
+// BuildBalanced makes a Set containing the Items in seq.  If they are in
+// strictly ascending order (as used by Iter()) and there are exactly
+// size_hint of them the tree is built as they arrive without collecting them
+// in a slice first, which halves the peak memory needed for large inputs.
+// Otherwise the Items are collected and the set is built as by
+// FromSortInterface().  Nil Items are skipped.  seq is run in a separate
+// goroutine.
+func BuildBalanced(seq Seq, size_hint int) (set *Set) {
+	// nil marks the end of the sequence
+	c := make(chan Item, 256);
+	go func() {
+		seq(func(item Item) bool {
+			if !is_nil(item) {
+				c <- item;
+			};
+			return true;
+		});
+		c <- nil;
+	}();
+	var last Item;
+	var pending []Item;
+	done, ordered, n := false, true, 0;
+	// the next item if it follows the previous one, otherwise nil
+	next := func() Item {
+		if done || !ordered {
+			return nil;
+		};
+		item := <-c;
+		if item == nil {
+			done = true;
+		} else if last != nil && compare_items(last, item) >= 0 {
+			ordered = false;
+			pending = append(pending, item);
+			return nil;
+		} else {
+			last = item;
+			n++;
+		};
+		return item;
+	};
+	// as build_balanced() but taking the items from next()
+	var build func(n int) (*ll_rb_node, int);
+	build = func(n int) (node *ll_rb_node, black_height int) {
+		if n <= 0 {
+			return nil, 0;
+		};
+		mid := n / 2;
+		left, lbh := build(mid);
+		item := next();
+		if item == nil {
+			// the shape no longer matters (see below)
+			return left, lbh;
+		};
+		node = new(ll_rb_node);
+		node.item = item;
+		node.left = left;
+		node.right, black_height = build(n - mid - 1);
+		if lbh > black_height {
+			node.left.red = true;
+		};
+		update_size(node);
+		black_height++;
+		return;
+	};
+	root, _ := build(size_hint);
+	if item := next(); item != nil {
+		// more items than expected
+		pending = append(pending, item);
+	};
+	if done && ordered && n == max(size_hint, 0) {
+		set = New();
+		set.root = root;
+		set.count = uint(n);
+		set.inserts = uint64(n);
+		set.version = uint64(n);
+		return;
+	};
+	items := make([]Item, 0, n + len(pending));
+	inorder(root, func(item Item) bool {
+		items = append(items, item);
+		return true;
+	});
+	items = append(items, pending...);
+	if !done {
+		for item := <-c; item != nil; item = <-c {
+			items = append(items, item);
+		};
+	};
+	if !strictly_ascending(items) {
+		return New(items...);
+	};
+	return from_ascending(items);
+};
+
+// Make a set containing items (which must be in strictly ascending order) in
+// linear time.
+func from_ascending(items []Item) (set *Set) {
+	set = New();
+	set.root, _ = build_balanced(items, nil);
+	set.count = uint(len(items));
+	set.inserts = uint64(len(items));
+	set.version = uint64(len(items));
+	return;
+};
+
+// Dedup returns the distinct non nil items in items in the order used by
+// Iter().  Where items contains equal items the first is kept.
+func Dedup(items []Item) []Item {
+	distinct := make([]Item, 0, len(items));
+	for _, item := range items {
+		if !is_nil(item) {
+			distinct = append(distinct, item);
+		};
+	};
+	if strictly_ascending(distinct) {
+		return distinct;
+	};
+	set := New();
+	for _, item := range distinct {
+		set.Intern(item);
+	};
+	return set.ToSlice();
+};
+
+// DedupInPlaceOrder returns the non nil items in items with any item equal to
+// an earlier item dropped.  The order of the remaining items is unchanged.
+func DedupInPlaceOrder(items []Item) []Item {
+	set := New();
+	distinct := make([]Item, 0, len(items));
+	for _, item := range items {
+		if set.Add(item) {
+			distinct = append(distinct, item);
+		};
+	};
+	return distinct;
+};
+
+// FromMap makes a Set containing the keys of m (nil keys are ignored).
+func FromMap(m map[Item]struct{}) (set *Set) {
+	set = New();
+	for item, _ := range m {
+		set.Add(item);
+	};
+	return;
+};
+
+// SetSlice attaches the methods of sort.Interface to []Item using the order
+// used by Sets so that (for example) sort.Search() can be used on the output
+// of ToSlice().
+type SetSlice []Item;
+
+func (this SetSlice) Len() int {
+	return len(this);
+};
+
+func (this SetSlice) Less(i, j int) bool {
+	return compare_items(this[i], this[j]) < 0;
+};
+
+func (this SetSlice) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i];
+};
+
+// Len returns the number of items in the set.
+func (this *Set) Cardinality() uint {
+	return this.count;
+};
+
+// SizeHint returns the number of items in the set as a uint64, for
+// consumers that want to preallocate buffers before reading from Iter().
+// It costs O(1) as the count is maintained by Add(), Remove() and Clear().
+func (this *Set) SizeHint() uint64 {
+	return uint64(this.count);
+};
+
+// Version returns a counter that is incremented whenever the membership of
+// the set changes i.e. by an Add() that inserts a new item, a Remove() that
+// deletes an item or a Clear() of a non-empty set.  Comparing it with a
+// previously saved value is a cheap way to tell whether the set has changed.
+func (this *Set) Version() uint64 {
+	return this.version;
+};
+
+// ToSlice returns the members of the set in the order used by Iter().  For a
+// set made with WithSliceCache() the slice is only built on the first call
+// after the set is modified and is shared by all callers so it must not be
+// modified.
+func (this *Set) ToSlice() SetSlice {
+	if this.caching && this.cached != nil {
+		return this.cached;
+	};
+	slice := make(SetSlice, 0, this.count);
+	inorder(this.root, func(item Item) bool {
+		slice = append(slice, item);
+		return true;
+	});
+	if this.caching {
+		this.cached = slice;
+	};
+	return slice;
+};
+
+// ToMap returns a map whose keys are the members of the set.  The map has
+// no order and distinguishes items using == rather than Precedes() so items
+// whose types cannot be map keys (e.g. Bytes) will cause a run-time panic.
+func (this *Set) ToMap() map[Item]struct{} {
+	m := make(map[Item]struct{}, this.count);
+	inorder(this.root, func(item Item) bool {
+		m[item] = struct{}{};
+		return true;
+	});
+	return m;
+};
+
+// ToByteKeyedMap returns a map from the key derived from each member of the
+// set by key (converted to a string) to the member.  The members are visited
+// in the order used by Iter() and if two members have the same key the later
+// one wins.
+func (this *Set) ToByteKeyedMap(key func(item Item) []byte) map[string]Item {
+	m := make(map[string]Item, this.count);
+	inorder(this.root, func(item Item) bool {
+		m[string(key(item))] = item;
+		return true;
+	});
+	return m;
+};
+
+// MutationEvent is an entry in the audit log of a Set created by
+// NewWithAuditLog().  Op is one of OP_ADD, OP_REMOVE or OP_CLEAR, Item is
+// the operation's argument (nil for OP_CLEAR) and Changed records whether
+// the operation changed the set's membership.
+type MutationEvent struct {
+	Op int;
+	Item Item;
+	Changed bool;
+};
+
+func (this *Set) record(op int, item Item, changed bool) {
+	this.audit_log = append(this.audit_log, MutationEvent{op, item, changed});
+};
+
+// WithAuditLog() causes every Add(), Remove() and Clear() to be recorded in
+// the set's audit log.  See Log().
+func WithAuditLog() Option {
+	return func(set *Set) {
+		set.auditing = true;
+	};
+};
+
+// Make a Set with an audit log (see Log()).  The optional Item parameters will
+// be used to initialize the set's contents (and will be logged).
+func NewWithAuditLog(items ...Item) (set *Set) {
+	set = Make(WithAuditLog());
+	for _, item := range items {
+		set.Add(item);
+	};
+	return;
+};
+
+// Log returns a copy of the set's audit log in the order that the operations
+// were performed.  It is empty unless the set was created with an audit log.
+func (this *Set) Log() []MutationEvent {
+	log := make([]MutationEvent, len(this.audit_log));
+	for i, event := range this.audit_log {
+		log[i] = event;
+	};
+	return log;
+};
+
+// ReplayLog makes a Set by performing the operations recorded in events
+// (e.g. as returned by Log()) in order.
+func ReplayLog(events []MutationEvent) (set *Set) {
+	set = New();
+	for _, event := range events {
+		switch event.Op {
+		case OP_ADD:
+			set.Add(event.Item);
+		case OP_REMOVE:
+			set.Remove(event.Item);
+		case OP_CLEAR:
+			set.Clear();
+		};
+	};
+	return;
+};
+
+// Make a copy of this set.
+func (this *Set) Copy() (set *Set) {
+	set = new(Set);
+	set.root = copy(this.root);
+	set.count = this.count;
+	set.version = this.version;
+	set.self_check = this.self_check;
+	set.auditing = this.auditing;
+	set.caching = this.caching;
+	set.checksumming = this.checksumming;
+	set.checksum = this.checksum;
+	if this.negative != nil {
+		set.negative = this.negative.copy();
+	};
+	if this.finger != nil {
+		set.finger = new(finger);
+	};
+	set.compare = this.compare;
+	set.equal = this.equal;
+	set.fallback = this.fallback;
+	set.compare_id, set.fallback_id = this.compare_id, this.fallback_id;
+	set.normalizer = this.normalizer;
+	set.backend = this.backend;
+	return;
+};
+
+// DeepClone makes a copy of this set in which each member that implements
+// Cloner is replaced by the result of its CloneItem() method.  Members that
+// don't implement Cloner are shared with this set so, in a set holding both
+// kinds, changes to a mutable member of the second kind will be seen by
+// both.  The copy's tree has the same shape as this set's.
+func (this *Set) DeepClone() (set *Set) {
+	set = this.Copy();
+	clone_items(set.root);
+	return;
+};
+
+func clone_items(node *ll_rb_node) {
+	if node == nil { return; };
+	if cloner, ok := node.item.(Cloner); ok {
+		node.item = cloner.CloneItem();
+	};
+	clone_items(node.left);
+	clone_items(node.right);
+};
+
+// similar returns an empty set with the same order, equality, normalizer and
+// backend as this set.
+func (this *Set) similar() (set *Set) {
+	set = new(Set);
+	set.compare = this.compare;
+	set.equal = this.equal;
+	set.fallback = this.fallback;
+	set.compare_id, set.fallback_id = this.compare_id, this.fallback_id;
+	set.normalizer = this.normalizer;
+	set.backend = this.backend;
+	return;
+};
+
+// similar_from returns a set like this one (see similar()) holding items
+// which must be distinct and in the set's order.  The tree is built from them
+// directly.
+func (this *Set) similar_from(items []Item) (set *Set) {
+	set = this.similar();
+	set.root = set.tree().build(items, nil);
+	set.count = uint(len(items));
+	set.inserts = uint64(len(items));
+	set.version = uint64(len(items));
+	return;
+};
+
+// TakeSmallest returns the first k members of the set (or all of them if
+// there are fewer than k) in the order used by Iter().  Only the part of the
+// tree holding those members is visited.
+func (this *Set) TakeSmallest(k int) []Item {
+	items := make([]Item, 0, min(max(k, 0), int(this.count)));
+	if k > 0 {
+		inorder(this.root, func(item Item) bool {
+			items = append(items, item);
+			return len(items) < k;
+		});
+	};
+	return items;
+};
+
+// SplitAt returns two new sets: first holding the k smallest members of the
+// set (in the order used by Iter()) and rest holding the others.  If k <= 0
+// first is empty and if k >= Cardinality() rest is.  Unlike splitting at a
+// pivot item the sizes of the halves don't depend on how the members are
+// distributed.  The halves are built directly from the tree without any
+// comparisons in O(n) time (or, if the set uses a treap, split from it in
+// O(log n) time: the red black and AVL trees have no join to reassemble the
+// pieces cut along a path) and have the same order and equality as this
+// set, which is left unchanged.
+func (this *Set) SplitAt(k int) (first, rest *Set) {
+	n := uint(min(max(k, 0), int(this.count)));
+	if is_treap(this) {
+		generation := share(this);
+		left, right := treap_split_at(this.root, n, generation);
+		return this.similar_tree(left, generation), this.similar_tree(right, generation);
+	};
+	items := make([]Item, 0, this.count);
+	inorder(this.root, func(item Item) bool {
+		items = append(items, item);
+		return true;
+	});
+	return this.similar_from(items[0:n]), this.similar_from(items[n:]);
+};
+
+// Split returns two new sets: below holding the members of the set that
+// precede pivot and rest holding the others (including the member equal to
+// pivot if there is one).  It is SplitAt() at pivot's rank so it takes
+// O(log n) time if the set uses a treap.
+func (this *Set) Split(pivot Item) (below, rest *Set) {
+	if is_nil(pivot) {
+		return this.SplitAt(0);
+	};
+	return this.SplitAt(int(rank(this.root, this.normal(pivot), this.comparator())));
+};
+
+// TakeLargest returns the last k members of the set (or all of them if there
+// are fewer than k) in the order used by Iter().  Only the part of the tree
+// holding those members is visited.
+func (this *Set) TakeLargest(k int) []Item {
+	items := make([]Item, 0, min(max(k, 0), int(this.count)));
+	if k > 0 {
+		reverse_inorder(this.root, func(item Item) bool {
+			items = append(items, item);
+			return len(items) < k;
+		});
+	};
+	for i, j := 0, len(items) - 1; i < j; i, j = i + 1, j - 1 {
+		items[i], items[j] = items[j], items[i];
+	};
+	return items;
+};
+
+// Take returns a new set containing the first n members of the set (in the
+// order used by Iter()).
+func (this *Set) Take(n int) (set *Set) {
+	set = this.similar();
+	inorder(this.root, func(item Item) bool {
+		if int(set.count) >= n {
+			return false;
+		};
+		set.Add(item);
+		return true;
+	});
+	return;
+};
+
+// Drop returns a new set containing the members of the set except for the
+// first n (in the order used by Iter()).
+func (this *Set) Drop(n int) (set *Set) {
+	set = this.similar();
+	var i int;
+	inorder(this.root, func(item Item) bool {
+		if i >= n {
+			set.Add(item);
+		};
+		i++;
+		return true;
+	});
+	return;
+};
+
+// A heap of Items ordered by an arbitrary comparison function
+type item_heap struct {
+	items []Item;
+	cmp func(a, b Item) int;
+};
+
+func (this *item_heap) Len() int {
+	return len(this.items);
+};
+
+func (this *item_heap) Less(i, j int) bool {
+	return this.cmp(this.items[i], this.items[j]) < 0;
+};
+
+func (this *item_heap) Swap(i, j int) {
+	this.items[i], this.items[j] = this.items[j], this.items[i];
+};
+
+func (this *item_heap) Push(x interface{}) {
+	this.items = append(this.items, x.(Item));
+};
+
+func (this *item_heap) Pop() interface{} {
+	last := this.items[len(this.items) - 1];
+	this.items = this.items[0:len(this.items) - 1];
+	return last;
+};
+
+// TopK returns (highest first) the k members of the set that rank highest
+// according to cmp which need not be related to the set's own order and must
+// return a negative, zero or positive int as a ranks lower than, equal to or
+// higher than b.  Of members that rank equally, those that come first in the
+// order used by Iter() are preferred.  It takes O(n log k) time.
+func (this *Set) TopK(k int, cmp func(a, b Item) int) []Item {
+	if k <= 0 {
+		return []Item{};
+	};
+	h := &item_heap{make([]Item, 0, min(k, int(this.count))), cmp};
+	inorder(this.root, func(item Item) bool {
+		if h.Len() < k {
+			heap.Push(h, item);
+		} else if cmp(item, h.items[0]) > 0 {
+			heap.Pop(h);
+			heap.Push(h, item);
+		};
+		return true;
+	});
+	top := make([]Item, h.Len());
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(h).(Item);
+	};
+	return top;
+};
+
+// Find an instance equal to item in the set.
+// This function is useful in the case where the item has a (key, value)
+// structure and only the key is used for implementing Precedes() for using
+// a Set as a look up table.
+func (this *Set) Find(item Item) (instance Item, found bool) {
+	if instance, found = this.find(item); !found {
+		this.count_failed_find();
+	};
+	return;
+};
+
+// As Find() but not counted by the usage statistics.
+func (this *Set) find(item Item) (instance Item, found bool) {
+	if is_nil(item) {
+		return;
+	};
+	return this.lookup(item);
+};
+
+// Is there an instance equal to item in the set.
+func (this *Set) Has(item Item) (has bool) {
+	_, has = this.Find(item);
+	return;
+};
+
+// HasSafe is like Has() except that it returns ErrNilItem if item is nil
+// and a *CompareError (identifying the items involved) if Precedes() panics.
+func (this *Set) HasSafe(item Item) (has bool, err os.Error) {
+	if is_nil(item) {
+		return false, ErrNilItem;
+	};
+	item = this.normal(item);
+	// the member being compared with item
+	var other Item;
+	defer func() {
+		if x := recover(); x != nil {
+			has, err = false, &CompareError{ErrIncomparable, item, other, x};
+		};
+	}();
+	if this.equal != nil {
+		inorder(this.root, func(member Item) bool {
+			other = member;
+			has = this.equal(member, item);
+			return !has;
+		});
+	} else if this.finger != nil {
+		compare := this.comparator();
+		_, has = this.finger_find(item, func(member, item Item) int {
+			other = member;
+			return compare(member, item);
+		});
+	} else {
+		compare := this.comparator();
+		for node := this.root; node != nil && !has; {
+			count_visit(this.visits);
+			other = node.item;
+			switch cmp := compare(node.item, item); {
+			case cmp > 0:
+				node = node.left;
+			case cmp < 0:
+				node = node.right;
+			default:
+				has = true;
+			};
+		};
+	};
+	if !has {
+		this.count_failed_find();
+	};
+	return;
+};
+
+// Run op (which modifies the set) so that if Precedes() (or a function
+// given to WithOrder()) panics the set is put back as it was and a
+// *CompareError identifying item and the member it was being compared with
+// is returned.  As for SnapshotIter() starting a new generation means that
+// the existing nodes are copied rather than modified so the original tree
+// survives intact.  Other panics are passed on once the set is restored.
+func (this *Set) safely(item Item, op func()) (err os.Error) {
+	saved := *this;
+	var saved_journal journal;
+	if this.journal != nil {
+		saved_journal = *this.journal;
+	};
+	var saved_negative negative_cache;
+	if this.negative != nil {
+		saved_negative = *this.negative;
+	};
+	var member Item;
+	comparing := false;
+	compare := this.compare;
+	if compare == nil {
+		compare = compare_items;
+	};
+	this.compare = func(a, b Item) int {
+		member, comparing = a, true;
+		cmp := compare(a, b);
+		comparing = false;
+		return cmp;
+	};
+	if equal := this.equal; equal != nil {
+		this.equal = func(a, b Item) bool {
+			member, comparing = a, true;
+			eq := equal(a, b);
+			comparing = false;
+			return eq;
+		};
+	};
+	this.generation = new_generation();
+	defer func() {
+		x := recover();
+		if x == nil {
+			this.compare, this.equal = saved.compare, saved.equal;
+			return;
+		};
+		*this = saved;
+		if this.journal != nil {
+			*this.journal = saved_journal;
+		};
+		if this.negative != nil {
+			*this.negative = saved_negative;
+		};
+		if !comparing {
+			panic(x);
+		};
+		err = &CompareError{ErrIncomparable, item, member, x};
+	}();
+	op();
+	return;
+};
+
+// AddSafe is like Add() except that it returns ErrNilItem if item is nil,
+// the validator's error if the set's validator (see WithValidator()) rejects
+// it and a *CompareError (identifying the items involved) if Precedes()
+// panics, in which case the set is left as it was.  This costs extra
+// allocation as the nodes on item's path are copied.
+func (this *Set) AddSafe(item Item) (inserted bool, err os.Error) {
+	if is_nil(item) {
+		return false, ErrNilItem;
+	};
+	if err = this.validate(item); err != nil {
+		return false, err;
+	};
+	err = this.safely(item, func() { inserted = this.Add(item); });
+	return;
+};
+
+// RemoveSafe is like Remove() except that it returns ErrNilItem if item is
+// nil and a *CompareError (identifying the items involved) if Precedes()
+// panics, in which case the set is left as it was (even if the panic
+// happened part way through rebalancing the tree).
+func (this *Set) RemoveSafe(item Item) os.Error {
+	if is_nil(item) {
+		return ErrNilItem;
+	};
+	return this.safely(item, func() { this.Remove(item); });
+};
+
+// Median returns the middle member of the set (in the order used by Iter())
+// or the lower of the two middle members if the cardinality is even.  If the
+// set is empty then found is false.
+func (this *Set) Median() (item Item, found bool) {
+	if this.count == 0 {
+		return;
+	};
+	return select_item(this.root, (this.count - 1) / 2), true;
+};
+
+// Quantile returns the member of the set at the q quantile (in the order
+// used by Iter()) using the nearest rank method i.e. the member at position
+// ceil(q * n) counting from 1 (or the first member when q is 0).  If the set
+// is empty or q is outside [0, 1] then found is false.
+func (this *Set) Quantile(q float64) (item Item, found bool) {
+	if this.count == 0 || !(q >= 0 && q <= 1) {
+		return;
+	};
+	rank := uint(math.Ceil(q * float64(this.count)));
+	if rank == 0 {
+		rank = 1;
+	};
+	return select_item(this.root, rank - 1), true;
+};
+
+// RandomItem returns a member of the set chosen uniformly at random using r
+// (or the rand package's default source if r is nil).  It takes O(log n)
+// time.  If the set is empty then found is false.
+func (this *Set) RandomItem(r *rand.Rand) (item Item, found bool) {
+	if this.count == 0 {
+		return;
+	};
+	var i int;
+	if r == nil {
+		i = rand.Intn(int(this.count));
+	} else {
+		i = r.Intn(int(this.count));
+	};
+	return select_item(this.root, uint(i)), true;
+};
+
+// Sample returns (in the order used by Iter()) k distinct members of the set
+// chosen uniformly at random using r (or the rand package's default source
+// if r is nil).  If k is greater than the cardinality all of the members are
+// returned and if k <= 0 the sample is empty.  The positions of the members
+// are chosen using Floyd's algorithm so it takes O(k log n) time and the same
+// sequence from r always gives the same sample.
+func (this *Set) Sample(r *rand.Rand, k int) []Item {
+	n := int(this.count);
+	if k <= 0 {
+		return []Item{};
+	} else if k >= n {
+		return this.ToSlice();
+	};
+	intn := rand.Intn;
+	if r != nil {
+		intn = func(n int) int { return r.Intn(n); };
+	};
+	chosen := make(map[int]bool, k);
+	positions := make([]int, 0, k);
+	for j := n - k; j < n; j++ {
+		i := intn(j + 1);
+		if chosen[i] {
+			i = j;
+		};
+		chosen[i] = true;
+		positions = append(positions, i);
+	};
+	sort.SortInts(positions);
+	sample := make([]Item, len(positions));
+	for i, position := range positions {
+		sample[i] = select_item(this.root, uint(position));
+	};
+	return sample;
+};
+
+// PopRandom removes a member of the set chosen uniformly at random using r
+// (or the rand package's default source if r is nil) and returns it.  If the
+// set is empty then found is false.
+func (this *Set) PopRandom(r *rand.Rand) (item Item, found bool) {
+	if item, found = this.RandomItem(r); found {
+		this.Remove(item);
+	};
+	return;
+};
+
+// Add an item to the set and report whether it was newly inserted.
+// If an Item equal to item is already present in the set it is overwritten.
+// This makes sets useful in the case where the items have a (key, value)
+// structure and only the key is used for implementing Precedes() for use as a
+// look up table.  A nil item (or nil pointer) or one rejected by the set's
+// validator (see WithValidator()) is dropped: the set is left unchanged and
+// false is returned.
+func (this *Set) Add(item Item) bool {
+	_, inserted := this.add(item);
+	return inserted;
+};
+
+// AddReportingPrevious is like Add() except that it returns the instance
+// that item replaced (if any) and whether there was one.  This needs only
+// one search of the tree whereas calling Find() and then Add() needs two.
+// If item is nil or rejected by the set's validator or the set is full (see
+// WithMaxLen()) and has no equal member the set is left unchanged and nil and false are returned.
+func (this *Set) AddReportingPrevious(item Item) (previous Item, existed bool) {
+	previous, _ = this.add(item);
+	return previous, previous != nil;
+};
+
+func (this *Set) add(item Item) (previous Item, inserted bool) {
+	item = this.normal(item);
+	if is_nil(item) || this.validate(item) != nil {
+		return;
+	};
+	this.check_not_in_callback("Add");
+	// even replacing an item changes the slice and (if a snapshot is
+	// sharing nodes) the finger's path
+	this.cached = nil;
+	if this.finger != nil {
+		this.finger.root = nil;
+	};
+	compare := this.comparator();
+	var present bool;
+	if this.max_len > 0 || this.equal != nil {
+		previous, present = this.lookup(item);
+	};
+	if !present && this.full() {
+		return;
+	};
+	if present && this.equal != nil && compare(previous, item) != 0 {
+		// the equal member is elsewhere in the order so move it
+		this.root, _ = this.tree().delete(this.root, previous, compare, this.generation, this.running_checksum(), this.visits, this.arena);
+	};
+	var replaced Item;
+	this.root, replaced = this.tree().insert(this.root, item, compare, this.generation, this.running_checksum(), this.visits, this.arena);
+	if !present {
+		previous = replaced;
+	};
+	if inserted = previous == nil; inserted {
+		this.negative_cache_insert(item);
+		this.count++;
+		this.count_inserts(1);
+		this.version++;
+	};
+	if this.auditing {
+		this.record(OP_ADD, item, inserted);
+	};
+	if this.journal != nil {
+		this.journal_record(journal_entry{op: OP_ADD, item: item, previous: previous});
+	};
+	if this.self_check != nil {
+		this.self_check(this, "Add", item);
+	};
+	if inserted && this.on_insert != nil {
+		this.callback(this.on_insert, item);
+	};
+	return;
+};
+
+// AddChecked is like Add() except that it returns ErrNilItem if item is nil,
+// the validator's error if the set's validator (see WithValidator()) rejects
+// it and ErrFull if item isn't already present and the set has the maximum
+// number of members set by WithMaxLen().
+func (this *Set) AddChecked(item Item) os.Error {
+	if is_nil(item) {
+		return ErrNilItem;
+	};
+	if err := this.validate(item); err != nil {
+		return err;
+	};
+	if this.full() {
+		if _, found := this.lookup(item); !found {
+			return ErrFull;
+		};
+	};
+	this.Add(item);
+	return nil;
+};
+
+func (this *Set) full() bool {
+	return this.max_len > 0 && this.count >= this.max_len;
+};
+
+// ContainsAll reports whether all of items are in the set (true if there
+// are no items).
+func (this *Set) ContainsAll(items ...Item) bool {
+	all := true;
+	this.contains(items, func(i int, has bool) bool {
+		all = has;
+		return all;
+	});
+	return all;
+};
+
+// ContainsAny reports whether any of items are in the set (false if there
+// are no items).
+func (this *Set) ContainsAny(items ...Item) bool {
+	var any bool;
+	this.contains(items, func(i int, has bool) bool {
+		any = has;
+		return !any;
+	});
+	return any;
+};
+
+// ContainsWhich reports which of items are in the set.
+func (this *Set) ContainsWhich(items ...Item) []bool {
+	which := make([]bool, len(items));
+	this.contains(items, func(i int, has bool) bool {
+		which[i] = has;
+		return true;
+	});
+	return which;
+};
+
+// contains calls fn(i, has) for each of items in turn (until fn returns
+// false) where has reports whether items[i] is in the set.  If items are in
+// order and numerous enough they are matched against the members in a single
+// in order walk of the tree rather than searched for one by one.
+func (this *Set) contains(items []Item, fn func(i int, has bool) bool) {
+	// normalized once here rather than at every comparison
+	probes := items;
+	if this.normalizer != nil {
+		probes = make([]Item, len(items));
+		for i, item := range items {
+			probes[i] = this.normal(item);
+		};
+	};
+	if !this.worth_walking(probes) {
+		for i, item := range items {
+			if !fn(i, this.Has(item)) {
+				return;
+			};
+		};
+		return;
+	};
+	items = probes;
+	compare := this.comparator();
+	i, more := 0, true;
+	inorder(this.root, func(member Item) bool {
+		for more && i < len(items) {
+			cmp := compare(items[i], member);
+			if cmp > 0 {
+				break;
+			} else if cmp < 0 {
+				this.count_failed_find();
+			};
+			more = fn(i, cmp == 0);
+			i++;
+		};
+		return more && i < len(items);
+	});
+	for ; more && i < len(items); i++ {
+		this.count_failed_find();
+		more = fn(i, false);
+	};
+};
+
+// worth_walking reports whether a walk of the tree will find items more
+// cheaply than searching for them individually i.e. they are in order (so
+// contain no nils) and walking the n members takes fewer comparisons than
+// len(items) searches of depth log2(n).
+func (this *Set) worth_walking(items []Item) bool {
+	if this.equal != nil || len(items) < 2 {
+		return false;
+	};
+	var log2 int;
+	for n := this.count; n > 0; n >>= 1 {
+		log2++;
+	};
+	if uint(len(items) * log2) < this.count {
+		return false;
+	};
+	compare := this.comparator();
+	for i, item := range items {
+		if is_nil(item) || i > 0 && compare(items[i - 1], item) > 0 {
+			return false;
+		};
+	};
+	return true;
+};
+
+// Intern returns the instance in the set equal to item having first added
+// item to the set if there was no such instance.  Unlike Add() it never
+// replaces an existing instance so it can be used to make many equal items
+// share a single instance.
+func (this *Set) Intern(item Item) Item {
+	if instance, found := this.Find(item); found {
+		return instance;
+	};
+	this.Add(item);
+	return this.normal(item);
+};
+
+// Successor returns the smallest member of the set that follows item (in the
+// order used by Iter()).  Unlike Cursor.Seek() the search is strict: if item
+// is in the set it is the member after it that is returned.
+func (this *Set) Successor(item Item) (successor Item, found bool) {
+	if is_nil(item) {
+		return;
+	};
+	item = this.normal(item);
+	compare := this.comparator();
+	if this.finger != nil {
+		return this.finger_successor(item, compare);
+	};
+	for node := this.root; node != nil; {
+		if compare(node.item, item) > 0 {
+			successor, found = node.item, true;
+			node = node.left;
+		} else {
+			node = node.right;
+		};
+	};
+	return;
+};
+
+// Predecessor returns the largest member of the set that precedes item (in
+// the order used by Iter()).  If item is in the set it is the member before
+// it that is returned.
+func (this *Set) Predecessor(item Item) (predecessor Item, found bool) {
+	if is_nil(item) {
+		return;
+	};
+	item = this.normal(item);
+	compare := this.comparator();
+	if this.finger != nil {
+		return this.finger_predecessor(item, compare);
+	};
+	for node := this.root; node != nil; {
+		if compare(node.item, item) < 0 {
+			predecessor, found = node.item, true;
+			node = node.right;
+		} else {
+			node = node.left;
+		};
+	};
+	return;
+};
+
+// Remove item from the set.
+func (this *Set) Remove(item Item) {
+	if is_nil(item) {
+		return;
+	};
+	this.check_not_in_callback("Remove");
+	var deleted bool;
+	// delete() assumes that item is present
+	instance, found := this.lookup(item);
+	if found {
+		this.root, deleted = this.tree().delete(this.root, instance, this.comparator(), this.generation, this.running_checksum(), this.visits, this.arena);
+		if deleted {
+			this.negative_cache_delete(instance);
+			this.cached = nil;
+			this.count--;
+			this.count_deletes(1);
+			this.version++;
+			if this.journal != nil {
+				this.journal_record(journal_entry{op: OP_REMOVE, item: instance});
+			};
+		};
+	};
+	if this.auditing {
+		this.record(OP_REMOVE, item, deleted);
+	};
+	if this.self_check != nil {
+		this.self_check(this, "Remove", item);
+	};
+	if deleted && this.on_delete != nil {
+		this.callback(this.on_delete, instance);
+	};
+};
+
+// ApplyPatch removes the items in remove from the set and then adds those in
+// add (so an item in both lists ends up in the set) and returns the number of
+// items actually removed or inserted.  Together with Diff() this allows a
+// copy of a set to be brought up to date incrementally and, as items that are
+// already absent or present are skipped, applying the same patch twice is
+// harmless.  If either list contains a nil item the set is left unchanged
+// and ErrNilItem is returned.  Similarly, if the set's validator (see
+// WithValidator()) rejects any item in add the set is left unchanged and
+// the validator's error for the first such item is returned and if the
+// patched set would have more members than allowed by WithMaxLen() it is
+// left unchanged and ErrFull is returned.
+func (this *Set) ApplyPatch(add, remove []Item) (changed int, err os.Error) {
+	for _, list := range [][]Item{add, remove} {
+		for _, item := range list {
+			if is_nil(item) {
+				return 0, ErrNilItem;
+			};
+		};
+	};
+	for _, item := range add {
+		if err = this.validate(item); err != nil {
+			return 0, err;
+		};
+	};
+	if this.max_len > 0 && this.patched_len(add, remove) > this.max_len {
+		return 0, ErrFull;
+	};
+	for _, item := range remove {
+		count := this.count;
+		this.Remove(item);
+		if this.count != count {
+			changed++;
+		};
+	};
+	for _, item := range add {
+		if this.Add(item) {
+			changed++;
+		};
+	};
+	return;
+};
+
+// patched_len returns the number of members the set would have after
+// ApplyPatch(add, remove).
+func (this *Set) patched_len(add, remove []Item) uint {
+	removing, adding := this.similar(), this.similar();
+	for _, item := range remove {
+		removing.Add(item);
+	};
+	n := this.count;
+	inorder(removing.root, func(item Item) bool {
+		if _, found := this.lookup(item); found {
+			n--;
+		};
+		return true;
+	});
+	for _, item := range add {
+		if _, found := this.lookup(item); !found {
+			adding.Add(item);
+		} else if _, found = removing.lookup(item); found {
+			adding.Add(item);
+		};
+	};
+	return n + adding.count;
+};
+
+// DeleteRange removes the members of the set that are equal to or follow lo
+// and precede hi (in the order used by Iter()) and returns the number
+// removed.  A nil lo or hi leaves that end of the range unbounded.  If only a
+// few members are removed they are removed one at a time; otherwise the tree
+// is rebuilt from the survivors in linear time.  Either way each removal is
+// recorded (and reported to any OnDelete callback) individually.
+func (this *Set) DeleteRange(lo, hi Item) int {
+	this.check_not_in_callback("DeleteRange");
+	compare := this.comparator();
+	first, last := uint(0), this.count;
+	if !is_nil(lo) {
+		first = rank(this.root, this.normal(lo), compare);
+	};
+	if !is_nil(hi) {
+		last = rank(this.root, this.normal(hi), compare);
+	};
+	return this.delete_positions(first, last, "DeleteRange", lo);
+};
+
+// RemoveType removes every member of the set whose type is the same as
+// proto's and returns the number removed.  As the members of each type are
+// adjacent in the set's default order the range they occupy is found in
+// O(log n) time and they are then removed as by DeleteRange().  For a set
+// made with WithOrder() the members are found by visiting them all.
+func (this *Set) RemoveType(proto Item) (removed uint64) {
+	if is_nil(proto) {
+		return;
+	};
+	this.check_not_in_callback("RemoveType");
+	if this.compare != nil {
+		proto_type := reflect.Typeof(proto);
+		var items []Item;
+		inorder(this.root, func(item Item) bool {
+			if reflect.Typeof(item) == proto_type {
+				items = append(items, item);
+			};
+			return true;
+		});
+		for _, item := range items {
+			this.Remove(item);
+		};
+		return uint64(len(items));
+	};
+	// the members of types preceding proto's and those of types up to and
+	// including proto's
+	first := rank(this.root, proto, func(a, b Item) int { return cmp_type(a, b); });
+	last := rank(this.root, proto, func(a, b Item) int {
+		if ct := cmp_type(a, b); ct != 0 {
+			return ct;
+		};
+		return -1;
+	});
+	return uint64(this.delete_positions(first, last, "RemoveType", proto));
+};
+
+// delete_positions removes the members of the set at positions first to
+// last - 1 (in the order used by Iter()) on behalf of op (called with item)
+// and returns the number removed.
+func (this *Set) delete_positions(first, last uint, op string, item Item) int {
+	if last <= first {
+		return 0;
+	};
+	k := last - first;
+	removed := make([]Item, k);
+	for i := range removed {
+		removed[i] = select_item(this.root, first + uint(i));
+	};
+	var log2 uint;
+	for n := this.count; n > 0; n >>= 1 {
+		log2++;
+	};
+	// the rebuilt tree wouldn't have the checksum's record of the hashes
+	if k * log2 < this.count || this.checksumming {
+		for _, item := range removed {
+			this.Remove(item);
+		};
+		return int(k);
+	};
+	survivors := make([]Item, 0, this.count - k);
+	var i uint;
+	inorder(this.root, func(item Item) bool {
+		if i < first || i >= last {
+			survivors = append(survivors, item);
+		};
+		i++;
+		return true;
+	});
+	this.root = this.tree().build(survivors, this.arena);
+	this.cached = nil;
+	this.count -= k;
+	this.count_deletes(uint64(k));
+	this.version += uint64(k);
+	for _, item := range removed {
+		this.negative_cache_delete(item);
+		if this.auditing {
+			this.record(OP_REMOVE, item, true);
+		};
+		if this.journal != nil {
+			this.journal_record(journal_entry{op: OP_REMOVE, item: item});
+		};
+	};
+	if this.self_check != nil {
+		this.self_check(this, op, item);
+	};
+	if this.on_delete != nil {
+		for _, item := range removed {
+			this.callback(this.on_delete, item);
+		};
+	};
+	return int(k);
+};
+
+// Remove all items from the set.
+func (this *Set) Clear() {
+	this.check_not_in_callback("Clear");
+	var removed []Item;
+	if this.on_delete != nil {
+		removed = this.ToSlice();
+	};
+	if this.auditing {
+		this.record(OP_CLEAR, nil, this.count > 0);
+	};
+	if this.count > 0 {
+		this.version++;
+		if this.journal != nil {
+			this.journal_record(journal_entry{op: OP_CLEAR, items: this.ToSlice()});
+		};
+	};
+	count := this.count;
+	this.root = nil;
+	this.cached = nil;
+	this.checksum = 0;
+	this.count = 0;
+	this.count_deletes(uint64(count));
+	this.arena = this.arena.renew();
+	if this.negative != nil {
+		this.negative = new_negative_cache(this.negative.bits_per_item, 0);
+	};
+	for _, item := range removed {
+		this.callback(this.on_delete, item);
+	};
+};
+
+// DrainSorted removes all of the members from the set and returns them in the
+// order used by Iter().  As for Clear() the removal is recorded as a single
+// operation.
+func (this *Set) DrainSorted() []Item {
+	items := this.ToSlice();
+	this.Clear();
+	return items;
+};
+
+// BlackHeight returns the number of black nodes on each path from the root of
+// the set's red black tree to a leaf.  If the paths disagree (or the tree's
+// colouring is otherwise invalid) an os.Error describing the problem is
+// returned instead.  It is intended for use in testing and is only meaningful
+// for sets using the LLRB backend.
+func (this *Set) BlackHeight() (int, os.Error) {
+	black_height, _, err := check_colours(this.root);
+	return black_height, err;
+};
+
+func count_colours(node *ll_rb_node, red, black *int) {
+	if node == nil {
+		return;
+	};
+	if node.red {
+		*red++;
+	} else {
+		*black++;
+	};
+	count_colours(node.left, red, black);
+	count_colours(node.right, red, black);
+};
+
+// ColorCounts returns the number of red and black nodes in the set's tree.
+// As red nodes lean left and are never adjacent each black node has at most
+// one red child so red never exceeds black.  It is intended for use in
+// testing.  The nodes of other backends' trees are all black.
+func (this *Set) ColorCounts() (red, black int) {
+	count_colours(this.root, &red, &black);
+	return;
+};
+
+// CheckInvariants examines the internal structure of the set (the balance
+// invariants of its backend's tree, the order of the items and the
+// cardinality) and returns an os.Error describing the first violation found
+// or nil if there are none.  It is intended for use in testing.
+func (this *Set) CheckInvariants() os.Error {
+	count, err := this.tree().check(this.root);
+	if err != nil {
+		return err;
+	};
+	if count != this.count {
+		return os.NewError(fmt.Sprintf("heteroset: cardinality %v but %v nodes", this.count, count));
+	};
+	_, err = check_order(this.root, nil, this.comparator());
+	return err;
+};
+
+// Validate calls Precedes() (both ways) on each pair of adjacent items of the
+// same type in the set and returns a *CompareError identifying the items if
+// any of the calls panic.  This is intended to help debug Item implementations.
+func (this *Set) Validate() (err os.Error) {
+	var last Item;
+	inorder(this.root, func(item Item) bool {
+		if last != nil && cmp_type(last, item) == 0 {
+			err = protected_compare(last, item);
+		};
+		last = item;
+		return err == nil;
+	});
+	return;
+};
+
+// Walk calls fn for each member of the set (in the same order as Iter())
+// passing the depth (zero for the root) and colour of the tree node holding
+// it.  This is intended for rendering the tree and analysing its balance.
+func (this *Set) Walk(fn func(item Item, depth int, red bool)) {
+	walk(this.root, 0, fn);
+};
+
+// Iterate over the set members in arbitrary type order and in order within type.
+func (this *Set) Iter() <-chan Item {
+	c := make(chan Item);
+	this.count_iterator();
+	go iterate(this.root, c);
+	return c;
+};
+
+// SnapshotIter returns a sequence of the set's current members (in the order
+// used by Iter()) which isn't affected by later changes to the set.  Taking
+// the snapshot is O(1): the set's tree is shared with the snapshot and the
+// set copies each shared node the first time it needs to modify it, so
+// later changes cost extra time and memory only until the shared nodes they
+// touch have been copied.  The sequence may be used in another goroutine
+// while the set is being modified (but not while SnapshotIter() itself is
+// called).
+func (this *Set) SnapshotIter() Seq {
+	root := this.root;
+	this.count_iterator();
+	if root != nil {
+		this.generation = new_generation();
+	};
+	return func(yield func(item Item) bool) {
+		inorder(root, yield);
+	};
+};
+
+// Iterate asynchronously over the set members in arbitrary type order and in
+// order within type. This method uses more memory than Iter() and is only
+// recommended for use when circumstances preclude the use of Iter().
+func (this *Set) IterAsync() <-chan Item {
+	c := make(chan Item, this.count);
+	this.count_iterator();
+	iterate(this.root, c);
+	return c;
+};
+
+// TypeGroup is the set members of a single type as delivered by IterByType().
+type TypeGroup struct {
+	// the type's name as given by reflect.Typeof(item).String()
+	Type string;
+	// in the order used by Iter()
+	Items []Item;
+};
+
+// IterByType delivers the set's members grouped by type with the groups in
+// the same order as the types are encountered by Iter().  The groups are
+// assembled before the channel is returned so it can be abandoned without
+// leaking a goroutine.
+func (this *Set) IterByType() <-chan TypeGroup {
+	var groups []TypeGroup;
+	inorder(this.root, func(item Item) bool {
+		if n := len(groups); n == 0 || cmp_type(groups[n - 1].Items[0], item) != 0 {
+			groups = append(groups, TypeGroup{reflect.Typeof(item).String(), nil});
+		};
+		last := &groups[len(groups) - 1];
+		last.Items = append(last.Items, item);
+		return true;
+	});
+	c := make(chan TypeGroup, len(groups));
+	this.count_iterator();
+	for _, group := range groups {
+		c <- group;
+	};
+	close(c);
+	return c;
+};
+
+// TypeHistogram returns a map from the name of each type in the set (as
+// given by reflect.Typeof(item).String()) to the number of members of that
+// type.  The members of each type are adjacent so only one name is looked
+// up per type.  Distinct types with the same name share a count.
+func (this *Set) TypeHistogram() map[string]uint64 {
+	histogram := make(map[string]uint64);
+	var first Item;
+	var count uint64;
+	tally := func() {
+		if first != nil {
+			histogram[reflect.Typeof(first).String()] += count;
+		};
+	};
+	inorder(this.root, func(item Item) bool {
+		if first == nil || cmp_type(first, item) != 0 {
+			tally();
+			first, count = item, 0;
+		};
+		count++;
+		return true;
+	});
+	tally();
+	return histogram;
+};
+
+// RoundRobinByType returns a sequence of the set's members that takes one
+// member of each type in turn: the first member of each type (with the types
+// in the order used by IterByType()), then the second of each and so on.
+// Types that run out of members drop out.  The members are grouped by type
+// when iteration starts so the set may be modified while the sequence is in
+// use without affecting it.
+func (this *Set) RoundRobinByType() Seq {
+	this.count_iterator();
+	return func(yield func(item Item) bool) {
+		var groups [][]Item;
+		inorder(this.root, func(item Item) bool {
+			if n := len(groups); n == 0 || cmp_type(groups[n - 1][0], item) != 0 {
+				groups = append(groups, nil);
+			};
+			groups[len(groups) - 1] = append(groups[len(groups) - 1], item);
+			return true;
+		});
+		for round := 0; len(groups) > 0; round++ {
+			live := groups[0:0];
+			for _, group := range groups {
+				if !yield(group[round]) {
+					return;
+				};
+				if round + 1 < len(group) {
+					live = append(live, group);
+				};
+			};
+			groups = live;
+		};
+	};
+};
+
+// GroupBy partitions the set's members into groups of members related by
+// equiv.  The members are scanned in the order used by Iter() and each is
+// added to the first group whose first member it is related to (or starts a
+// new group) so the groups are ordered by their first members and the
+// members of each group are in order.  As only first members are compared
+// equiv must be an equivalence relation (in particular transitive) for the
+// result to be a true partition.  It takes O(n * g) time for g groups.
+func (this *Set) GroupBy(equiv func(a, b Item) bool) (groups [][]Item) {
+	inorder(this.root, func(item Item) bool {
+		for i, group := range groups {
+			if equiv(group[0], item) {
+				groups[i] = append(group, item);
+				return true;
+			};
+		};
+		groups = append(groups, []Item{item});
+		return true;
+	});
+	return;
+};
+
+// LongestConsecutive returns the longest run of the set's members (in the
+// order used by Iter()) in which each member is next() of the one before
+// according to equal.  E.g. for a set of Ints with next adding one it is
+// the longest stretch without gaps.  next must return an item that follows
+// its argument in the set's order (or nil if there is none) so that a
+// member's successor, if present, is the member after it and the set is
+// scanned once without any look ups.  Of runs of the same length the first
+// is returned and the result is empty only if the set is.
+func (this *Set) LongestConsecutive(next func(Item) Item, equal func(a, b Item) bool) (longest []Item) {
+	var run []Item;
+	inorder(this.root, func(item Item) bool {
+		if len(run) > 0 {
+			if successor := next(run[len(run) - 1]); is_nil(successor) || !equal(successor, item) {
+				if len(run) > len(longest) {
+					longest = run;
+				};
+				run = nil;
+			};
+		};
+		run = append(run, item);
+		return true;
+	});
+	if len(run) > len(longest) {
+		longest = run;
+	};
+	if longest == nil {
+		longest = []Item{};
+	};
+	return;
+};
+
+// The functions of two (or more) sets use the order and equality of the
+// first set.  The sets can only be walked in step if their members are in
+// the same order and their positions in it decide whether they are equal
+// i.e. neither set was made with an equal function (see WithOrder()) and
+// either both use the default order or they were given it by the same
+// Options.  (Functions can't be compared so sets made by separate calls of
+// WithOrder() are assumed to differ.)  Otherwise members have to be looked up
+// individually.
+func in_step(setA, setB *Set) (compare func(a, b Item) int, ordered bool) {
+	ordered = setA.equal == nil && setB.equal == nil && setA.compare_id == setB.compare_id && setA.fallback_id == setB.fallback_id;
+	return setA.comparator(), ordered;
+};
+
+// all_in_step reports whether all of sets can be walked in step with the
+// first of them.
+func all_in_step(sets []*Set) bool {
+	for _, set := range sets {
+		if _, ordered := in_step(sets[0], set); !ordered {
+			return false;
+		};
+	};
+	return true;
+};
+
+// Walk setA and setB in tandem (in the order used by Iter()) calling fn for
+// each distinct member of either set with its instances in setA and setB as
+// a and b.  Only one of a or b is non nil unless both sets have the member.
+// The walk stops if fn returns false.  If the sets can't be walked in step
+// (see in_step()) the members of setA are visited in order followed by
+// those of setB that aren't in setA and each takes a look up in the other
+// set.
+func tandem(setA, setB *Set, fn func(a, b Item) bool) {
+	compare, ordered := in_step(setA, setB);
+	if !ordered {
+		more := true;
+		inorder(setA.root, func(a Item) bool {
+			b, _ := setB.lookup(a);
+			more = fn(a, b);
+			return more;
+		});
+		if more {
+			inorder(setB.root, func(b Item) bool {
+				if _, found := setA.lookup(b); found {
+					return true;
+				};
+				return fn(nil, b);
+			});
+		};
+		return;
+	};
+	ca, cb := setA.Cursor(), setB.Cursor();
+	for ok := true; ok && (ca.Valid() || cb.Valid()); {
+		a, _ := ca.Item();
+		b, _ := cb.Item();
+		cmp := 0;
+		if a == nil {
+			cmp = 1;
+		} else if b == nil {
+			cmp = -1;
+		} else {
+			cmp = compare(a, b);
+		};
+		switch {
+		case cmp < 0:
+			ok = fn(a, nil);
+			ca.Next();
+		case cmp > 0:
+			ok = fn(nil, b);
+			cb.Next();
+		default:
+			ok = fn(a, b);
+			ca.Next();
+			cb.Next();
+		};
+	};
+};
+
+// CountDiff returns the number of members only in this set, in both this set
+// and other, and only in other.  It makes a single pass over the two sets
+// without building any intermediate sets.
+func (this *Set) CountDiff(other *Set) (onlyA, shared, onlyB uint64) {
+	tandem(this, other, func(a, b Item) bool {
+		switch {
+		case b == nil:
+			onlyA++;
+		case a == nil:
+			onlyB++;
+		default:
+			shared++;
+		};
+		return true;
+	});
+	return;
+};
+
+// Overlaps reports whether this set and other have any members in common
+// and, if so, how many.  Like CountDiff() it makes a single pass over the
+// two sets rather than building their intersection.
+func (this *Set) Overlaps(other *Set) (overlaps bool, shared uint64) {
+	tandem(this, other, func(a, b Item) bool {
+		if a != nil && b != nil {
+			shared++;
+		};
+		return true;
+	});
+	return shared > 0, shared;
+};
+
+// SymmetricDifferenceCount returns the number of members that are in only
+// one of this set and other i.e. the cardinality of their symmetric
+// difference.  The sets are compared in a single pass without building the
+// difference.
+func (this *Set) SymmetricDifferenceCount(other *Set) (count uint64) {
+	tandem(this, other, func(a, b Item) bool {
+		if a == nil || b == nil {
+			count++;
+		};
+		return true;
+	});
+	return;
+};
+
+// Diff returns (in the order used by Iter()) the members that are only in
+// this set and those that are only in other, computed in a single pass over
+// both sets.  Members that are equal (according to Precedes()) are
+// considered unchanged even if they differ in other ways, e.g. the value
+// part of (key, value) items.
+func (this *Set) Diff(other *Set) (onlyInReceiver, onlyInOther []Item) {
+	onlyInReceiver, onlyInOther = []Item{}, []Item{};
+	tandem(this, other, func(a, b Item) bool {
+		if b == nil {
+			onlyInReceiver = append(onlyInReceiver, a);
+		} else if a == nil {
+			onlyInOther = append(onlyInOther, b);
+		};
+		return true;
+	});
+	return;
+};
+
+// DiffStringLimit is the maximum number of item lines included in the
+// output of DiffString().
+var DiffStringLimit = 20;
+
+// DiffString returns a description of the differences between two sets
+// suitable for test failure messages.  Items only in setA are prefixed by
+// "-" and those only in setB by "+" and they are grouped under a header for
+// their type.  At most DiffStringLimit items are listed and the report ends
+// with a summary of the numbers of items in each category.  The empty string
+// is returned if the sets are equal.
+func DiffString(setA, setB *Set) (report string) {
+	var onlyA, onlyB, lines int;
+	var last reflect.Type;
+	tandem(setA, setB, func(a, b Item) bool {
+		var line string;
+		switch {
+		case b == nil:
+			onlyA++;
+			line = fmt.Sprintf("-%v\n", a);
+		case a == nil:
+			onlyB++;
+			a, line = b, fmt.Sprintf("+%v\n", b);
+		default:
+			return true;
+		};
+		if lines++; lines <= DiffStringLimit {
+			if t := reflect.Typeof(a); t != last {
+				report += fmt.Sprintf("@@ %v @@\n", t);
+				last = t;
+			};
+			report += line;
+		};
+		return true;
+	});
+	if lines == 0 {
+		return;
+	};
+	if lines > DiffStringLimit {
+		report += fmt.Sprintf("... %d more\n", lines - DiffStringLimit);
+	};
+	return report + fmt.Sprintf("%d only in first set, %d only in second set\n", onlyA, onlyB);
+};
+
+func in_size_order(setA, setB *Set) (smallest, other *Set) {
+	if setA.Cardinality() < setB.Cardinality() {
+		smallest, other = setA, setB;
+	} else {
+		smallest, other = setB, setA;
+	};
+	return;
+};
+
+// Disjoint returns true if setA and setB have no members in common
+func Disjoint(setA, setB *Set) bool {
+	smallest, other := in_size_order(setA, setB);
+	for item := range smallest.Iter() {
+		if other.Has(item) {
+			return false;
+		};
+	};
+	return true;
+};
+
+// Intersect returns true if setA and setB have at least one member common
+func Intersect(setA, setB *Set) bool {
+	smallest, other := in_size_order(setA, setB);
+	for item := range smallest.Iter() {
+		if other.Has(item) {
+			return true;
+		};
+	};
+	return false;
+};
+
+// Subset returns true if every member of setA is also member of setB
+//	Intersection(setA, setB) == setA
+// The sets are walked in tandem so this takes O(n + m) time and stops at the
+// first member of setA missing from setB.
+func Subset(setA, setB *Set) bool {
+	if setA.Cardinality() > setB.Cardinality() { return false; };
+	subset := true;
+	matched := uint(0);
+	tandem(setA, setB, func(a, b Item) bool {
+		if b == nil {
+			subset = false;
+			return false;
+		};
+		if a != nil {
+			matched++;
+		};
+		// no need to walk the rest of setB
+		return matched < setA.count;
+	});
+	return subset;
+};
+
+// ProperSubset returns true if every member of setA is also member of setB
+// and they are not equal
 //	Intersection(setA, setB) == setA && setA != setB
 func ProperSubset(setA, setB *Set) bool {
 	if setA.Cardinality() >= setB.Cardinality() { return false; };
@@ -390,75 +2904,233 @@ func ProperSuperset(setA, setB *Set) bool {
 
 // Equal returns true if setA and setB contain exactly the same members
 //	Intersection(setA, setB) == setA == setB
+// The sets are walked in step and compared member by member so this takes
+// O(n) time in the worst case and stops at the first difference.  If the
+// sets can't be walked in step (see in_step()) the members of setA are
+// instead looked up in setB (using its equality).
 func Equal(setA, setB *Set) bool {
 	if setA.Cardinality() != setB.Cardinality() { return false; };
-	return Subset(setA, setB);
-};
-
-// Precedes() implements Item.Precedes() method for sets so that sets of sets are
-// possible
-func (this *Set) Precedes(other interface{}) bool {
-	thisiter := this.Iter();
-	otheriter := other.(*Set).Iter();
-	for {
-		thisitem, this_ok := <- thisiter;
-		otheritem, other_ok := <- otheriter;
-		if !this_ok {
-			return !other_ok;
-		} else if !other_ok {
+	compare, ordered := in_step(setA, setB);
+	if !ordered {
+		equal := true;
+		inorder(setA.root, func(item Item) bool {
+			_, equal = setB.lookup(item);
+			return equal;
+		});
+		return equal;
+	};
+	ca, cb := setA.Cursor(), setB.Cursor();
+	for ; ca.Valid(); ca.Next() {
+		a, _ := ca.Item();
+		b, _ := cb.Item();
+		if compare(a, b) != 0 {
 			return false;
 		};
-		ct := cmp_type(thisitem, otheritem);
-		if ct == 0 {
-			if thisitem.Precedes(otheritem) {
-				return true;
-			} else if otheritem.Precedes(thisitem) {
-				return false;
-			};
-		} else {
-			return ct < 0;
+		cb.Next();
+	};
+	return true;
+};
+
+// Hash returns a hash of the set's contents.  The per item hashes are
+// combined with XOR so the result does not depend on the order in which the
+// items were added and sets that are Equal() have equal hashes.  Items that
+// have a (key, value) structure should implement Hasher (using only the key)
+// as the encoding used for other items includes the whole item.
+func (this *Set) Hash() (hash uint64) {
+	for item := range this.Iter() {
+		hash ^= hash_item(item);
+	};
+	return;
+};
+
+// Compare returns -1, 0 or 1 as the members of setA (in the order used by
+// Iter()) precede, equal or follow those of setB when compared
+// lexicographically.  A set precedes any longer set that it is a prefix of.
+// The comparison is positional: members are compared by their positions in
+// setA's order and any equal function given to WithOrder() is ignored.  This
+// makes it a total order in which only sets whose members match position
+// for position compare as 0.  That is the same as Equal() if the sets can be
+// walked in step (see in_step()) but otherwise Equal() sets (e.g. with their
+// members in different orders) may compare as non zero.
+func Compare(setA, setB *Set) int {
+	compare := setA.comparator();
+	ca, cb := setA.Cursor(), setB.Cursor();
+	for ; ca.Valid() && cb.Valid(); ca.Next() {
+		a, _ := ca.Item();
+		b, _ := cb.Item();
+		if cmp := compare(a, b); cmp < 0 {
+			return -1;
+		} else if cmp > 0 {
+			return 1;
 		};
+		cb.Next();
 	};
-	return false;
+	switch {
+	case ca.Valid():
+		return 1;
+	case cb.Valid():
+		return -1;
+	};
+	return 0;
+};
+
+// Precedes() implements Item.Precedes() method for sets so that sets of sets are
+// possible.  The order is that of Compare().  As all sets have the same type
+// they form a single band among the members of a heterogeneous set and sets
+// may be nested to any depth.
+//
+// WARNING: a set must NOT be changed while it is a member of another set.
+// Its position in the outer set's tree was decided by its members when it
+// was added so changing them silently breaks the outer set's order and look
+// ups (including Has() and Remove() of the changed set itself) may then fail.
+// CheckInvariants() reports such a corrupted outer set.  Either add a Copy()
+// of a set that will go on changing or remove it from the outer set, change
+// it and add it again.
+func (this *Set) Precedes(other interface{}) bool {
+	return Compare(this, other.(*Set)) < 0;
 };
 
 // Union returns a set that is the union of setA and setB
 //	for any Item i:
 //		(setA.Has(i) || setB.Has(i)) == Union(setA, setB).Has(i)
+// Where both sets have a member the instance in setA is used.  It is built
+// from the output of UnionIter() in linear time unless the sets can't be
+// walked in step (see in_step()) in which case setB's members are added to
+// a copy of setA one at a time.  If both sets use a treap their trees are
+// instead split and joined in O(m log(n/m)) expected time (where m is the
+// size of the smaller set).  Like the results of the other set algebra
+// functions it has the same order, equality and backend as setA.
 func Union(setA, setB *Set) (set *Set) {
-	smallest, other := in_size_order(setA, setB);
-	set = other.Copy();
-	for item := range smallest.Iter() {
-		set.Add(item);
+	if treaps(setA, setB) {
+		generation := share(setA, setB);
+		return setA.similar_tree(treap_union(setA.root, setB.root, setA.comparator(), generation), generation);
 	};
-	return;
+	if _, ordered := in_step(setA, setB); !ordered {
+		set = setA.Copy();
+		inorder(setB.root, func(item Item) bool {
+			if _, found := set.lookup(item); !found {
+				set.Add(item);
+			};
+			return true;
+		});
+		return;
+	};
+	items := make([]Item, 0, setA.count + setB.count);
+	UnionIter(setA, setB)(func(item Item) bool {
+		items = append(items, item);
+		return true;
+	});
+	return setA.similar_from(items);
+};
+
+// Merge returns the union of setA and setB.  It is meant for recombining
+// sets made by Split() or SplitAt(): if both sets use a treap and every
+// member of setA precedes every member of setB their trees are joined in
+// O(log n) time.  Otherwise it is the same as Union().
+func Merge(setA, setB *Set) (set *Set) {
+	if !treaps(setA, setB) || setA.root == nil || setB.root == nil {
+		return Union(setA, setB);
+	};
+	last := select_item(setA.root, setA.root.size - 1);
+	if setA.comparator()(last, select_item(setB.root, 0)) >= 0 {
+		return Union(setA, setB);
+	};
+	generation := share(setA, setB);
+	return setA.similar_tree(treap_join(setA.root, setB.root, generation), generation);
+};
+
+// UnionAll returns a set that is the union of all of sets.  Where more than
+// one of the sets has a member the instance from the first of them is used.
+// It is built from the output of MergeIter() in a single pass rather than by
+// repeated calls to Union().  With no arguments it returns an empty set and
+// with one it returns a copy.  As for Union(), if the sets can't all be
+// walked in step with the first (see in_step()) the members of the others
+// are added to a copy of it one at a time.
+func UnionAll(sets ...*Set) (set *Set) {
+	switch len(sets) {
+	case 0:
+		return New();
+	case 1:
+		return sets[0].Copy();
+	};
+	if !all_in_step(sets) {
+		set = sets[0].Copy();
+		for _, other := range sets[1:] {
+			inorder(other.root, func(item Item) bool {
+				if _, found := set.lookup(item); !found {
+					set.Add(item);
+				};
+				return true;
+			});
+		};
+		return;
+	};
+	total := uint(0);
+	for _, set := range sets {
+		total += set.count;
+	};
+	items := make([]Item, 0, total);
+	MergeIter(sets...)(func(item Item) bool {
+		items = append(items, item);
+		return true;
+	});
+	return sets[0].similar_from(items);
+};
+
+// MergeSortedSlices returns the members of setA and setB (in the order used
+// by Iter()) in a single slice.  Unlike Union() members of both sets appear
+// twice (setA's instance first) which is useful for building multisets.
+func MergeSortedSlices(setA, setB *Set) []Item {
+	items := make([]Item, 0, setA.count + setB.count);
+	tandem(setA, setB, func(a, b Item) bool {
+		if a != nil {
+			items = append(items, a);
+		};
+		if b != nil {
+			items = append(items, b);
+		};
+		return true;
+	});
+	return items;
 };
 
 // Intersection returns a set that is the intersection of setA and setB
 //	for any Item i:
 //		(setA.Has(i) && setB.Has(i)) == Intersection(setA, setB).Has(i)
+// The instances in setA are used.  It is built from the output of
+// IntersectIter() (which is in setA's order whether or not the sets can be
+// walked in step) in linear time or, if both sets use a treap, by splitting
+// and joining their trees.
 func Intersection(setA, setB *Set) (set *Set) {
-	smallest, other := in_size_order(setA, setB);
-	set = New();
-	for item := range smallest.Iter() {
-		if other.Has(item) {
-			set.Add(item);
-		};
+	if treaps(setA, setB) {
+		generation := share(setA, setB);
+		return setA.similar_tree(treap_intersection(setA.root, setB.root, setA.comparator(), generation), generation);
 	};
-	return;
+	items := make([]Item, 0, min(int(setA.count), int(setB.count)));
+	IntersectIter(setA, setB)(func(item Item) bool {
+		items = append(items, item);
+		return true;
+	});
+	return setA.similar_from(items);
 };
 
 // Difference returns a set that contains the items in setA minus any items in setB
 //	for any Item i:
 //		(setA.Has(i) && !setB.Has(i)) == Difference(setA, setB).Has(i)
+// It is built from the output of DifferenceIter() (which is in setA's order
+// whether or not the sets can be walked in step) in linear time or, if both
+// sets use a treap, by splitting and joining their trees.
 func Difference(setA, setB *Set) (set *Set) {
-	set = New();
-	for item := range setA.Iter() {
-		if !setB.Has(item) {
-			set.Add(item);
-		};
+	if treaps(setA, setB) {
+		generation := share(setA, setB);
+		return setA.similar_tree(treap_difference(setA.root, setB.root, setA.comparator(), generation), generation);
 	};
-	return;
+	items := make([]Item, 0, setA.count);
+	DifferenceIter(setA, setB)(func(item Item) bool {
+		items = append(items, item);
+		return true;
+	});
+	return setA.similar_from(items);
 };
 
 // SymmetricDifference returns a set that contains the items in setA minus or setB
@@ -466,7 +3138,13 @@ func Difference(setA, setB *Set) (set *Set) {
 //	for any Item i:
 //		((setA.Has(i) && !setB.Has(i)) || (!setA.Has(i) && setB.Has(i))) == SymmetricDifference(setA, setB).Has(i)
 func SymmetricDifference(setA, setB *Set) (set *Set) {
-	set = New();
+	if treaps(setA, setB) {
+		compare, generation := setA.comparator(), share(setA, setB);
+		a := treap_difference(setA.root, setB.root, compare, generation);
+		b := treap_difference(setB.root, setA.root, compare, generation);
+		return setA.similar_tree(treap_union(a, b, compare, generation), generation);
+	};
+	set = setA.similar();
 	for item := range setA.Iter() {
 		if !setB.Has(item) {
 			set.Add(item);
@@ -4,18 +4,21 @@
 package heteroset;
 
 import (
+	"container/heap";
+	"expvar";
+	"json";
+	"math";
+	"os";
+	"sort";
 	"testing";
 	"rand";
 	"reflect";
 	"fmt";
+	"strings";
+	"testing/quick";
+	"time";
 )
 
-type Int int;
-
-func (i Int) Precedes(other interface{}) bool {
-	return int(i) < int(other.(Int));
-};
-
 type Real float64;
 
 func (r Real) Precedes(other interface{}) bool {
@@ -304,3 +307,4657 @@ func TestIntersection(t *testing.T) {
 	};
 };
 
+
+func TestHash(t *testing.T) {
+	setA, setB := New(), New();
+	for i := 0; i < 100; i++ {
+		setA.Add(Int(i));
+		setA.Add(Real(i));
+		setB.Add(Real(99 - i));
+		setB.Add(Int(99 - i));
+	};
+	if setA.Hash() != setB.Hash() {
+		t.Errorf("Equal sets built in different orders should hash identically");
+	};
+	setB.Remove(Real(50));
+	if setA.Hash() == setB.Hash() {
+		t.Errorf("Unequal sets should (probably) have different hashes");
+	};
+	if New().Hash() != 0 {
+		t.Errorf("Expected empty set hash 0: got %v", New().Hash());
+	};
+	if New(Int(1)).Hash() == New(Real(1)).Hash() {
+		t.Errorf("Items of different types should hash differently");
+	};
+};
+
+func TestRemove(t *testing.T) {
+	set := New();
+	set.Remove(Int(1));
+	set.Add(Int(1));
+	set.Remove(Int(2));
+	set.Remove(Real(1));
+	if set.Cardinality() != 1 {
+		t.Errorf("Expected count 1: got %v", set.Cardinality());
+	};
+	set.Remove(Int(1));
+	if set.Cardinality() != 0 || set.root != nil {
+		t.Errorf("Expected empty set: got %v", set.Cardinality());
+	};
+	for i := 0; i < 1000; i++ {
+		set.Add(Int(rand.Intn(500)));
+		set.Remove(Int(rand.Intn(500)));
+		if err := set.CheckInvariants(); err != nil {
+			t.Fatalf("%v", err);
+		};
+	};
+};
+
+type walk_record struct {
+	item Item;
+	depth int;
+	red bool;
+};
+
+// The node with the least depth in an in order sequence is the root of the
+// subtree so the tree's shape can be reconstructed from Walk()'s output.
+// Returns the black height of the subtree.
+func check_walk_records(t *testing.T, records []walk_record, depth int, parent_red, is_right bool) int {
+	if len(records) == 0 {
+		return 0;
+	};
+	root := 0;
+	for i, record := range records {
+		if record.depth < records[root].depth {
+			root = i;
+		};
+	};
+	record := records[root];
+	if record.depth != depth {
+		t.Errorf("%v: expected depth %v got %v", record.item, depth, record.depth);
+	};
+	if record.red && (parent_red || is_right || depth == 0) {
+		t.Errorf("%v: misplaced red node at depth %v", record.item, depth);
+	};
+	lbh := check_walk_records(t, records[0:root], depth + 1, record.red, false);
+	rbh := check_walk_records(t, records[root + 1:], depth + 1, record.red, true);
+	if lbh != rbh {
+		t.Errorf("%v: unequal black heights %v and %v", record.item, lbh, rbh);
+	};
+	if !record.red {
+		lbh++;
+	};
+	return lbh;
+};
+
+func TestWalk(t *testing.T) {
+	set := New();
+	for i := 0; i < 3000; i++ {
+		set.Add(Int(rand.Intn(10000)));
+		set.Add(Real(rand.Float64()));
+	};
+	records := make([]walk_record, 0, set.Cardinality());
+	set.Walk(func(item Item, depth int, red bool) {
+		records = append(records, walk_record{item, depth, red});
+	});
+	if uint(len(records)) != set.Cardinality() {
+		t.Errorf("Expected %v items got %v", set.Cardinality(), len(records));
+	};
+	log2 := 0;
+	for n := len(records); n > 1; n >>= 1 {
+		log2++;
+	};
+	i := 0;
+	for item := range set.Iter() {
+		if records[i].item != item {
+			t.Errorf("Walk() order differs from Iter() at %v", i);
+		};
+		if records[i].depth > 2 * (log2 + 1) {
+			t.Errorf("%v: depth %v exceeds 2 * log2(%v)", item, records[i].depth, len(records));
+		};
+		i++;
+	};
+	check_walk_records(t, records, 0, false, false);
+};
+
+func TestClear(t *testing.T) {
+	set := New(Int(1), Int(2), Real(3));
+	set.Clear();
+	if set.Cardinality() != 0 || set.Has(Int(1)) {
+		t.Errorf("Expected empty set: got %v", set.Cardinality());
+	};
+	set.Add(Int(4));
+	if set.Cardinality() != 1 || !set.Has(Int(4)) {
+		t.Errorf("Expected set with Int(4): got %v", set.Cardinality());
+	};
+};
+
+func TestApplyOps(t *testing.T) {
+	data := make([]byte, 20000);
+	for i := range data {
+		data[i] = byte(rand.Intn(256));
+	};
+	if err := ApplyOps(OpsFromBytes(data)); err != nil {
+		t.Errorf("%v", err);
+	};
+	if err := ApplyOps([]Op{Op{OP_FIND, 1}, Op{99, 1}}); err == nil {
+		t.Errorf("Expected error for unknown operation kind");
+	};
+};
+
+func TestApplyOpsQuick(t *testing.T) {
+	f := func(data []byte) bool {
+		return ApplyOps(OpsFromBytes(data)) == nil;
+	};
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+// Precedes() panics when armed and either item is 13
+type Fussy int;
+
+var fussy_armed bool;
+
+func (f Fussy) Precedes(other interface{}) bool {
+	if fussy_armed && (f == 13 || other.(Fussy) == 13) {
+		panic("unlucky");
+	};
+	return int(f) < int(other.(Fussy));
+};
+
+func TestValidate(t *testing.T) {
+	set := New(Int(1), Real(2));
+	for i := 0; i < 20; i++ {
+		set.Add(Fussy(i));
+	};
+	fussy_armed = true;
+	defer func() { fussy_armed = false; }();
+	err := set.Validate();
+	if err == nil {
+		t.Fatalf("Expected Validate() to fail");
+	};
+	if strings.Index(err.String(), "12 and 13") < 0 {
+		t.Errorf("Expected error to identify the items: got %v", err);
+	};
+	if New(Int(1), Real(2), Fussy(14)).Validate() != nil {
+		t.Errorf("Unexpected Validate() failure");
+	};
+};
+
+func try_add(set *Set, item Item) (x interface{}) {
+	defer func() { x = recover(); }();
+	set.Add(item);
+	return;
+};
+
+func TestSelfCheck(t *testing.T) {
+	set := Make(WithSelfCheck(true));
+	for i := 0; i < 100; i++ {
+		set.Add(Int(i));
+		set.Remove(Int(i / 2));
+	};
+	good_rotate_left := rotate_left;
+	defer func() { rotate_left = good_rotate_left; }();
+	var corrupted bool;
+	// loses the subtree that should move across
+	rotate_left = func(node *ll_rb_node, generation uint) *ll_rb_node {
+		corrupted = corrupted || node.right.left != nil;
+		tmp := good_rotate_left(node, generation);
+		node.right = nil;
+		return tmp;
+	};
+	for i := 100; !corrupted && i < 1000; i++ {
+		x := try_add(set, Int(i));
+		if corrupted && x == nil {
+			t.Errorf("Self check missed the corruption caused by Add(%v)", i);
+		} else if !corrupted && x != nil {
+			t.Errorf("Unexpected panic: %v", x);
+		} else if x != nil && strings.Index(fmt.Sprint(x), fmt.Sprintf("after Add(%v)", i)) < 0 {
+			t.Errorf("Panic should identify the operation: %v", x);
+		};
+	};
+	if !corrupted {
+		t.Errorf("Faulty rotation never corrupted the tree");
+	};
+	if try_add(Make(WithSelfCheck(false)), Int(1)) != nil {
+		t.Errorf("Unexpected panic with self check off");
+	};
+};
+
+func TestNilItem(t *testing.T) {
+	set := New(Int(1), Real(2));
+	if set.Add(nil) {
+		t.Errorf("Add(nil) should return false");
+	};
+	if set.Cardinality() != 2 {
+		t.Errorf("Expected count 2: got %v", set.Cardinality());
+	};
+	if set.Has(nil) {
+		t.Errorf("Unexpectedly has nil");
+	};
+	set.Remove(nil);
+	if set.Cardinality() != 2 || New(nil).Cardinality() != 0 {
+		t.Errorf("nil should be ignored");
+	};
+	if !set.Add(Int(3)) || set.Add(Int(3)) {
+		t.Errorf("Add() should report whether the item was newly inserted");
+	};
+};
+
+func read_expvar(t *testing.T, name string) (stats map[string]interface{}) {
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil {
+		t.Fatalf("%v", err);
+	};
+	return;
+};
+
+func TestPublishExpvar(t *testing.T) {
+	for run := 0; run < 2; run++ {
+		set := New();
+		set.PublishExpvar("heteroset_test");
+		for i := 0; i < 7; i++ {
+			set.Add(Int(i));
+		};
+		set.Add(Int(3));
+		set.Remove(Int(4));
+		set.Has(Real(1));
+		// removing an absent item isn't a failed look up
+		set.Remove(Int(100));
+		for _ = range set.Iter() {
+		};
+		expected := map[string]string{
+			"length": "6",
+			"height": fmt.Sprint(left_spine_height(set.root)),
+			"inserts": "7",
+			"deletes": "1",
+			"failed_finds": "1",
+			"iterators": "1",
+		};
+		stats := read_expvar(t, "heteroset_test");
+		for key, value := range expected {
+			if fmt.Sprint(stats[key]) != value {
+				t.Errorf("Run %v: expected %v %v: got %v", run, key, value, stats[key]);
+			};
+		};
+		set.Clear();
+		if stats = read_expvar(t, "heteroset_test"); fmt.Sprint(stats["length"]) != "0" || fmt.Sprint(stats["deletes"]) != "7" {
+			t.Errorf("Run %v: Clear() not reflected: %v", run, stats);
+		};
+	};
+};
+
+func TestTakeDrop(t *testing.T) {
+	set := make_Int_set_serial(0, 9);
+	set.Add(Real(0.5));
+	items := make([]Item, 0, 11);
+	for item := range set.Iter() {
+		items = append(items, item);
+	};
+	for _, n := range []int{-1, 0, 1, 5, 10, 11, 20} {
+		take, drop := set.Take(n), set.Drop(n);
+		split := n;
+		if split < 0 {
+			split = 0;
+		} else if split > len(items) {
+			split = len(items);
+		};
+		if take.Cardinality() != uint(split) || drop.Cardinality() != uint(len(items) - split) {
+			t.Errorf("Take/Drop(%v): unexpected sizes %v and %v", n, take.Cardinality(), drop.Cardinality());
+		};
+		for i, item := range items {
+			if take.Has(item) != (i < split) || drop.Has(item) != (i >= split) {
+				t.Errorf("Take/Drop(%v): %v in wrong set", n, item);
+			};
+		};
+	};
+	if New().Take(3).Cardinality() != 0 || New().Drop(3).Cardinality() != 0 {
+		t.Errorf("Take/Drop of an empty set should be empty");
+	};
+};
+
+func TestFloat64(t *testing.T) {
+	nan := Float64(math.NaN());
+	set := New(Float64(1), nan, Float64(-1), Float64(0), Float64(math.Inf(-1)), Float64(math.NaN()));
+	if set.Cardinality() != 5 {
+		t.Errorf("Expected NaNs to be equal: got count %v", set.Cardinality());
+	};
+	expected := []float64{math.NaN(), math.Inf(-1), -1, 0, 1};
+	i := 0;
+	for item := range set.Iter() {
+		f := float64(item.(Float64));
+		if f != expected[i] && !(math.IsNaN(f) && math.IsNaN(expected[i])) {
+			t.Errorf("Expected %v at %v: got %v", expected[i], i, f);
+		};
+		i++;
+	};
+	set.Add(Float64(math.Copysign(0, -1)));
+	if set.Cardinality() != 5 || !set.Has(Float64(0)) {
+		t.Errorf("Expected negative zero to equal zero");
+	};
+	if !nan.Precedes(Float64(math.Inf(-1))) || Float64(1).Precedes(nan) || nan.Precedes(nan) {
+		t.Errorf("NaN ordering broken");
+	};
+};
+
+func TestItems(t *testing.T) {
+	set := New(String("b"), String("a"), Bytes("y"), Bytes("x"), Bytes("xy"), Int(2), Int(-1));
+	if set.Cardinality() != 7 || !set.Has(Bytes("xy")) || set.Has(Bytes("z")) || !set.Has(String("a")) {
+		t.Errorf("Unexpected set contents");
+	};
+	last := map[string]Item{};
+	for item := range set.Iter() {
+		kind := reflect.Typeof(item).String();
+		if prev, ok := last[kind]; ok && !prev.Precedes(item) {
+			t.Errorf("%v should precede %v", prev, item);
+		};
+		last[kind] = item;
+	};
+	if str := fmt.Sprintf("%v %v %v %v", Int(-1), String("a"), Float64(1.5), Bytes("x")); str != "-1 a 1.5 x" {
+		t.Errorf("Unexpected string forms: %v", str);
+	};
+};
+
+func TestTime(t *testing.T) {
+	now := time.Seconds();
+	set := New(Time{time.SecondsToUTC(now)}, Time{time.SecondsToUTC(now - 60)});
+	if !set.Has(Time{time.SecondsToLocalTime(now)}) {
+		t.Errorf("Equal instants in different zones should be equal");
+	};
+	set.Add(Time{time.SecondsToLocalTime(now - 60)});
+	if set.Cardinality() != 2 {
+		t.Errorf("Expected count 2: got %v", set.Cardinality());
+	};
+	if !(Time{time.SecondsToUTC(now - 60)}).Precedes(Time{time.SecondsToLocalTime(now)}) {
+		t.Errorf("Earlier time should precede later time");
+	};
+	// instants in the same second differ by their nanoseconds
+	early, late := Time{time.NanosecondsToUTC(now * 1e9 + 5)}, Time{time.NanosecondsToLocalTime(now * 1e9 + 7)};
+	if !early.Precedes(late) || late.Precedes(early) {
+		t.Errorf("Expected %v ns to precede %v ns", early.Nanosecond, late.Nanosecond);
+	};
+	if !set.Add(early) || !set.Add(late) || set.Cardinality() != 4 {
+		t.Errorf("Expected instants in the same second to be distinct: got %v", set.Cardinality());
+	};
+	if !set.Has(Time{time.NanosecondsToUTC(now * 1e9 + 7)}) || set.Has(Time{time.NanosecondsToUTC(now * 1e9 + 6)}) {
+		t.Errorf("Look ups should match to the nanosecond");
+	};
+	// the zero value is a nil item
+	if set.Add(Time{}) || set.Has(Time{}) || set.Cardinality() != 4 {
+		t.Errorf("Time{} should be rejected");
+	};
+	if err := set.AddChecked(Time{}); err != ErrNilItem {
+		t.Errorf("Expected ErrNilItem for Time{}: got %v", err);
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestCursor(t *testing.T) {
+	set := New();
+	for i := 0; i < 100; i += 2 {
+		set.Add(Int(i));
+	};
+	set.Add(Real(0.5));
+	c := set.Cursor();
+	if item, ok := c.Item(); !ok || item != Int(0) {
+		t.Errorf("Expected new cursor at Int(0): got %v", item);
+	};
+	if !c.Seek(Int(50)) {
+		t.Fatalf("Seek(Int(50)) failed");
+	};
+	for i := 50; i < 100; i += 2 {
+		if item, ok := c.Item(); !ok || item != Int(i) {
+			t.Errorf("Expected Int(%v): got %v", i, item);
+		};
+		c.Next();
+	};
+	if item, ok := c.Item(); !ok || item != Real(0.5) || c.Next() || c.Valid() {
+		t.Errorf("Expected Real(0.5) then the end: got %v", item);
+	};
+	if !c.Seek(Int(51)) {
+		t.Fatalf("Seek(Int(51)) failed");
+	};
+	for i := 52; i >= 0; i -= 2 {
+		if item, ok := c.Item(); !ok || item != Int(i) {
+			t.Errorf("Expected Int(%v): got %v", i, item);
+		};
+		c.Prev();
+	};
+	if c.Valid() || c.Prev() || c.Next() {
+		t.Errorf("Cursor should be invalid after stepping off the start");
+	};
+	if c.Seek(Real(0.6)) || c.Valid() {
+		t.Errorf("Seek() past the end should fail");
+	};
+	if !c.Last() || !c.Prev() {
+		t.Fatalf("Last()/Prev() failed");
+	};
+	if item, _ := c.Item(); item != Int(98) {
+		t.Errorf("Expected Int(98): got %v", item);
+	};
+	if c = New().Cursor(); c.Valid() || c.Next() || c.Prev() || c.Seek(Int(1)) || c.Last() {
+		t.Errorf("Cursor of an empty set should be invalid");
+	};
+};
+
+// A type from "somewhere else" without a Precedes() method
+type point struct {
+	x, y int;
+};
+
+func by_x(a, b interface{}) int {
+	return a.(point).x - b.(point).x;
+};
+
+func by_length(a, b interface{}) int {
+	return len(a.(string)) - len(b.(string));
+};
+
+func TestItemOf(t *testing.T) {
+	set := New(Int(1));
+	for _, p := range []point{point{3, 0}, point{1, 1}, point{2, 2}, point{1, 3}} {
+		set.Add(ItemOf("point", p, by_x));
+	};
+	for _, s := range []string{"ccc", "a", "bb", "d"} {
+		set.Add(ItemOf("string", s, by_length));
+	};
+	if set.Cardinality() != 7 {
+		t.Errorf("Expected count 7: got %v", set.Cardinality());
+	};
+	if item, ok := set.Find(ItemOf("point", point{1, 0}, by_x)); !ok || item.(*FuncItem).Value() != (point{1, 3}) {
+		t.Errorf("Expected to find point{1, 3}: got %v", item);
+	};
+	if !set.Has(ItemOf("string", "zz", by_length)) || set.Has(ItemOf("string", "zzzz", by_length)) {
+		t.Errorf("Strings should be found by length");
+	};
+	expected := []string{"{1 3}", "{2 2}", "{3 0}", "d", "bb", "ccc"};
+	i := 0;
+	for item := range set.Iter() {
+		if f, ok := item.(*FuncItem); ok {
+			if fmt.Sprint(f) != expected[i] {
+				t.Errorf("Expected %v at %v: got %v", expected[i], i, f);
+			};
+			if (i < 3 && f.Key() != "point") || (i >= 3 && f.Key() != "string") {
+				t.Errorf("Items should be grouped by key: got %v at %v", f.Key(), i);
+			};
+			i++;
+		};
+	};
+};
+
+func TestCountDiff(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		setA, setB := New(), New();
+		for j := rand.Intn(200); j > 0; j-- {
+			setA.Add(Int(rand.Intn(100)));
+			setB.Add(Int(rand.Intn(100)));
+			setA.Add(Real(float64(rand.Intn(50))));
+			setB.Add(Real(float64(rand.Intn(50))));
+		};
+		onlyA, shared, onlyB := setA.CountDiff(setB);
+		if onlyA != uint64(Difference(setA, setB).Cardinality()) {
+			t.Errorf("Expected onlyA %v: got %v", Difference(setA, setB).Cardinality(), onlyA);
+		};
+		if shared != uint64(Intersection(setA, setB).Cardinality()) {
+			t.Errorf("Expected shared %v: got %v", Intersection(setA, setB).Cardinality(), shared);
+		};
+		if onlyB != uint64(Difference(setB, setA).Cardinality()) {
+			t.Errorf("Expected onlyB %v: got %v", Difference(setB, setA).Cardinality(), onlyB);
+		};
+	};
+};
+
+type person struct {
+	name string;
+	age int;
+};
+
+type by_age []person;
+
+func (this by_age) Len() int { return len(this); };
+func (this by_age) Less(i, j int) bool { return this[i].age < this[j].age; };
+func (this by_age) Swap(i, j int) { this[i], this[j] = this[j], this[i]; };
+
+func (this person) Precedes(other interface{}) bool {
+	return this.age < other.(person).age;
+};
+
+func TestFromSortInterface(t *testing.T) {
+	for n := 0; n < 300; n++ {
+		data := make(sort.IntArray, n);
+		for i := range data {
+			data[i] = rand.Intn(1000);
+		};
+		for sorted := 0; sorted < 2; sorted++ {
+			set := FromSortInterface(data, func(i int) Item { return Int(data[i]); });
+			if err := set.CheckInvariants(); err != nil {
+				t.Fatalf("n = %v: %v", n, err);
+			};
+			for _, i := range data {
+				if !set.Has(Int(i)) {
+					t.Errorf("n = %v: missing %v", n, i);
+				};
+			};
+			data.Sort();
+		};
+		for i := range data {
+			data[i] = 2 * i;
+		};
+		set := FromSortInterface(data, func(i int) Item { return Int(data[i]); });
+		if err := set.CheckInvariants(); err != nil || set.Cardinality() != uint(n) {
+			t.Fatalf("n = %v: %v", n, err);
+		};
+	};
+	people := by_age{person{"c", 30}, person{"a", 10}, person{"b", 20}, person{"d", 20}};
+	set := FromSortInterface(people, func(i int) Item { return people[i]; });
+	if set.Cardinality() != 3 || !set.Has(person{"x", 10}) {
+		t.Errorf("Unexpected set contents: %v", set.ToSlice());
+	};
+	sort.Sort(people);
+	set = FromSortInterface(people, func(i int) Item { return people[i]; });
+	if set.Cardinality() != 3 || set.CheckInvariants() != nil {
+		t.Errorf("Unexpected set contents: %v", set.ToSlice());
+	};
+};
+
+func TestSetSlice(t *testing.T) {
+	set := make_Int_set_serial(0, 99);
+	set.Add(Real(1));
+	slice := set.ToSlice();
+	if len(slice) != 101 || !sort.IsSorted(slice) {
+		t.Errorf("Expected sorted slice of 101 items: got %v", slice);
+	};
+	i := sort.Search(slice.Len(), func(i int) bool { return compare_items(slice[i], Int(42)) >= 0; });
+	if slice[i] != Int(42) {
+		t.Errorf("Expected to find Int(42): got %v", slice[i]);
+	};
+	slice.Swap(0, 100);
+	if sort.IsSorted(slice) {
+		t.Errorf("Expected unsorted slice");
+	};
+	sort.Sort(slice);
+	if slice[0] != Int(0) || slice[100] != Real(1) {
+		t.Errorf("Expected sorted slice: got %v", slice);
+	};
+};
+
+func TestAuditLog(t *testing.T) {
+	set := NewWithAuditLog(Int(1), Real(2));
+	set.Add(Int(1));
+	set.Remove(Int(3));
+	set.Remove(Real(2));
+	set.Add(nil);
+	set.Clear();
+	set.Clear();
+	set.Add(Int(4));
+	expected := []MutationEvent{
+		MutationEvent{OP_ADD, Int(1), true},
+		MutationEvent{OP_ADD, Real(2), true},
+		MutationEvent{OP_ADD, Int(1), false},
+		MutationEvent{OP_REMOVE, Int(3), false},
+		MutationEvent{OP_REMOVE, Real(2), true},
+		MutationEvent{OP_CLEAR, nil, true},
+		MutationEvent{OP_CLEAR, nil, false},
+		MutationEvent{OP_ADD, Int(4), true},
+	};
+	log := set.Log();
+	if len(log) != len(expected) {
+		t.Fatalf("Expected %v events: got %v", len(expected), log);
+	};
+	for i, event := range log {
+		if event != expected[i] {
+			t.Errorf("Event %v: expected %v got %v", i, expected[i], event);
+		};
+	};
+	log[0].Item = Int(99);
+	if set.Log()[0].Item != Int(1) {
+		t.Errorf("Log() should return a copy");
+	};
+	if len(New(Int(1)).Log()) != 0 {
+		t.Errorf("Sets without an audit log should have an empty log");
+	};
+};
+
+func TestReplayLog(t *testing.T) {
+	set := NewWithAuditLog();
+	for i := 0; i < 2000; i++ {
+		switch rand.Intn(20) {
+		case 0:
+			set.Clear();
+		case 1, 2, 3, 4, 5, 6:
+			set.Remove(Int(rand.Intn(100)));
+		default:
+			set.Add(Int(rand.Intn(100)));
+			set.Add(Real(rand.Intn(10)));
+		};
+	};
+	replay := ReplayLog(set.Log());
+	if !Equal(set, replay) {
+		t.Errorf("Replayed set differs: %v and %v", set.ToSlice(), replay.ToSlice());
+	};
+	if ReplayLog(nil).Cardinality() != 0 {
+		t.Errorf("Replaying an empty log should give an empty set");
+	};
+};
+
+// rank Ints by their distance from 50 (furthest first) and Reals below all Ints
+func distance_from_50(a, b Item) int {
+	score := func(item Item) int {
+		if i, ok := item.(Int); ok {
+			if i < 50 {
+				return int(50 - i);
+			};
+			return int(i - 50);
+		};
+		return -1;
+	};
+	return score(a) - score(b);
+};
+
+func TestTopK(t *testing.T) {
+	set := make_Int_set_serial(0, 90);
+	set.Add(Real(1000));
+	top := set.TopK(3, distance_from_50);
+	expected := []Item{Int(0), Int(1), Int(2)};
+	if len(top) != len(expected) || top[0] != expected[0] || top[1] != expected[1] || top[2] != expected[2] {
+		t.Errorf("Expected %v: got %v", expected, top);
+	};
+	set.Add(Int(100));
+	top = set.TopK(2, distance_from_50);
+	if len(top) != 2 || !(top[0] == Int(0) && top[1] == Int(100) || top[0] == Int(100) && top[1] == Int(0)) {
+		t.Errorf("Expected Int(0) and Int(100): got %v", top);
+	};
+	set.Remove(Int(100));
+	if len(set.TopK(0, distance_from_50)) != 0 || len(New().TopK(3, distance_from_50)) != 0 {
+		t.Errorf("Expected empty results");
+	};
+	all := set.TopK(1000, distance_from_50);
+	if len(all) != 92 || all[91] != Real(1000) {
+		t.Errorf("Expected all items with Real(1000) last: got %v", all);
+	};
+	for i := 1; i < len(all); i++ {
+		if distance_from_50(all[i - 1], all[i]) < 0 {
+			t.Errorf("Results out of order at %v: %v", i, all);
+		};
+	};
+};
+
+func TestErrors(t *testing.T) {
+	set := New(Int(1));
+	for i := 0; i < 20; i++ {
+		set.Add(Fussy(i));
+	};
+	if has, err := set.HasSafe(nil); has || err != ErrNilItem {
+		t.Errorf("Expected ErrNilItem: got %v", err);
+	};
+	if has, err := set.HasSafe(Fussy(5)); !has || err != nil {
+		t.Errorf("Expected to have Fussy(5): got %v %v", has, err);
+	};
+	if has, err := set.HasSafe(Int(2)); has || err != nil {
+		t.Errorf("Expected not to have Int(2): got %v %v", has, err);
+	};
+	fussy_armed = true;
+	defer func() { fussy_armed = false; }();
+	has, err := set.HasSafe(Fussy(13));
+	if cerr, ok := err.(*CompareError); has || !ok || cerr.Err != ErrIncomparable || cerr.A != Fussy(13) {
+		t.Errorf("Expected *CompareError with ErrIncomparable: got %v", err);
+	};
+	err = set.Validate();
+	if cerr, ok := err.(*CompareError); !ok || cerr.Err != ErrIncomparable || cerr.A != Fussy(12) || cerr.B != Fussy(13) {
+		t.Errorf("Expected *CompareError with ErrIncomparable: got %v", err);
+	};
+};
+
+func TestNewFromChannel(t *testing.T) {
+	set := make_Int_set_serial(0, 99);
+	set.Add(Real(0.5));
+	c := make(chan Item);
+	go func() {
+		for item := range set.Iter() {
+			if i, ok := item.(Int); ok && i % 2 == 0 {
+				c <- i / 2;
+			} else {
+				c <- nil;
+			};
+		};
+		close(c);
+	}();
+	halves := NewFromChannel(c);
+	if !Equal(halves, make_Int_set_serial(0, 49)) {
+		t.Errorf("Unexpected set contents: %v", halves.ToSlice());
+	};
+	closed := make(chan Item);
+	close(closed);
+	if NewFromChannel(closed).Cardinality() != 0 {
+		t.Errorf("Expected an empty set from a closed channel");
+	};
+};
+
+type Named struct {
+	name string;
+	data []int;
+};
+
+func (this *Named) Precedes(other interface{}) bool {
+	return this.name < other.(*Named).name;
+};
+
+func TestIntern(t *testing.T) {
+	set := New();
+	first := &Named{"x", make([]int, 100)};
+	if set.Intern(first) != first {
+		t.Errorf("Interning a new item should return it");
+	};
+	for i := 0; i < 10; i++ {
+		if interned := set.Intern(&Named{"x", make([]int, 100)}); interned != first {
+			t.Errorf("Expected %p: got %p", first, interned);
+		};
+	};
+	other := &Named{"y", nil};
+	if set.Intern(other) != other || set.Intern(&Named{"y", nil}) != other {
+		t.Errorf("Expected %p", other);
+	};
+	if set.Cardinality() != 2 || set.Intern(nil) != nil {
+		t.Errorf("Expected count 2: got %v", set.Cardinality());
+	};
+};
+
+func TestHashCanonical(t *testing.T) {
+	const n = 500;
+	ascending, descending, random := New(), New(), New();
+	for i := 0; i < n; i++ {
+		ascending.Add(Int(i));
+		descending.Add(Int(n - 1 - i));
+	};
+	for _, i := range rand.Perm(n) {
+		random.Add(Int(i));
+	};
+	data := make(sort.IntArray, n);
+	for i := range data {
+		data[i] = i;
+	};
+	bulk := FromSortInterface(data, func(i int) Item { return Int(data[i]); });
+	hash := ascending.Hash();
+	for _, set := range []*Set{descending, random, bulk, ascending.Copy()} {
+		if set.Hash() != hash {
+			t.Errorf("Equal sets should have equal hashes regardless of tree shape");
+		};
+	};
+	for i := 0; i < n; i += 50 {
+		changed := ascending.Copy();
+		changed.Remove(Int(i));
+		if changed.Hash() == hash {
+			t.Errorf("Removing Int(%v) should change the hash", i);
+		};
+		changed.Add(Int(n + i));
+		if changed.Hash() == hash {
+			t.Errorf("Replacing Int(%v) should change the hash", i);
+		};
+	};
+};
+
+func TestDiff(t *testing.T) {
+	setA, setB := New(), New();
+	for i := 0; i < 10000; i++ {
+		setA.Add(Int(i));
+		setB.Add(Int(i));
+	};
+	for i := 0; i < 10000; i += 97 {
+		setA.Remove(Int(i));
+		setB.Add(Real(i));
+	};
+	setB.Remove(Int(5));
+	setB.Remove(Int(9999));
+	onlyA, onlyB := setA.Diff(setB);
+	if len(onlyA) != 2 || onlyA[0] != Int(5) || onlyA[1] != Int(9999) {
+		t.Errorf("Expected [5 9999]: got %v", onlyA);
+	};
+	if uint(len(onlyB)) != Difference(setB, setA).Cardinality() || !sort.IsSorted(SetSlice(onlyB)) {
+		t.Errorf("Expected %v sorted items: got %v", Difference(setB, setA).Cardinality(), onlyB);
+	};
+	for i, item := range onlyB {
+		if !setB.Has(item) || setA.Has(item) {
+			t.Errorf("%v shouldn't be in the diff", item);
+		};
+		if i > 0 && compare_items(onlyB[i - 1], item) >= 0 {
+			t.Errorf("Diff out of order at %v", i);
+		};
+	};
+	onlyA, onlyB = New(&Named{"x", nil}).Diff(New(&Named{"x", []int{1}}));
+	if len(onlyA) != 0 || len(onlyB) != 0 {
+		t.Errorf("Equal items with different payloads should be unchanged");
+	};
+};
+
+func TestSizeHint(t *testing.T) {
+	set := New();
+	if set.SizeHint() != 0 {
+		t.Errorf("Expected 0: got %v", set.SizeHint());
+	};
+	for i := 0; i < 1000; i++ {
+		set.Add(Int(rand.Intn(500)));
+		if i % 3 == 0 {
+			set.Remove(Int(rand.Intn(500)));
+		};
+		if set.SizeHint() != uint64(len(set.ToSlice())) {
+			t.Fatalf("Expected %v: got %v", len(set.ToSlice()), set.SizeHint());
+		};
+	};
+	set.Clear();
+	if set.SizeHint() != 0 {
+		t.Errorf("Expected 0 after Clear(): got %v", set.SizeHint());
+	};
+};
+
+func TestApplyPatch(t *testing.T) {
+	source, replica := New(), New();
+	for i := 0; i < 1000; i++ {
+		source.Add(Int(i));
+		replica.Add(Int(i));
+	};
+	stale := replica.Copy();
+	for i := 0; i < 1000; i += 7 {
+		source.Remove(Int(i));
+		source.Add(String(fmt.Sprintf("%v", i)));
+	};
+	add, remove := source.Diff(replica);
+	changed, err := replica.ApplyPatch(add, remove);
+	if err != nil || changed != len(add) + len(remove) {
+		t.Errorf("Expected %v changes: got %v (%v)", len(add) + len(remove), changed, err);
+	};
+	if !Equal(source, replica) {
+		t.Errorf("Patched replica differs from the source");
+	};
+	changed, err = replica.ApplyPatch(add, remove);
+	if err != nil || changed != 0 || !Equal(source, replica) {
+		t.Errorf("Reapplying a patch should change nothing: got %v (%v)", changed, err);
+	};
+	for i := 0; i < 2; i++ {
+		stale.ApplyPatch(add, remove);
+		if !Equal(source, stale) {
+			t.Errorf("Patched stale copy differs from the source");
+		};
+	};
+	set := New(Int(1), Int(2));
+	changed, err = set.ApplyPatch([]Item{Int(2), Int(3)}, []Item{Int(2), Int(4)});
+	if err != nil || changed != 3 || !Equal(set, New(Int(1), Int(2), Int(3))) {
+		t.Errorf("Expected 3 changes giving {1, 2, 3}: got %v %v (%v)", changed, set.ToSlice(), err);
+	};
+	changed, err = set.ApplyPatch([]Item{Int(5), nil}, nil);
+	if err != ErrNilItem || changed != 0 || set.Has(Int(5)) {
+		t.Errorf("Expected ErrNilItem and no change: got %v (%v)", changed, err);
+	};
+};
+
+func TestSuccessorPredecessor(t *testing.T) {
+	set := New();
+	for i := 0; i < 100; i += 2 {
+		set.Add(Int(i));
+	};
+	for i := -1; i <= 100; i++ {
+		succ, found := set.Successor(Int(i));
+		expected := Int(i + 1 + (i + 1) % 2);
+		if i >= 98 {
+			if found {
+				t.Errorf("%v: expected no successor: got %v", i, succ);
+			};
+		} else if !found || succ != expected {
+			t.Errorf("%v: expected successor %v: got %v %v", i, expected, succ, found);
+		};
+		pred, found := set.Predecessor(Int(i));
+		expected = Int(i - 1 - (i + 1) % 2);
+		if i <= 0 {
+			if found {
+				t.Errorf("%v: expected no predecessor: got %v", i, pred);
+			};
+		} else if !found || pred != expected {
+			t.Errorf("%v: expected predecessor %v: got %v %v", i, expected, pred, found);
+		};
+	};
+	set.Add(String("a"));
+	if succ, found := set.Successor(Int(98)); !found || succ != String("a") {
+		t.Errorf("Expected \"a\": got %v %v", succ, found);
+	};
+	if pred, found := set.Predecessor(String("a")); !found || pred != Int(98) {
+		t.Errorf("Expected 98: got %v %v", pred, found);
+	};
+	if _, found := New().Successor(Int(1)); found {
+		t.Errorf("Empty set has no successors");
+	};
+	if _, found := set.Predecessor(nil); found {
+		t.Errorf("nil has no predecessor");
+	};
+};
+
+func TestDiffString(t *testing.T) {
+	setA := New(Int(1), Int(2), Int(3), String("a"), String("b"), Real(1.5));
+	setB := New(Int(2), Int(4), String("b"), String("c"), Real(2.5));
+	expected := "@@ heteroset.Int @@\n" +
+		"-1\n" +
+		"-3\n" +
+		"+4\n" +
+		"@@ heteroset.Real @@\n" +
+		"-1.5\n" +
+		"+2.5\n" +
+		"@@ heteroset.String @@\n" +
+		"-a\n" +
+		"+c\n" +
+		"4 only in first set, 3 only in second set\n";
+	if report := DiffString(setA, setB); report != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, report);
+	};
+	if report := DiffString(setA, setA.Copy()); report != "" {
+		t.Errorf("Expected no report for equal sets: got:\n%s", report);
+	};
+	setA, setB = New(), New(String("x"));
+	for i := 0; i < 30; i++ {
+		setA.Add(Int(i));
+	};
+	expected = "@@ heteroset.Int @@\n";
+	for i := 0; i < DiffStringLimit; i++ {
+		expected += fmt.Sprintf("-%d\n", i);
+	};
+	expected += "... 11 more\n30 only in first set, 1 only in second set\n";
+	if report := DiffString(setA, setB); report != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, report);
+	};
+};
+
+func TestMap(t *testing.T) {
+	m := make(map[Item]struct{});
+	for i := 0; i < 100; i++ {
+		m[Int(rand.Intn(50))] = struct{}{};
+		m[String(fmt.Sprintf("%v", rand.Intn(50)))] = struct{}{};
+	};
+	set := FromMap(m);
+	if set.Cardinality() != uint(len(m)) {
+		t.Errorf("Expected %v items: got %v", len(m), set.Cardinality());
+	};
+	slice := set.ToSlice();
+	if !sort.IsSorted(slice) {
+		t.Errorf("Slice is out of order: %v", slice);
+	};
+	for _, item := range slice {
+		if _, present := m[item]; !present {
+			t.Errorf("Unexpected item %v", item);
+		};
+	};
+	round := set.ToMap();
+	if len(round) != len(m) {
+		t.Errorf("Expected %v keys: got %v", len(m), len(round));
+	};
+	for item, _ := range m {
+		if _, present := round[item]; !present {
+			t.Errorf("Missing key %v", item);
+		};
+	};
+	if FromMap(nil).Cardinality() != 0 || len(New().ToMap()) != 0 {
+		t.Errorf("Expected empty results");
+	};
+};
+
+func TestVersion(t *testing.T) {
+	set := New();
+	check := func(op string, expected uint64) {
+		if set.Version() != expected {
+			t.Errorf("%s: expected version %v: got %v", op, expected, set.Version());
+		};
+	};
+	check("New", 0);
+	set.Clear();
+	check("Clear of empty set", 0);
+	set.Remove(Int(1));
+	check("Remove from empty set", 0);
+	set.Add(Int(1));
+	check("Add", 1);
+	set.Add(Int(1));
+	check("duplicate Add", 1);
+	set.Add(nil);
+	check("Add(nil)", 1);
+	set.Remove(Int(2));
+	check("Remove of absent item", 1);
+	set.Remove(nil);
+	check("Remove(nil)", 1);
+	set.Has(Int(1));
+	set.Find(Int(2));
+	for _ = range set.Iter() {
+	};
+	check("queries", 1);
+	set.Add(Int(2));
+	set.Remove(Int(1));
+	check("Add and Remove", 3);
+	set.Clear();
+	check("Clear", 4);
+	set.Clear();
+	check("second Clear", 4);
+	set.ApplyPatch([]Item{Int(1), Int(2)}, []Item{Int(3)});
+	check("ApplyPatch", 6);
+	if version := set.Copy().Version(); version != 6 {
+		t.Errorf("Expected copy to have version 6: got %v", version);
+	};
+};
+
+func TestJournal(t *testing.T) {
+	set := New(Int(1));
+	if set.Undo() || set.Redo() {
+		t.Errorf("Undo()/Redo() should fail without a journal");
+	};
+	set.BeginJournal(0);
+	steps := []struct {
+		action func();
+		expected *Set;
+	}{
+		{func() { set.Add(Int(2)) }, New(Int(1), Int(2))},
+		{func() { set.Add(Int(3)) }, New(Int(1), Int(2), Int(3))},
+		{func() { set.Remove(Int(1)) }, New(Int(2), Int(3))},
+		{func() { set.Remove(Int(9)) }, New(Int(2), Int(3))},
+		{func() { set.Clear() }, New()},
+		{func() { set.Add(String("a")) }, New(String("a"))},
+		{func() { set.ApplyPatch([]Item{Int(4), Int(5)}, []Item{String("a")}) }, New(Int(4), Int(5))},
+	};
+	for i, step := range steps {
+		step.action();
+		if !Equal(set, step.expected) {
+			t.Errorf("Step %v: expected %v: got %v", i, step.expected.ToSlice(), set.ToSlice());
+		};
+	};
+	// an absent Remove() changes nothing and ApplyPatch() makes one entry per change
+	undone := []*Set{
+		New(Int(4)),
+		New(),
+		New(String("a")),
+		New(),
+		New(Int(2), Int(3)),
+		New(Int(1), Int(2), Int(3)),
+		New(Int(1), Int(2)),
+		New(Int(1)),
+	};
+	for i, expected := range undone {
+		if !set.Undo() || !Equal(set, expected) {
+			t.Errorf("Undo %v: expected %v: got %v", i, expected.ToSlice(), set.ToSlice());
+		};
+	};
+	if set.Undo() {
+		t.Errorf("Undo() past the start of the journal");
+	};
+	for i := len(undone) - 2; i >= 0; i-- {
+		if !set.Redo() || !Equal(set, undone[i]) {
+			t.Errorf("Redo %v: expected %v: got %v", i, undone[i].ToSlice(), set.ToSlice());
+		};
+	};
+	if !set.Redo() || !Equal(set, New(Int(4), Int(5))) || set.Redo() {
+		t.Errorf("Expected final Redo() to give {4, 5}: got %v", set.ToSlice());
+	};
+	set.Undo();
+	set.Undo();
+	set.Add(Int(6));
+	if set.Redo() || !Equal(set, New(Int(6))) {
+		t.Errorf("New mutation should discard redo history: got %v", set.ToSlice());
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	// overwriting an equal item is undone by restoring the previous instance
+	first := &Named{"k", []int{1}};
+	set.Add(first);
+	set.Add(&Named{"k", []int{2}});
+	set.Undo();
+	if item, _ := set.Find(&Named{"k", nil}); item != first {
+		t.Errorf("Expected the first instance: got %v", item);
+	};
+	set.EndJournal();
+	set.Add(Int(7));
+	if set.Undo() || !set.Has(Int(7)) {
+		t.Errorf("Undo() should fail after EndJournal()");
+	};
+	set = New();
+	set.BeginJournal(3);
+	for i := 0; i < 10; i++ {
+		set.Add(Int(i));
+	};
+	for set.Undo() {
+	};
+	if !Equal(set, New(Int(0), Int(1), Int(2), Int(3), Int(4), Int(5), Int(6))) {
+		t.Errorf("Expected only the last 3 mutations to be undone: got %v", set.ToSlice());
+	};
+};
+
+type Labelled struct {
+	label string;
+};
+
+func (this *Labelled) Precedes(other interface{}) bool {
+	return this.label < other.(*Labelled).label;
+};
+
+func TestTypeTieBreak(t *testing.T) {
+	// unnamed pointer types have empty package paths and names
+	named, labelled := &Named{"x", nil}, &Labelled{"x"};
+	set := New(named, labelled, &Named{"y", nil}, &Labelled{"w"});
+	if set.Cardinality() != 4 || !set.Has(named) || !set.Has(labelled) {
+		t.Errorf("Expected 4 distinct items: got %v", set.ToSlice());
+	};
+	if compare_items(named, labelled) != -compare_items(labelled, named) || compare_items(named, labelled) == 0 {
+		t.Errorf("Expected a strict order between *Labelled and *Named");
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	if err := set.Validate(); err != nil {
+		t.Errorf("%v", err);
+	};
+	slice := set.ToSlice();
+	if _, ok := slice[0].(*Labelled); !ok || slice[0].(*Labelled).label != "w" {
+		t.Errorf("Expected *Labelled (by type string) then by label: got %v", slice);
+	};
+};
+
+func TestCallbacks(t *testing.T) {
+	index := make(map[string]int);
+	var set *Set;
+	on_insert := func(item Item) {
+		if !set.Has(item) {
+			t.Errorf("%v should be in the set during its OnInsert callback", item);
+		};
+		index[fmt.Sprintf("%v", item)]++;
+	};
+	on_delete := func(item Item) {
+		if set.Has(item) {
+			t.Errorf("%v shouldn't be in the set during its OnDelete callback", item);
+		};
+		index[fmt.Sprintf("%v", item)]--;
+	};
+	set = Make(WithOnInsert(on_insert), WithOnDelete(on_delete));
+	check := func(op string) {
+		if err := set.CheckInvariants(); err != nil {
+			t.Errorf("%s: %v", op, err);
+		};
+		for key, n := range index {
+			if n < 0 || n > 1 || (n == 1) != set.Has(String(key)) {
+				t.Errorf("%s: index out of step for %q: %v", op, key, n);
+			};
+		};
+		var total int;
+		for _, n := range index {
+			total += n;
+		};
+		if uint(total) != set.Cardinality() {
+			t.Errorf("%s: index has %v items: set has %v", op, total, set.Cardinality());
+		};
+	};
+	set.Add(String("a"));
+	set.Add(String("a"));
+	set.Add(nil);
+	check("Add");
+	set.Remove(String("b"));
+	set.Remove(String("a"));
+	set.Remove(String("a"));
+	check("Remove");
+	set.ApplyPatch([]Item{String("x"), String("y"), String("z")}, []Item{String("q")});
+	check("ApplyPatch");
+	set.Clear();
+	set.Clear();
+	check("Clear");
+	if len(index) != 4 {
+		t.Errorf("Expected callbacks for 4 distinct items: got %v", index);
+	};
+	set.BeginJournal(0);
+	set.Add(String("j"));
+	set.Undo();
+	set.Redo();
+	check("Undo/Redo");
+	if index["j"] != 1 {
+		t.Errorf("Expected \"j\" to be indexed: got %v", index["j"]);
+	};
+	for _, op := range []string{"Add", "Remove", "Clear"} {
+		reentrant := Make(WithOnInsert(func(item Item) {
+			switch op {
+			case "Add":
+				set.Add(String("again"));
+			case "Remove":
+				set.Remove(item);
+			case "Clear":
+				set.Clear();
+			};
+		}));
+		set = reentrant;
+		func() {
+			defer func() {
+				if x := recover(); x == nil || strings.Index(fmt.Sprintf("%v", x), op) < 0 {
+					t.Errorf("Expected a panic from a re-entrant %s(): got %v", op, x);
+				};
+			}();
+			set.Add(Int(1));
+		}();
+		if set.in_callback || set.Cardinality() != 1 || set.Has(String("again")) {
+			t.Errorf("Set corrupted by re-entrant %s(): %v", op, set.ToSlice());
+		};
+		set.Remove(Int(1));
+		if err := set.CheckInvariants(); err != nil || set.Cardinality() != 0 {
+			t.Errorf("Set unusable after re-entrant %s(): %v", op, err);
+		};
+	};
+};
+
+func TestIterByType(t *testing.T) {
+	set := New(String("b"), Int(3), Real(2.5), Int(1), String("a"), Real(0.5), Int(2));
+	expected := []TypeGroup{
+		{"heteroset.Int", []Item{Int(1), Int(2), Int(3)}},
+		{"heteroset.Real", []Item{Real(0.5), Real(2.5)}},
+		{"heteroset.String", []Item{String("a"), String("b")}},
+	};
+	var i int;
+	for group := range set.IterByType() {
+		if i >= len(expected) {
+			t.Fatalf("Unexpected group %v", group);
+		};
+		if group.Type != expected[i].Type || !reflect.DeepEqual(group.Items, expected[i].Items) {
+			t.Errorf("Expected %v: got %v", expected[i], group);
+		};
+		i++;
+	};
+	if i != len(expected) {
+		t.Errorf("Expected %v groups: got %v", len(expected), i);
+	};
+	for group := range New().IterByType() {
+		t.Errorf("Unexpected group %v in empty set", group);
+	};
+};
+
+func TestMaxLen(t *testing.T) {
+	set := Make(WithMaxLen(3));
+	for i := 0; i < 2; i++ {
+		if err := set.AddChecked(Int(i)); err != nil {
+			t.Errorf("Add %v: unexpected error %v", i, err);
+		};
+	};
+	// n - 1 members plus a duplicate
+	if err := set.AddChecked(Int(1)); err != nil || set.Cardinality() != 2 {
+		t.Errorf("Re-adding at n - 1: got %v with %v members", err, set.Cardinality());
+	};
+	if err := set.AddChecked(Int(2)); err != nil || set.Cardinality() != 3 {
+		t.Errorf("Filling the set: got %v with %v members", err, set.Cardinality());
+	};
+	// exactly n members
+	if err := set.AddChecked(Int(3)); err != ErrFull || set.Has(Int(3)) {
+		t.Errorf("Expected ErrFull: got %v", err);
+	};
+	if set.Add(Int(3)) || set.Has(Int(3)) || set.Cardinality() != 3 {
+		t.Errorf("Add() shouldn't exceed the limit: %v", set.ToSlice());
+	};
+	first := &Named{"k", []int{1}};
+	full := Make(WithMaxLen(1));
+	full.Add(first);
+	if err := full.AddChecked(&Named{"k", []int{2}}); err != nil {
+		t.Errorf("Replacing an item in a full set: got %v", err);
+	};
+	if item, _ := full.Find(first); item == first {
+		t.Errorf("Expected the item to have been replaced");
+	};
+	if err := set.AddChecked(nil); err != ErrNilItem {
+		t.Errorf("Expected ErrNilItem: got %v", err);
+	};
+	set.Remove(Int(0));
+	if err := set.AddChecked(Int(3)); err != nil || set.Cardinality() != 3 {
+		t.Errorf("Expected room after Remove(): got %v", err);
+	};
+	// set is now {1, 2, 3}
+	changed, err := set.ApplyPatch([]Item{Int(4), Int(5)}, []Item{Int(1)});
+	if err != ErrFull || changed != 0 || !Equal(set, New(Int(1), Int(2), Int(3))) {
+		t.Errorf("Expected all-or-nothing ErrFull: got %v %v %v", changed, err, set.ToSlice());
+	};
+	changed, err = set.ApplyPatch([]Item{Int(4), Int(2), Int(1)}, []Item{Int(1), Int(3), Int(9)});
+	if err != nil || changed != 4 || !Equal(set, New(Int(1), Int(2), Int(4))) {
+		t.Errorf("Expected patch to fit: got %v %v %v", changed, err, set.ToSlice());
+	};
+};
+
+func TestOverlaps(t *testing.T) {
+	setA := make_Int_set_serial(-100, 0);
+	setB := make_Int_set_serial(1, 100);
+	setC := make_Int_set_serial(-50, 50);
+	setC.Add(String("x"));
+	tests := []struct {
+		setA, setB *Set;
+		overlaps bool;
+		shared uint64;
+	}{
+		{setA, setB, false, 0},
+		{setA, setC, true, 51},
+		{setC, setB, true, 50},
+		{setC, setC.Copy(), true, 102},
+		{New(), setA, false, 0},
+	};
+	for _, test := range tests {
+		overlaps, shared := test.setA.Overlaps(test.setB);
+		if overlaps != test.overlaps || shared != test.shared {
+			t.Errorf("Expected (%v, %v): got (%v, %v)", test.overlaps, test.shared, overlaps, shared);
+		};
+		if overlaps != Intersect(test.setA, test.setB) || shared != uint64(Intersection(test.setA, test.setB).Cardinality()) {
+			t.Errorf("Overlaps() disagrees with Intersect()/Intersection()");
+		};
+	};
+};
+
+func TestDedup(t *testing.T) {
+	first := &Named{"k", []int{1}};
+	tests := []struct {
+		items, sorted, in_place []Item;
+	}{
+		{
+			[]Item{String("b"), Int(2), Real(1), Int(2), String("a"), Real(1), String("b"), Int(1), nil},
+			[]Item{Int(1), Int(2), Real(1), String("a"), String("b")},
+			[]Item{String("b"), Int(2), Real(1), String("a"), Int(1)},
+		},
+		{
+			[]Item{Int(1), Int(2), Real(1), String("a")},
+			[]Item{Int(1), Int(2), Real(1), String("a")},
+			[]Item{Int(1), Int(2), Real(1), String("a")},
+		},
+		{
+			[]Item{Int(3), Int(3), Int(3)},
+			[]Item{Int(3)},
+			[]Item{Int(3)},
+		},
+		{
+			[]Item{first, &Named{"k", []int{2}}},
+			[]Item{first},
+			[]Item{first},
+		},
+		{nil, []Item{}, []Item{}},
+	};
+	for _, test := range tests {
+		if sorted := Dedup(test.items); !reflect.DeepEqual(sorted, test.sorted) {
+			t.Errorf("Dedup(%v): expected %v: got %v", test.items, test.sorted, sorted);
+		};
+		if in_place := DedupInPlaceOrder(test.items); !reflect.DeepEqual(in_place, test.in_place) {
+			t.Errorf("DedupInPlaceOrder(%v): expected %v: got %v", test.items, test.in_place, in_place);
+		};
+	};
+};
+
+type event struct {
+	id string;
+	at int;
+};
+
+func (this *event) Precedes(other interface{}) bool {
+	return this.id < other.(*event).id;
+};
+
+func by_time(a, b Item) bool {
+	return a.(*event).at < b.(*event).at;
+};
+
+func same_id(a, b Item) bool {
+	return a.(*event).id == b.(*event).id;
+};
+
+func TestWithOrder(t *testing.T) {
+	set := Make(WithOrder(by_time, same_id), WithSelfCheck(true));
+	set.Add(&event{"c", 30});
+	set.Add(&event{"a", 10});
+	set.Add(&event{"b", 20});
+	// equal by ID: replaces "a" and moves it to its new place in the order
+	if set.Add(&event{"a", 40}) {
+		t.Errorf("Adding an existing ID shouldn't insert");
+	};
+	// same time but different IDs: both kept (ordered by Precedes())
+	if !set.Add(&event{"d", 20}) {
+		t.Errorf("Adding a new ID should insert");
+	};
+	var got []string;
+	for item := range set.Iter() {
+		got = append(got, fmt.Sprintf("%s@%d", item.(*event).id, item.(*event).at));
+	};
+	if expected := []string{"b@20", "d@20", "c@30", "a@40"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if set.Cardinality() != 4 {
+		t.Errorf("Expected 4 members: got %v", set.Cardinality());
+	};
+	if item, found := set.Find(&event{"c", 0}); !found || item.(*event).at != 30 {
+		t.Errorf("Expected to find c@30 by ID: got %v %v", item, found);
+	};
+	if has, err := set.HasSafe(&event{"b", 99}); !has || err != nil {
+		t.Errorf("Expected HasSafe() to find b: got %v %v", has, err);
+	};
+	set.Remove(&event{"b", 0});
+	if set.Has(&event{"b", 20}) || set.Cardinality() != 3 {
+		t.Errorf("Expected b to be removed by ID");
+	};
+	if succ, _ := set.Successor(&event{"x", 25}); succ.(*event).id != "c" {
+		t.Errorf("Expected the successor of time 25 to be c: got %v", succ);
+	};
+	if first, _ := set.Copy().Take(1).Cursor().Item(); first.(*event).id != "d" {
+		t.Errorf("Expected Take() to keep the order: got %v", first);
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	// with no equal function, equality follows the order
+	by_order := Make(WithOrder(by_time, nil));
+	by_order.Add(&event{"a", 1});
+	by_order.Add(&event{"a", 2});
+	by_order.Add(&event{"a", 1});
+	if by_order.Cardinality() != 2 || !by_order.Has(&event{"a", 2}) {
+		t.Errorf("Expected 2 members: got %v", by_order.ToSlice());
+	};
+};
+
+func TestRandomItem(t *testing.T) {
+	if _, found := New().RandomItem(nil); found {
+		t.Errorf("Empty set has no random item");
+	};
+	set := New(Int(1), String("a"), Real(2), Int(7), String("b"));
+	r := rand.New(rand.NewSource(1));
+	counts := make(map[Item]int);
+	const draws = 50000;
+	for i := 0; i < draws; i++ {
+		item, found := set.RandomItem(r);
+		if !found || !set.Has(item) {
+			t.Fatalf("Expected a member: got %v", item);
+		};
+		counts[item]++;
+	};
+	if len(counts) != 5 {
+		t.Errorf("Expected all 5 members to be drawn: got %v", counts);
+	};
+	expected := float64(draws) / 5;
+	var chi_squared float64;
+	for _, n := range counts {
+		chi_squared += (float64(n) - expected) * (float64(n) - expected) / expected;
+	};
+	// the 0.001 critical value for 4 degrees of freedom
+	if chi_squared > 18.47 {
+		t.Errorf("Draws aren't uniform (chi squared %v): %v", chi_squared, counts);
+	};
+	if item, found := set.RandomItem(nil); !found || !set.Has(item) {
+		t.Errorf("Expected a member from the default source: got %v", item);
+	};
+	// sizes must survive every kind of restructuring
+	set = Make(WithSelfCheck(true));
+	for i := 0; i < 500; i++ {
+		set.Add(Int(rand.Intn(200)));
+		set.Remove(Int(rand.Intn(200)));
+	};
+	slice := set.ToSlice();
+	for i, item := range slice {
+		if selected := select_item(set.root, uint(i)); selected != item {
+			t.Errorf("Position %v: expected %v: got %v", i, item, selected);
+		};
+	};
+	if err := FromSortInterface(slice, func(i int) Item { return slice[i]; }).Copy().CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestPopRandom(t *testing.T) {
+	if _, found := New().PopRandom(nil); found {
+		t.Errorf("Can't pop from an empty set");
+	};
+	r := rand.New(rand.NewSource(2));
+	counts := make([]int, 4);
+	const trials = 40000;
+	for i := 0; i < trials; i++ {
+		set := New(Int(0), Int(1), Int(2), Int(3));
+		item, found := set.PopRandom(r);
+		if !found || set.Has(item) || set.Cardinality() != 3 {
+			t.Fatalf("Expected %v to be removed: got %v", item, set.ToSlice());
+		};
+		counts[int(item.(Int))]++;
+	};
+	expected := float64(trials) / 4;
+	var chi_squared float64;
+	for _, n := range counts {
+		chi_squared += (float64(n) - expected) * (float64(n) - expected) / expected;
+	};
+	// the 0.001 critical value for 3 degrees of freedom
+	if chi_squared > 16.27 {
+		t.Errorf("Pops aren't uniform (chi squared %v): %v", chi_squared, counts);
+	};
+	set := make_Int_set_serial(1, 100);
+	popped := New();
+	for set.Cardinality() > 0 {
+		item, _ := set.PopRandom(nil);
+		popped.Add(item);
+		if err := set.CheckInvariants(); err != nil {
+			t.Fatalf("%v", err);
+		};
+	};
+	if !Equal(popped, make_Int_set_serial(1, 100)) {
+		t.Errorf("Expected every member to be popped once: got %v", popped.ToSlice());
+	};
+};
+
+func TestSample(t *testing.T) {
+	set := make_Int_set_serial(0, 99);
+	sample := set.Sample(rand.New(rand.NewSource(42)), 5);
+	again := set.Sample(rand.New(rand.NewSource(42)), 5);
+	if !reflect.DeepEqual(sample, again) {
+		t.Errorf("Same seed gave different samples: %v and %v", sample, again);
+	};
+	golden := fmt.Sprint(sample);
+	if golden != "[4 17 23 42 93]" {
+		t.Errorf("Expected golden sample: got %v", golden);
+	};
+	for _, k := range []int{-1, -100} {
+		if sample = set.Sample(nil, k); sample == nil || len(sample) != 0 {
+			t.Errorf("Sample(nil, %v): expected an empty sample: got %v", k, sample);
+		};
+	};
+	for k := 0; k <= 110; k += 11 {
+		sample = set.Sample(nil, k);
+		if expected := min(k, 100); len(sample) != expected {
+			t.Errorf("Expected %v items: got %v", expected, len(sample));
+		};
+		if !strictly_ascending(sample) {
+			t.Errorf("Expected distinct items in order: got %v", sample);
+		};
+		for _, item := range sample {
+			if !set.Has(item) {
+				t.Errorf("Unexpected item %v", item);
+			};
+		};
+	};
+	r := rand.New(rand.NewSource(3));
+	counts := make([]int, 10);
+	const trials = 20000;
+	small := make_Int_set_serial(0, 9);
+	for i := 0; i < trials; i++ {
+		for _, item := range small.Sample(r, 3) {
+			counts[int(item.(Int))]++;
+		};
+	};
+	expected := float64(trials) * 3 / 10;
+	var chi_squared float64;
+	for _, n := range counts {
+		chi_squared += (float64(n) - expected) * (float64(n) - expected) / expected;
+	};
+	// the 0.001 critical value for 9 degrees of freedom
+	if chi_squared > 27.88 {
+		t.Errorf("Samples aren't uniform (chi squared %v): %v", chi_squared, counts);
+	};
+};
+
+func TestSampleDistinct(t *testing.T) {
+	r := rand.New(rand.NewSource(4));
+	for trial := 0; trial < 50; trial++ {
+		set := New();
+		for i := r.Intn(40); i > 0; i-- {
+			set.Add(Int(r.Intn(30)));
+			set.Add(String(fmt.Sprint(r.Intn(30))));
+		};
+		k := r.Intn(int(set.Cardinality()) + 10);
+		sample := set.Sample(r, k);
+		if expected := min(k, int(set.Cardinality())); len(sample) != expected {
+			t.Errorf("Expected %v items: got %v", expected, len(sample));
+		};
+		if distinct := New(sample...); distinct.Cardinality() != uint(len(sample)) || !Subset(distinct, set) {
+			t.Errorf("Expected distinct members of %v: got %v", set.ToSlice(), sample);
+		};
+	};
+};
+
+func TestMedianQuantile(t *testing.T) {
+	for n := 0; n <= 12; n++ {
+		set := New();
+		for i := 0; i < n; i++ {
+			set.Add(Int(i * 10));
+		};
+		slice := set.ToSlice();
+		median, found := set.Median();
+		if found != (n > 0) || n > 0 && median != slice[(n - 1) / 2] {
+			t.Errorf("n = %v: expected median %v: got %v %v", n, slice, median, found);
+		};
+		for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.99, 1} {
+			item, found := set.Quantile(q);
+			if n == 0 {
+				if found {
+					t.Errorf("n = 0: unexpected quantile %v", item);
+				};
+				continue;
+			};
+			rank := int(math.Ceil(q * float64(n)));
+			if rank < 1 {
+				rank = 1;
+			};
+			if !found || item != slice[rank - 1] {
+				t.Errorf("n = %v, q = %v: expected %v: got %v %v", n, q, slice[rank - 1], item, found);
+			};
+		};
+	};
+	set := New(Int(1), Int(2));
+	if median, _ := set.Median(); median != Int(1) {
+		t.Errorf("Expected lower middle 1: got %v", median);
+	};
+	if item, _ := set.Quantile(0.5); item != Int(1) {
+		t.Errorf("Expected 1: got %v", item);
+	};
+	if item, _ := set.Quantile(0.51); item != Int(2) {
+		t.Errorf("Expected 2: got %v", item);
+	};
+	for _, q := range []float64{-0.1, 1.1, math.NaN(), math.Inf(1)} {
+		if item, found := set.Quantile(q); found {
+			t.Errorf("q = %v should be rejected: got %v", q, item);
+		};
+	};
+};
+
+func TestBlackHeight(t *testing.T) {
+	if bh, err := New().BlackHeight(); bh != 0 || err != nil {
+		t.Errorf("Expected 0 for an empty set: got %v %v", bh, err);
+	};
+	set := New();
+	for i := 0; i < 5000; i++ {
+		if rand.Intn(3) == 0 {
+			set.Remove(Int(rand.Intn(1000)));
+		} else {
+			set.Add(Int(rand.Intn(1000)));
+		};
+		if i % 100 != 0 {
+			continue;
+		};
+		bh, err := set.BlackHeight();
+		if err != nil {
+			t.Fatalf("After %v operations: %v", i, err);
+		};
+		// every path has at least bh black nodes so n >= 2^bh - 1
+		if n := set.Cardinality(); n + 1 < 1 << uint(bh) {
+			t.Errorf("Black height %v is too big for %v items", bh, n);
+		};
+	};
+	set = make_Int_set_serial(1, 100);
+	set.root.left.red = !set.root.left.red;
+	if _, err := set.BlackHeight(); err == nil {
+		t.Errorf("Expected an error for a corrupted tree");
+	};
+};
+
+var counted_calls int;
+
+type counted int;
+
+func (this counted) Precedes(other interface{}) bool {
+	counted_calls++;
+	return this < other.(counted);
+};
+
+func TestContains(t *testing.T) {
+	set := New(Int(1), Int(3), Int(5), String("a"));
+	if !set.ContainsAll() || set.ContainsAny() || len(set.ContainsWhich()) != 0 {
+		t.Errorf("Wrong answers for no items");
+	};
+	tests := []struct {
+		items []Item;
+		all, any bool;
+		which []bool;
+	}{
+		{[]Item{Int(1), Int(3)}, true, true, []bool{true, true}},
+		{[]Item{Int(3), Int(3), Int(3)}, true, true, []bool{true, true, true}},
+		{[]Item{Int(2), Int(2)}, false, false, []bool{false, false}},
+		{[]Item{Int(5), Int(2), String("a")}, false, true, []bool{true, false, true}},
+		{[]Item{Real(1), String("b"), nil}, false, false, []bool{false, false, false}},
+		{[]Item{Real(1), Int(1), Int(1), Int(1), Int(3), Int(3), Int(5), Int(6), String("a"), String("z")}, false, true,
+			[]bool{false, true, true, true, true, true, true, false, true, false}},
+	};
+	for _, test := range tests {
+		if all := set.ContainsAll(test.items...); all != test.all {
+			t.Errorf("ContainsAll(%v): expected %v: got %v", test.items, test.all, all);
+		};
+		if any := set.ContainsAny(test.items...); any != test.any {
+			t.Errorf("ContainsAny(%v): expected %v: got %v", test.items, test.any, any);
+		};
+		if which := set.ContainsWhich(test.items...); !reflect.DeepEqual(which, test.which) {
+			t.Errorf("ContainsWhich(%v): expected %v: got %v", test.items, test.which, which);
+		};
+	};
+	// many sorted probes are matched in a single walk of the tree
+	const n = 1024;
+	big := New();
+	probes := make([]Item, 0, n);
+	for i := 0; i < n; i++ {
+		big.Add(counted(2 * i));
+		probes = append(probes, counted(i));
+	};
+	counted_calls = 0;
+	which := big.ContainsWhich(probes...);
+	if counted_calls > 6 * n {
+		t.Errorf("Expected at most %v calls to Precedes(): got %v", 6 * n, counted_calls);
+	};
+	for i, has := range which {
+		if has != (i % 2 == 0) {
+			t.Errorf("%v: expected %v: got %v", i, i % 2 == 0, has);
+		};
+	};
+	if !big.ContainsAll(probes[0], probes[2], probes[1000]) || big.ContainsAll(probes...) || !big.ContainsAny(probes[1:]...) {
+		t.Errorf("Wrong answers for big set");
+	};
+};
+
+func TestDrainSorted(t *testing.T) {
+	set := New();
+	for i := 0; i < 500; i++ {
+		set.Add(Int(rand.Intn(1000)));
+		set.Add(String(fmt.Sprint(rand.Intn(1000))));
+	};
+	n := set.Cardinality();
+	drained := set.DrainSorted();
+	if uint(len(drained)) != n || !strictly_ascending(drained) {
+		t.Errorf("Expected %v items in order: got %v", n, drained);
+	};
+	if set.Cardinality() != 0 || set.root != nil {
+		t.Errorf("Expected the set to be empty");
+	};
+	if drained = set.DrainSorted(); len(drained) != 0 {
+		t.Errorf("Expected nothing from an empty set: got %v", drained);
+	};
+	set.Add(Int(1));
+	if !set.Has(Int(1)) || set.Cardinality() != 1 {
+		t.Errorf("Set unusable after DrainSorted()");
+	};
+};
+
+func TestDeleteRange(t *testing.T) {
+	make_set := func() *Set {
+		set := make_Int_set_serial(0, 199);
+		for i := 0; i < 50; i++ {
+			set.Add(String(fmt.Sprintf("%02d", i)));
+		};
+		return set;
+	};
+	in_range := func(item, lo, hi Item) bool {
+		return (lo == nil || compare_items(item, lo) >= 0) && (hi == nil || compare_items(item, hi) < 0);
+	};
+	tests := []struct {
+		lo, hi Item;
+		removed int;
+	}{
+		{nil, nil, 250},
+		{Int(10), Int(12), 2},
+		{Int(10), Int(10), 0},
+		{Int(12), Int(10), 0},
+		{Int(-5), Int(0), 0},
+		{Int(1000), String(""), 0},
+		{Int(150), String("10"), 60},
+		{Real(0), nil, 50},
+		{nil, Int(190), 190},
+		{Int(5), nil, 245},
+		{String("48"), String("zz"), 2},
+	};
+	for _, test := range tests {
+		set := make_set();
+		expected := make_set();
+		for item := range make_set().Iter() {
+			if in_range(item, test.lo, test.hi) {
+				expected.Remove(item);
+			};
+		};
+		set.BeginJournal(0);
+		if removed := set.DeleteRange(test.lo, test.hi); removed != test.removed {
+			t.Errorf("[%v, %v): expected %v removed: got %v", test.lo, test.hi, test.removed, removed);
+		};
+		if !Equal(set, expected) {
+			t.Errorf("[%v, %v): wrong result:\n%s", test.lo, test.hi, DiffString(set, expected));
+		};
+		if err := set.CheckInvariants(); err != nil {
+			t.Errorf("[%v, %v): %v", test.lo, test.hi, err);
+		};
+		for set.Undo() {
+		};
+		if !Equal(set, make_set()) {
+			t.Errorf("[%v, %v): Undo() didn't restore the set", test.lo, test.hi);
+		};
+	};
+	var deleted int;
+	set := Make(WithOnDelete(func(item Item) { deleted++; }), WithSelfCheck(true));
+	for i := 0; i < 100; i++ {
+		set.Add(Int(i));
+	};
+	version := set.Version();
+	if set.DeleteRange(Int(10), Int(90)) != 80 || deleted != 80 || set.Version() != version + 80 || set.Cardinality() != 20 {
+		t.Errorf("Expected 80 deletions: got %v callbacks and %v members", deleted, set.Cardinality());
+	};
+};
+
+func TestCollect(t *testing.T) {
+	var yielded int;
+	seq := func(yield func(item Item) bool) {
+		for i := 0; i < 100; i++ {
+			yielded++;
+			if !yield(Int(i % 10)) || !yield(String(fmt.Sprint(i % 7))) {
+				return;
+			};
+		};
+		yield(nil);
+	};
+	set := Collect(seq);
+	if yielded != 100 || set.Cardinality() != 17 {
+		t.Errorf("Expected 17 distinct items from 100 rounds: got %v from %v", set.Cardinality(), yielded);
+	};
+	for i := 0; i < 10; i++ {
+		if !set.Has(Int(i)) || i < 7 && !set.Has(String(fmt.Sprint(i))) {
+			t.Errorf("Missing %v", i);
+		};
+	};
+	if Collect(func(yield func(item Item) bool) {}).Cardinality() != 0 {
+		t.Errorf("Expected an empty set from an empty sequence");
+	};
+};
+
+func TestTakeSmallestLargest(t *testing.T) {
+	set := make_Int_set_serial(0, 9999);
+	set.Add(String("a"));
+	set.Add(String("b"));
+	var visits int;
+	visit_hook = func(node *ll_rb_node) { visits++; };
+	defer func() { visit_hook = nil; }();
+	height := int(max_depth(set.root));
+	for _, k := range []int{1, 5, 50} {
+		visits = 0;
+		smallest := set.TakeSmallest(k);
+		if len(smallest) != k || smallest[0] != Int(0) || smallest[k - 1] != Int(k - 1) || !strictly_ascending(smallest) {
+			t.Errorf("TakeSmallest(%v): got %v", k, smallest);
+		};
+		if visits > k + height {
+			t.Errorf("TakeSmallest(%v) visited %v nodes", k, visits);
+		};
+		visits = 0;
+		largest := set.TakeLargest(k);
+		if len(largest) != k || largest[k - 1] != String("b") || !strictly_ascending(largest) {
+			t.Errorf("TakeLargest(%v): got %v", k, largest);
+		};
+		if visits > k + height {
+			t.Errorf("TakeLargest(%v) visited %v nodes", k, visits);
+		};
+	};
+	if largest := set.TakeLargest(3); largest[0] != Int(9999) {
+		t.Errorf("Expected [9999 a b]: got %v", largest);
+	};
+	for _, k := range []int{0, -1} {
+		if len(set.TakeSmallest(k)) != 0 || len(set.TakeLargest(k)) != 0 {
+			t.Errorf("Expected nothing for k = %v", k);
+		};
+	};
+	small := New(Int(2), Int(1));
+	if all := small.TakeLargest(5); len(all) != 2 || all[0] != Int(1) {
+		t.Errorf("Expected [1 2]: got %v", all);
+	};
+	if all := small.TakeSmallest(5); len(all) != 2 || all[1] != Int(2) {
+		t.Errorf("Expected [1 2]: got %v", all);
+	};
+};
+
+func TestSeekFrom(t *testing.T) {
+	set := New();
+	for i := 0; i < 100; i += 2 {
+		set.Add(Int(i));
+	};
+	set.Add(String("a"));
+	collect := func(seq Seq, limit int) (items []Item) {
+		seq(func(item Item) bool {
+			items = append(items, item);
+			return len(items) < limit;
+		});
+		return;
+	};
+	if page := collect(set.SeekFrom(Int(41)), 100); len(page) != 30 || page[0] != Int(42) || page[28] != Int(98) || page[29] != String("a") {
+		t.Errorf("Expected 42..98 and \"a\": got %v", page);
+	};
+	if page := collect(set.SeekFrom(Int(42)), 3); !reflect.DeepEqual(page, []Item{Int(42), Int(44), Int(46)}) {
+		t.Errorf("Expected [42 44 46]: got %v", page);
+	};
+	// keyset pagination: each page starts after the last item of the previous one
+	var pages, total int;
+	for page := collect(set.SeekFrom(nil), 7); len(page) > 0; {
+		pages++;
+		total += len(page);
+		next, found := set.Successor(page[len(page) - 1]);
+		if !found {
+			break;
+		};
+		page = collect(set.SeekFrom(next), 7);
+	};
+	if total != 51 || pages != 8 {
+		t.Errorf("Expected 51 items in 8 pages: got %v in %v", total, pages);
+	};
+	if page := collect(set.SeekFrom(String("b")), 10); len(page) != 0 {
+		t.Errorf("Expected nothing after the last item: got %v", page);
+	};
+};
+
+func among(item Item, items []Item) bool {
+	for _, other := range items {
+		if other == item {
+			return true;
+		};
+	};
+	return false;
+};
+
+func TestTopKTracker(t *testing.T) {
+	N := 10000000;
+	if testing.Short() {
+		N = 100000;
+	};
+	const k = 100;
+	r := rand.New(rand.NewSource(5));
+	tracker := NewTopK(k);
+	// the k largest distinct values so far with the least at the top
+	least := &item_heap{make([]Item, 0, k), compare_items};
+	var admitted int;
+	for i := 0; i < N; i++ {
+		item := Item(Int(r.Intn(1 << 30)));
+		if tracker.Offer(item) {
+			admitted++;
+		};
+		switch {
+		case least.Len() == k && compare_items(item, least.items[0]) <= 0, among(item, least.items):
+		case least.Len() < k:
+			heap.Push(least, item);
+		default:
+			heap.Pop(least);
+			heap.Push(least, item);
+		};
+	};
+	expected := New(least.items...);
+	result := tracker.Result();
+	if !Equal(result, expected) {
+		t.Errorf("Wrong result:\n%s", DiffString(result, expected));
+	};
+	// about k (1 + ln(N / k)) are expected
+	if float64(admitted) > 2 * k * (1 + math.Log(float64(N) / k)) {
+		t.Errorf("Expected few admissions from a random stream: got %v", admitted);
+	};
+	tracker = NewTopK(3);
+	offers := []struct {
+		item Item;
+		admitted bool;
+	}{
+		{Int(5), true},
+		{Int(1), true},
+		{nil, false},
+		{Int(3), true},
+		{Int(0), false},
+		{Int(1), true},
+		{Int(4), true},
+		{Int(2), false},
+		{Int(3), true},
+		{String("a"), true},
+	};
+	for _, offer := range offers {
+		if admitted := tracker.Offer(offer.item); admitted != offer.admitted {
+			t.Errorf("Offer(%v): expected %v: got %v", offer.item, offer.admitted, admitted);
+		};
+	};
+	if result = tracker.Result(); !Equal(result, New(Int(4), Int(5), String("a"))) {
+		t.Errorf("Expected [4 5 a]: got %v", result.ToSlice());
+	};
+	if NewTopK(0).Offer(Int(1)) {
+		t.Errorf("A zero capacity tracker should reject everything");
+	};
+};
+
+func BenchmarkTopKReject(b *testing.B) {
+	b.StopTimer();
+	tracker := NewTopK(100);
+	for i := 0; i < 100; i++ {
+		tracker.Offer(Int(1000 + i));
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		tracker.Offer(Int(i % 1000));
+	};
+};
+
+func TestSymmetricDifferenceCount(t *testing.T) {
+	for trial := 0; trial < 20; trial++ {
+		setA, setB := New(), New();
+		for i := rand.Intn(200); i > 0; i-- {
+			setA.Add(Int(rand.Intn(100)));
+			setB.Add(Int(rand.Intn(100)));
+			setB.Add(String(fmt.Sprint(rand.Intn(10))));
+		};
+		expected := uint64(SymmetricDifference(setA, setB).Cardinality());
+		if count := setA.SymmetricDifferenceCount(setB); count != expected {
+			t.Errorf("Expected %v: got %v", expected, count);
+		};
+		if count := setB.SymmetricDifferenceCount(setA); count != expected {
+			t.Errorf("Expected %v (reversed): got %v", expected, count);
+		};
+		if count := setA.SymmetricDifferenceCount(setA.Copy()); count != 0 {
+			t.Errorf("Expected 0 for equal sets: got %v", count);
+		};
+	};
+};
+
+func TestMergeIter(t *testing.T) {
+	collect := func(seq Seq) (items []Item) {
+		items = []Item{};
+		seq(func(item Item) bool {
+			items = append(items, item);
+			return true;
+		});
+		return;
+	};
+	first, second := &Named{"k", []int{1}}, &Named{"k", []int{2}};
+	shards := []*Set{
+		New(Int(1), Int(4), Int(7), String("a")),
+		New(),
+		New(Int(2), Int(4), second, String("a")),
+		New(Int(3), first, Int(7), Int(9)),
+	};
+	merged := collect(MergeIter(shards...));
+	// pointer types have no package path so *Named comes first
+	expected := []Item{second, Int(1), Int(2), Int(3), Int(4), Int(7), Int(9), String("a")};
+	if len(merged) != len(expected) {
+		t.Fatalf("Expected %v: got %v", expected, merged);
+	};
+	for i, item := range merged {
+		if compare_items(item, expected[i]) != 0 {
+			t.Errorf("Position %v: expected %v: got %v", i, expected[i], item);
+		};
+	};
+	// ties are resolved in favour of the earliest set
+	if merged[0] != second {
+		t.Errorf("Expected the instance from the third set");
+	};
+	if merged = collect(MergeIter()); len(merged) != 0 {
+		t.Errorf("Expected nothing from no sets: got %v", merged);
+	};
+	if merged = collect(MergeIter(New(), New())); len(merged) != 0 {
+		t.Errorf("Expected nothing from empty sets: got %v", merged);
+	};
+	for trial := 0; trial < 10; trial++ {
+		var sets []*Set;
+		union := New();
+		for i := rand.Intn(6); i >= 0; i-- {
+			set := New();
+			for j := rand.Intn(100); j > 0; j-- {
+				set.Add(Int(rand.Intn(200)));
+			};
+			sets = append(sets, set);
+			union = Union(union, set);
+		};
+		if merged = collect(MergeIter(sets...)); !reflect.DeepEqual(merged, []Item(union.ToSlice())) {
+			t.Errorf("Expected %v: got %v", union.ToSlice(), merged);
+		};
+	};
+	var n int;
+	MergeIter(shards...)(func(item Item) bool {
+		n++;
+		return n < 3;
+	});
+	if n != 3 {
+		t.Errorf("Expected to stop after 3 items: got %v", n);
+	};
+};
+
+func TestSliceCache(t *testing.T) {
+	set := Make(WithSliceCache());
+	check := func(op string) {
+		slice := set.ToSlice();
+		if again := set.ToSlice(); len(slice) > 0 && &again[0] != &slice[0] {
+			t.Errorf("%s: expected the cached slice to be reused", op);
+		};
+		if expected := New(slice...); !Equal(set, expected) || uint(len(slice)) != set.Cardinality() || !strictly_ascending(slice) {
+			t.Errorf("%s: stale slice %v", op, slice);
+		};
+	};
+	check("empty");
+	for i := 0; i < 20; i++ {
+		set.Add(Int(i));
+	};
+	check("Add");
+	set.Remove(Int(5));
+	check("Remove");
+	set.Remove(Int(100));
+	check("Remove of absent item");
+	first := &Named{"k", []int{1}};
+	set.Add(first);
+	set.ToSlice();
+	set.Add(&Named{"k", []int{2}});
+	if slice := set.ToSlice(); slice[0] == first {
+		t.Errorf("Expected the replacement to be in the slice");
+	};
+	set.DeleteRange(Int(2), Int(18));
+	check("DeleteRange");
+	set.Copy().Add(Int(50));
+	if set.Has(Int(50)) || New(set.ToSlice()...).Has(Int(50)) {
+		t.Errorf("Copy shares the cache");
+	};
+	set.Clear();
+	check("Clear");
+	if len(set.ToSlice()) != 0 {
+		t.Errorf("Expected empty slice after Clear()");
+	};
+};
+
+func benchmark_to_slice(b *testing.B, set *Set) {
+	b.StopTimer();
+	for i := 0; i < 10000; i++ {
+		set.Add(Int(i));
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		set.ToSlice();
+	};
+};
+
+func BenchmarkToSlice(b *testing.B) {
+	benchmark_to_slice(b, New());
+};
+
+func BenchmarkToSliceCached(b *testing.B) {
+	benchmark_to_slice(b, Make(WithSliceCache()));
+};
+
+func TestUnionIter(t *testing.T) {
+	for trial := 0; trial < 20; trial++ {
+		setA, setB := New(), New();
+		for i := rand.Intn(200); i > 0; i-- {
+			setA.Add(Int(rand.Intn(150)));
+			setB.Add(Int(rand.Intn(150)));
+			if i % 5 == 0 {
+				setA.Add(String(fmt.Sprint(rand.Intn(20))));
+			};
+		};
+		streamed := []Item{};
+		UnionIter(setA, setB)(func(item Item) bool {
+			streamed = append(streamed, item);
+			return true;
+		});
+		if expected := Union(setA, setB).ToSlice(); !reflect.DeepEqual(streamed, []Item(expected)) {
+			t.Errorf("Expected %v: got %v", expected, streamed);
+		};
+		union := New();
+		for item := range setA.Iter() {
+			union.Add(item);
+		};
+		for item := range setB.Iter() {
+			union.Add(item);
+		};
+		if !Equal(union, Union(setA, setB)) {
+			t.Errorf("Union() is wrong:\n%s", DiffString(union, Union(setA, setB)));
+		};
+	};
+	first, second := &Named{"k", []int{1}}, &Named{"k", []int{2}};
+	var streamed []Item;
+	UnionIter(New(first, Int(1)), New(second, Int(2)))(func(item Item) bool {
+		streamed = append(streamed, item);
+		return len(streamed) < 2;
+	});
+	if len(streamed) != 2 || streamed[0] != first || streamed[1] != Int(1) {
+		t.Errorf("Expected [setA's instance, 1] then to stop: got %v", streamed);
+	};
+	if item, _ := Union(New(first), New(second, Int(1))).Find(first); item != first {
+		t.Errorf("Expected Union() to use setA's instance");
+	};
+	if err := Union(New(), make_Int_set_serial(1, 100)).CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	// sets with a custom order keep it
+	setA, setB := Make(WithOrder(by_time, same_id)), Make(WithOrder(by_time, same_id));
+	setA.Add(&event{"a", 10});
+	setA.Add(&event{"b", 20});
+	setB.Add(&event{"b", 5});
+	setB.Add(&event{"c", 30});
+	union := Union(setA, setB);
+	var got []string;
+	for item := range union.Iter() {
+		got = append(got, fmt.Sprintf("%s@%d", item.(*event).id, item.(*event).at));
+	};
+	if expected := []string{"a@10", "b@20", "c@30"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if !union.Has(&event{"b", 0}) || union.Has(&event{"d", 20}) {
+		t.Errorf("Expected look ups by ID in the union");
+	};
+	if err := union.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestCompare(t *testing.T) {
+	// in ascending order
+	sets := []*Set{
+		New(),
+		New(Int(1)),
+		New(Int(1), Int(2)),
+		New(Int(1), Int(2), String("a")),
+		New(Int(1), Int(3)),
+		New(Int(2)),
+		New(Int(2), Real(0)),
+		New(Real(0)),
+		New(String("a")),
+	};
+	for i, setA := range sets {
+		for j, setB := range sets {
+			expected := 0;
+			if i < j {
+				expected = -1;
+			} else if i > j {
+				expected = 1;
+			};
+			if cmp := Compare(setA, setB); cmp != expected {
+				t.Errorf("Compare(%v, %v): expected %v: got %v", setA.ToSlice(), setB.ToSlice(), expected, cmp);
+			};
+			if setA.Precedes(setB) != (i < j) {
+				t.Errorf("%v.Precedes(%v): expected %v", setA.ToSlice(), setB.ToSlice(), i < j);
+			};
+		};
+		if Compare(setA, setA.Copy()) != 0 {
+			t.Errorf("Expected a copy of %v to compare equal", setA.ToSlice());
+		};
+	};
+	// random sets: the order must be antisymmetric, transitive and agree with Equal()
+	random := make([]*Set, 30);
+	for i := range random {
+		random[i] = New();
+		for j := rand.Intn(4); j > 0; j-- {
+			random[i].Add(Int(rand.Intn(3)));
+		};
+	};
+	for _, a := range random {
+		for _, b := range random {
+			if Compare(a, b) != -Compare(b, a) || (Compare(a, b) == 0) != Equal(a, b) {
+				t.Errorf("Inconsistent comparison of %v and %v", a.ToSlice(), b.ToSlice());
+			};
+			for _, c := range random {
+				if Compare(a, b) < 0 && Compare(b, c) < 0 && Compare(a, c) >= 0 {
+					t.Errorf("Not transitive: %v %v %v", a.ToSlice(), b.ToSlice(), c.ToSlice());
+				};
+			};
+		};
+	};
+	set_of_sets := New();
+	for i := len(sets) - 1; i >= 0; i-- {
+		set_of_sets.Add(sets[i]);
+		set_of_sets.Add(sets[i].Copy());
+	};
+	if set_of_sets.Cardinality() != uint(len(sets)) {
+		t.Errorf("Expected %v distinct sets: got %v", len(sets), set_of_sets.Cardinality());
+	};
+	for i, item := range set_of_sets.ToSlice() {
+		if !Equal(item.(*Set), sets[i]) {
+			t.Errorf("Position %v: expected %v: got %v", i, sets[i].ToSlice(), item.(*Set).ToSlice());
+		};
+	};
+};
+
+func TestIntersectIter(t *testing.T) {
+	collect := func(seq Seq, limit int) (items []Item) {
+		items = []Item{};
+		seq(func(item Item) bool {
+			items = append(items, item);
+			return len(items) < limit;
+		});
+		return;
+	};
+	for trial := 0; trial < 20; trial++ {
+		setA, setB := New(), New();
+		for i := rand.Intn(200); i > 0; i-- {
+			setA.Add(Int(rand.Intn(150)));
+			setB.Add(Int(rand.Intn(150)));
+			setB.Add(String(fmt.Sprint(rand.Intn(20))));
+		};
+		expected := New();
+		for item := range setA.Iter() {
+			if setB.Has(item) {
+				expected.Add(item);
+			};
+		};
+		if streamed := collect(IntersectIter(setA, setB), 1000); !reflect.DeepEqual(streamed, []Item(expected.ToSlice())) {
+			t.Errorf("Expected %v: got %v", expected.ToSlice(), streamed);
+		};
+		if !Equal(Intersection(setA, setB), expected) || !Equal(Intersection(setB, setA), expected) {
+			t.Errorf("Intersection() is wrong");
+		};
+	};
+	first, second := &Named{"k", []int{1}}, &Named{"k", []int{2}};
+	if items := collect(IntersectIter(New(first, Int(1), Int(2)), New(second, Int(1), Int(2))), 2); len(items) != 2 || items[0] != first {
+		t.Errorf("Expected [setA's instance, 1] then to stop: got %v", items);
+	};
+	// a small set intersected with a big one must skip most of the big one
+	small, big := New(), New();
+	for i := 0; i < 100000; i++ {
+		big.Add(counted(i));
+	};
+	for i := 0; i < 10; i++ {
+		small.Add(counted(i * 9973));
+	};
+	small.Add(counted(-1));
+	small.Add(counted(200000));
+	for _, pair := range [][]*Set{[]*Set{small, big}, []*Set{big, small}} {
+		counted_calls = 0;
+		if items := collect(IntersectIter(pair[0], pair[1]), 100); len(items) != 10 {
+			t.Errorf("Expected 10 items: got %v", items);
+		};
+		if counted_calls > 3000 {
+			t.Errorf("Expected the big set to be skipped: %v calls to Precedes()", counted_calls);
+		};
+	};
+	// sets with a custom order keep it
+	setA, setB := Make(WithOrder(by_time, same_id)), Make(WithOrder(by_time, same_id));
+	setA.Add(&event{"a", 30});
+	setA.Add(&event{"b", 20});
+	setA.Add(&event{"c", 10});
+	setB.Add(&event{"a", 5});
+	setB.Add(&event{"c", 40});
+	intersection := Intersection(setA, setB);
+	var got []string;
+	for item := range intersection.Iter() {
+		got = append(got, fmt.Sprintf("%s@%d", item.(*event).id, item.(*event).at));
+	};
+	if expected := []string{"c@10", "a@30"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if !intersection.Has(&event{"a", 0}) || intersection.Has(&event{"b", 20}) {
+		t.Errorf("Expected look ups by ID in the intersection");
+	};
+	if err := intersection.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestNestedSets(t *testing.T) {
+	var _ Item = New();
+	inner := []*Set{New(Int(3)), New(Int(1), Int(2)), New(), New(Int(1))};
+	outer := New(String("x"), Int(7));
+	for _, set := range inner {
+		outer.Add(set);
+	};
+	outer.Add(New(Int(1)));
+	if outer.Cardinality() != 6 {
+		t.Errorf("Expected 6 members: got %v", outer.Cardinality());
+	};
+	if err := outer.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	// sets are ordered among the other types by type and among themselves by Compare()
+	var sets []*Set;
+	var others int;
+	for item := range outer.Iter() {
+		if set, ok := item.(*Set); ok {
+			if len(sets) > 0 && Compare(sets[len(sets) - 1], set) >= 0 {
+				t.Errorf("%v is out of order", set.ToSlice());
+			};
+			sets = append(sets, set);
+		} else {
+			others++;
+		};
+	};
+	if len(sets) != 4 || others != 2 {
+		t.Errorf("Expected 4 sets and 2 others: got %v and %v", len(sets), others);
+	};
+	if !outer.Has(New(Int(2), Int(1))) || outer.Has(New(Int(2))) {
+		t.Errorf("Wrong membership of nested sets");
+	};
+	outer.Remove(New(Int(3)));
+	if outer.Has(inner[0]) || outer.Cardinality() != 5 {
+		t.Errorf("Expected {3} to be removed");
+	};
+	nested := New(outer, New(outer.Copy()));
+	if nested.Cardinality() != 2 || !nested.Has(outer.Copy()) {
+		t.Errorf("Expected a set of sets of sets to work");
+	};
+};
+
+func permissions(names ...string) *Set {
+	set := New();
+	for _, name := range names {
+		set.Add(String(name));
+	};
+	return set;
+};
+
+func TestDeeplyNestedSets(t *testing.T) {
+	make_roles := func() *Set {
+		reader := New(permissions("read"), permissions("list", "stat"));
+		writer := New(permissions("read", "write"), permissions("delete"));
+		return New(writer, reader, New(), String("guest"));
+	};
+	roles := make_roles();
+	if err := roles.CheckInvariants(); err != nil {
+		t.Fatalf("%v", err);
+	};
+	// membership of equal but distinct sets at each level
+	if !roles.Has(New(permissions("stat", "list"), permissions("read"))) || roles.Has(New(permissions("read"))) {
+		t.Errorf("Wrong membership of bundles");
+	};
+	if !roles.Has(make_roles().ToSlice()[1]) || !New(roles).Has(make_roles()) {
+		t.Errorf("Wrong membership of roles");
+	};
+	// iteration at each level: the band of sets (in Compare() order) then
+	// the String band
+	expected := "[[] [[delete] [read write]] [[list stat] [read]] guest]";
+	if got := fmt.Sprint(nested_strings(roles)); got != expected {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	var bundles, sets, names int;
+	for role := range roles.Iter() {
+		bundle, ok := role.(*Set);
+		if !ok {
+			continue;
+		};
+		bundles++;
+		for set := range bundle.Iter() {
+			sets++;
+			names += int(set.(*Set).Cardinality());
+		};
+	};
+	if bundles != 3 || sets != 4 || names != 6 {
+		t.Errorf("Expected 3 bundles, 4 sets and 6 names: got %v, %v and %v", bundles, sets, names);
+	};
+	// changing a member set corrupts the outer set
+	reader := roles.ToSlice()[2].(*Set);
+	reader.Add(permissions("admin"));
+	if err := roles.CheckInvariants(); err == nil {
+		t.Errorf("Expected changing a member set to break the order");
+	};
+};
+
+// The members of set with nested sets replaced by slices of their members.
+func nested_strings(set *Set) (items []interface{}) {
+	for item := range set.Iter() {
+		if inner, ok := item.(*Set); ok {
+			items = append(items, nested_strings(inner));
+		} else {
+			items = append(items, item);
+		};
+	};
+	return;
+};
+
+func TestDifferenceIter(t *testing.T) {
+	collect := func(seq Seq, limit int) (items []Item) {
+		items = []Item{};
+		seq(func(item Item) bool {
+			items = append(items, item);
+			return len(items) < limit;
+		});
+		return;
+	};
+	for trial := 0; trial < 20; trial++ {
+		setA, setB := New(), New();
+		for i := rand.Intn(200); i > 0; i-- {
+			setA.Add(Int(rand.Intn(150)));
+			setB.Add(Int(rand.Intn(100)));
+			setA.Add(String(fmt.Sprint(rand.Intn(20))));
+		};
+		expected := New();
+		for item := range setA.Iter() {
+			if !setB.Has(item) {
+				expected.Add(item);
+			};
+		};
+		if streamed := collect(DifferenceIter(setA, setB), 1000); !reflect.DeepEqual(streamed, []Item(expected.ToSlice())) {
+			t.Errorf("Expected %v: got %v", expected.ToSlice(), streamed);
+		};
+		if !Equal(Difference(setA, setB), expected) {
+			t.Errorf("Difference() is wrong");
+		};
+	};
+	setA := make_Int_set_serial(1, 20);
+	// runs of setA only members and setB running out before setA
+	setB := New(Int(0), Int(5), Int(6), Int(12), Real(1));
+	expected := []Item{Int(1), Int(2), Int(3), Int(4), Int(7), Int(8), Int(9), Int(10), Int(11), Int(13)};
+	if items := collect(DifferenceIter(setA, setB), 10); !reflect.DeepEqual(items, expected) {
+		t.Errorf("Expected %v then to stop: got %v", expected, items);
+	};
+	if items := collect(DifferenceIter(setA, New()), 100); len(items) != 20 {
+		t.Errorf("Expected all of setA: got %v", items);
+	};
+	if items := collect(DifferenceIter(New(), setA), 100); len(items) != 0 {
+		t.Errorf("Expected nothing: got %v", items);
+	};
+	// the iterators compose: (setA - setB) - evens, intersected with setA
+	odd := func(seq Seq) Seq {
+		return func(yield func(item Item) bool) {
+			seq(func(item Item) bool {
+				return item.(Int) % 2 == 0 || yield(item);
+			});
+		};
+	};
+	chained := Collect(odd(DifferenceIter(setA, setB)));
+	if items := collect(IntersectIter(chained, setA), 100); !reflect.DeepEqual(items, []Item{Int(1), Int(3), Int(7), Int(9), Int(11), Int(13), Int(15), Int(17), Int(19)}) {
+		t.Errorf("Unexpected result from chained iterators: %v", items);
+	};
+	// sets with a custom order keep it
+	byA, byB := Make(WithOrder(by_time, same_id)), Make(WithOrder(by_time, same_id));
+	byA.Add(&event{"a", 30});
+	byA.Add(&event{"b", 20});
+	byA.Add(&event{"c", 10});
+	byB.Add(&event{"b", 40});
+	difference := Difference(byA, byB);
+	var got []string;
+	for item := range difference.Iter() {
+		got = append(got, fmt.Sprintf("%s@%d", item.(*event).id, item.(*event).at));
+	};
+	if expected := []string{"c@10", "a@30"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if !difference.Has(&event{"a", 0}) || difference.Has(&event{"b", 20}) {
+		t.Errorf("Expected look ups by ID in the difference");
+	};
+	if err := difference.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestEquivalent(t *testing.T) {
+	set := New();
+	if !set.Equivalent(Int(3), Int(3)) || set.Equivalent(Int(3), Int(4)) {
+		t.Errorf("Equivalent() disagrees with Precedes()");
+	};
+	if set.Equivalent(Int(3), Real(3)) {
+		t.Errorf("Items of different types shouldn't be equivalent");
+	};
+	if !set.Equivalent(&event{"a", 10}, &event{"a", 20}) {
+		t.Errorf("Items ordered by ID only should be equivalent");
+	};
+	by_id := Make(WithOrder(by_time, same_id));
+	if !by_id.Equivalent(&event{"a", 10}, &event{"a", 20}) || by_id.Equivalent(&event{"a", 10}, &event{"b", 10}) {
+		t.Errorf("Equivalent() disagrees with the custom equal function");
+	};
+	by_time_only := Make(WithOrder(by_time, nil));
+	if by_time_only.Equivalent(&event{"a", 10}, &event{"a", 20}) || !by_time_only.Equivalent(&event{"a", 10}, &event{"a", 10}) {
+		t.Errorf("Equivalent() disagrees with the custom order");
+	};
+	// agrees with what Add() does
+	for _, s := range []*Set{set, by_id, by_time_only} {
+		a, b := &event{"a", 10}, &event{"a", 20};
+		s.Add(a);
+		if inserted := s.Add(b); inserted == s.Equivalent(a, b) {
+			t.Errorf("Add() inserted = %v but Equivalent() = %v", inserted, s.Equivalent(a, b));
+		};
+	};
+};
+
+func TestEqualWalk(t *testing.T) {
+	setA := make_Int_set_serial(1, 100);
+	setB := make_Int_set_serial(1, 100);
+	if !Equal(setA, setB) {
+		t.Errorf("Expected equal sets");
+	};
+	for _, i := range []Int{1, 50, 100} {
+		setC := setB.Copy();
+		setC.Remove(i);
+		setC.Add(Real(i));
+		if Equal(setA, setC) || Equal(setC, setA) {
+			t.Errorf("Sets differing at %v reported equal", i);
+		};
+	};
+	if Equal(setA, make_Int_set_serial(1, 99)) {
+		t.Errorf("Sets of different sizes reported equal");
+	};
+	if !Equal(New(), New()) {
+		t.Errorf("Empty sets should be equal");
+	};
+	// the same IDs at different times in a different order
+	byA, byB := Make(WithOrder(by_time, same_id)), Make(WithOrder(by_time, same_id));
+	for i, id := range []string{"a", "b", "c"} {
+		byA.Add(&event{id, i});
+		byB.Add(&event{id, 10 - i});
+	};
+	if !Equal(byA, byB) || !Equal(byB, byA) {
+		t.Errorf("Expected sets with the same IDs to be equal");
+	};
+	byB.Remove(&event{"c", 0});
+	byB.Add(&event{"d", 0});
+	if Equal(byA, byB) || Equal(byB, byA) {
+		t.Errorf("Sets with different IDs reported equal");
+	};
+};
+
+func benchmark_equal(b *testing.B, differ Int) {
+	b.StopTimer();
+	setA := make_Int_set_serial(0, 99999);
+	setB := make_Int_set_serial(0, 99999);
+	if differ >= 0 {
+		setB.Remove(differ);
+		setB.Add(Int(-1));
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		Equal(setA, setB);
+	};
+};
+
+func BenchmarkEqual(b *testing.B) {
+	benchmark_equal(b, -1);
+};
+
+func BenchmarkEqualEarlyMismatch(b *testing.B) {
+	benchmark_equal(b, 10);
+};
+
+func TestColorCounts(t *testing.T) {
+	if red, black := New().ColorCounts(); red != 0 || black != 0 {
+		t.Errorf("Expected no nodes: got %v %v", red, black);
+	};
+	serial := make_Int_set_serial(1, 1000);
+	random := New();
+	for i := 0; i < 1000; i++ {
+		random.Add(Int(rand.Intn(5000)));
+	};
+	for _, set := range []*Set{serial, random} {
+		red, black := set.ColorCounts();
+		if uint(red + black) != set.Cardinality() {
+			t.Errorf("Expected %v nodes: got %v red and %v black", set.Cardinality(), red, black);
+		};
+		if red > black {
+			t.Errorf("Too many red nodes: %v red and %v black", red, black);
+		};
+	};
+	for i := Int(1); i <= 1000; i += 2 {
+		serial.Remove(i);
+	};
+	if red, black := serial.ColorCounts(); red + black != 500 || red > black {
+		t.Errorf("After deletions got %v red and %v black", red, black);
+	};
+};
+
+func TestSubsetWalk(t *testing.T) {
+	for trial := 0; trial < 20; trial++ {
+		setA, setB := New(), New();
+		for i := rand.Intn(50); i > 0; i-- {
+			setA.Add(Int(rand.Intn(60)));
+		};
+		setB = setA.Copy();
+		for i := rand.Intn(50); i > 0; i-- {
+			setB.Add(Int(rand.Intn(100)));
+			setB.Add(String(fmt.Sprint(rand.Intn(10))));
+		};
+		if !Subset(setA, setB) || !Subset(setA, setA) {
+			t.Errorf("Expected %v to be a subset of %v", setA, setB);
+		};
+		if setA.Cardinality() > 0 {
+			item, _ := setA.RandomItem(rand.New(rand.NewSource(int64(trial))));
+			setB.Remove(item);
+			if Subset(setA, setB) {
+				t.Errorf("%v isn't a subset of %v", setA, setB);
+			};
+		};
+	};
+	if !Subset(New(), New()) || !Subset(New(), New(Int(1))) || Subset(New(Int(1)), New()) {
+		t.Errorf("Wrong result for empty sets");
+	};
+	big, small := New(), New();
+	for i := 1; i <= 10000; i++ {
+		big.Add(counted(i));
+	};
+	for i := 0; i < 100; i++ {
+		small.Add(counted(i));
+	};
+	// counted(0), the first member of small, is missing from big
+	counted_calls = 0;
+	if Subset(small, big) {
+		t.Errorf("Expected the missing minimum to be detected");
+	};
+	if counted_calls > 100 {
+		t.Errorf("Expected an early exit: %v calls to Precedes()", counted_calls);
+	};
+};
+
+// a record whose Precedes() panics if either name is missing
+type partial struct {
+	name *string;
+	id int;
+};
+
+func (this *partial) Precedes(other interface{}) bool {
+	return *this.name < *other.(*partial).name;
+};
+
+func by_partial_id(a, b Item) int {
+	return a.(*partial).id - b.(*partial).id;
+};
+
+func TestWithFallbackOrder(t *testing.T) {
+	names := []string{"b", "a"};
+	items := []*partial{&partial{&names[0], 2}, &partial{nil, 3}, &partial{&names[1], 1}, &partial{nil, 0}};
+	if _, err := New(items[0]).HasSafe(items[1]); err == nil {
+		t.Errorf("Expected the primary order to fail");
+	};
+	set := Make(WithFallbackOrder(by_partial_id), WithSelfCheck(true));
+	for _, item := range items {
+		if !set.Add(item) {
+			t.Errorf("Expected %v to be inserted", item);
+		};
+	};
+	got := []int{};
+	for item := range set.Iter() {
+		got = append(got, item.(*partial).id);
+	};
+	if expected := []int{0, 1, 2, 3}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	for _, item := range items {
+		if !set.Has(item) {
+			t.Errorf("Expected to find %v", item);
+		};
+	};
+	if has, err := set.HasSafe(&partial{nil, 5}); has || err != nil {
+		t.Errorf("Expected no error: got %v %v", has, err);
+	};
+	set.Remove(items[1]);
+	if set.Has(items[1]) || set.Cardinality() != 3 {
+		t.Errorf("Expected %v to be removed", items[1]);
+	};
+	if copied := set.Copy(); !copied.Has(items[3]) || !copied.Add(&partial{nil, 4}) {
+		t.Errorf("Copies should inherit the fallback order");
+	};
+};
+
+func TestUnionAll(t *testing.T) {
+	if set := UnionAll(); set.Cardinality() != 0 {
+		t.Errorf("Expected an empty set: got %v", set);
+	};
+	only := make_Int_set_serial(1, 10);
+	if set := UnionAll(only); !Equal(set, only) || set == only {
+		t.Errorf("Expected a copy of %v: got %v", only, set);
+	} else if set.Add(Int(11)); only.Has(Int(11)) {
+		t.Errorf("Modifying the copy changed the original");
+	};
+	for trial := 0; trial < 10; trial++ {
+		sets := make([]*Set, rand.Intn(8) + 2);
+		expected := New();
+		for i := range sets {
+			sets[i] = New();
+			for j := rand.Intn(50); j > 0; j-- {
+				sets[i].Add(Int(rand.Intn(100)));
+				sets[i].Add(String(fmt.Sprint(rand.Intn(10))));
+			};
+			expected = Union(expected, sets[i]);
+		};
+		set := UnionAll(sets...);
+		if !Equal(set, expected) {
+			t.Errorf("Expected %v: got %v", expected, set);
+		};
+		if err := set.CheckInvariants(); err != nil {
+			t.Errorf("%v", err);
+		};
+	};
+	// the earliest argument's instance wins
+	first, second := &event{"a", 1}, &event{"a", 2};
+	set := UnionAll(New(), New(first), New(second, &event{"b", 3}));
+	if item, _ := set.Find(&event{"a", 0}); item != first || set.Cardinality() != 2 {
+		t.Errorf("Expected %v to be used: got %v", first, item);
+	};
+	// the first set's custom order is kept
+	by_time_sets := make([]*Set, 3);
+	for i := range by_time_sets {
+		by_time_sets[i] = Make(WithOrder(by_time, same_id));
+		for j, id := range []string{"a", "b", "c", "d"}[i:i + 2] {
+			by_time_sets[i].Add(&event{id, 10 * (i + 1) - j});
+		};
+	};
+	set = UnionAll(by_time_sets...);
+	var got []string;
+	for item := range set.Iter() {
+		got = append(got, fmt.Sprintf("%s@%d", item.(*event).id, item.(*event).at));
+	};
+	if expected := []string{"b@9", "a@10", "c@19", "d@29"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if !set.Has(&event{"c", 0}) || set.Has(&event{"e", 19}) {
+		t.Errorf("Expected look ups by ID in the union");
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	var merged []string;
+	MergeIter(by_time_sets...)(func(item Item) bool {
+		merged = append(merged, item.(*event).id);
+		return true;
+	});
+	if expected := []string{"b", "a", "c", "d"}; !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %v: got %v", expected, merged);
+	};
+};
+
+func make_shards(n int) (shards []*Set) {
+	shards = make([]*Set, n);
+	for i := range shards {
+		shards[i] = New();
+		for j := 0; j < 500; j++ {
+			shards[i].Add(Int(rand.Intn(50000)));
+		};
+	};
+	return;
+};
+
+func BenchmarkUnionAll(b *testing.B) {
+	b.StopTimer();
+	shards := make_shards(200);
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		UnionAll(shards...);
+	};
+};
+
+func BenchmarkUnionFold(b *testing.B) {
+	b.StopTimer();
+	shards := make_shards(200);
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		set := New();
+		for _, shard := range shards {
+			set = Union(set, shard);
+		};
+	};
+};
+
+func TestSnapshotIter(t *testing.T) {
+	set := Make(WithSelfCheck(true));
+	for i := 0; i < 1000; i++ {
+		set.Add(Int(rand.Intn(2000)));
+	};
+	for round := 0; round < 5; round++ {
+		expected := set.ToSlice();
+		snapshot := set.SnapshotIter();
+		done := make(chan []Item);
+		go func() {
+			items := []Item{};
+			for pass := 0; pass < 3; pass++ {
+				items = items[0:0];
+				snapshot(func(item Item) bool {
+					items = append(items, item);
+					return true;
+				});
+			};
+			done <- items;
+		}();
+		for i := 0; i < 2000; i++ {
+			if rand.Intn(2) == 0 {
+				set.Remove(Int(rand.Intn(2000)));
+			} else {
+				set.Add(Int(rand.Intn(2000)));
+			};
+		};
+		if items := <-done; !reflect.DeepEqual(items, []Item(expected)) {
+			t.Errorf("Round %v: snapshot changed: expected %v items: got %v", round, len(expected), len(items));
+		};
+		if err := set.CheckInvariants(); err != nil {
+			t.Errorf("%v", err);
+		};
+	};
+	// the snapshot doesn't see later changes, the set sees all of them
+	set = make_Int_set_serial(1, 10);
+	snapshot := set.SnapshotIter();
+	set.Remove(Int(5));
+	set.Add(Int(11));
+	got := []Item{};
+	snapshot(func(item Item) bool {
+		got = append(got, item);
+		return true;
+	});
+	if !reflect.DeepEqual(got, []Item(make_Int_set_serial(1, 10).ToSlice())) {
+		t.Errorf("Snapshot changed: %v", got);
+	};
+	if set.Has(Int(5)) || !set.Has(Int(11)) || set.Cardinality() != 10 {
+		t.Errorf("Changes after the snapshot were lost: %v", set);
+	};
+	New().SnapshotIter()(func(item Item) bool {
+		t.Errorf("Unexpected item %v", item);
+		return true;
+	});
+};
+
+func TestWithChecksum(t *testing.T) {
+	check := func(set *Set, when string) {
+		if sum, hash := set.Checksum(), set.Hash(); sum != hash {
+			t.Fatalf("%s: running checksum %x but recomputed %x", when, sum, hash);
+		};
+	};
+	set := Make(WithChecksum(), WithSelfCheck(true));
+	check(set, "empty");
+	set.BeginJournal(0);
+	for i := 0; i < 5000; i++ {
+		id := fmt.Sprint(rand.Intn(200));
+		switch rand.Intn(10) {
+		case 0, 1, 2:
+			set.Remove(&event{id, 0});
+		case 3:
+			set.Undo();
+		case 4:
+			set.Redo();
+		case 5:
+			if i % 500 == 5 {
+				set.DeleteRange(&event{"1", 0}, &event{"5", 0});
+			};
+		default:
+			// replaces the payload of any member with the same ID
+			set.Add(&event{id, rand.Intn(1000)});
+		};
+		check(set, fmt.Sprint("after operation ", i));
+	};
+	if copied := set.Copy(); copied.Checksum() != set.Checksum() {
+		t.Errorf("Copy() didn't keep the checksum");
+	} else {
+		copied.Add(&event{"x", 1});
+		check(copied, "after adding to a copy");
+		check(set, "after the copy was changed");
+	};
+	set.Clear();
+	check(set, "after Clear()");
+	// members moved by a custom order
+	set = Make(WithChecksum(), WithOrder(by_time, same_id));
+	for i := 0; i < 1000; i++ {
+		set.Add(&event{fmt.Sprint(rand.Intn(50)), rand.Intn(100)});
+		check(set, "after moving a member");
+	};
+	if unchecked := New(Int(1), Int(2)); unchecked.Checksum() != unchecked.Hash() {
+		t.Errorf("Checksum() should fall back to Hash()");
+	};
+};
+
+type linked struct {
+	id int;
+	next *linked;
+};
+
+func (this *linked) Precedes(other interface{}) bool {
+	return this.id < other.(*linked).id;
+};
+
+func TestHashEncoding(t *testing.T) {
+	if hash_item(&event{"a", 1}) != hash_item(&event{"a", 1}) {
+		t.Errorf("Equal values at different addresses should have equal hashes");
+	};
+	if hash_item(&event{"a", 1}) == hash_item(&event{"a", 2}) || hash_item(Int(1)) == hash_item(Real(1)) {
+		t.Errorf("Expected different values to have different hashes");
+	};
+	if hash_item(&Named{"k", []int{1, 2}}) == hash_item(&Named{"k", []int{1}}) {
+		t.Errorf("Expected slices to be encoded");
+	};
+	// the encoding of a cycle stops when it gets back to the start
+	a, b := &linked{1, nil}, &linked{1, nil};
+	a.next, b.next = a, b;
+	if hash_item(a) != hash_item(b) {
+		t.Errorf("Equal cycles should have equal hashes");
+	};
+};
+
+func TestMergeSortedSlices(t *testing.T) {
+	setA := New(Int(1), Int(3), Int(5), String("a"), &event{"x", 1});
+	setB := New(Int(2), Int(3), Int(4), Int(5), &event{"x", 2});
+	items := MergeSortedSlices(setA, setB);
+	expected := []Item{Int(1), Int(2), Int(3), Int(3), Int(4), Int(5), Int(5), String("a")};
+	if len(items) != 10 || !reflect.DeepEqual(items[2:], expected) {
+		t.Errorf("Expected %v after the events: got %v", expected, items);
+	};
+	// both instances of a shared member are kept, setA's first
+	if items[0].(*event).at != 1 || items[1].(*event).at != 2 {
+		t.Errorf("Expected both events: got %v %v", items[0], items[1]);
+	};
+	if items := MergeSortedSlices(New(), New()); len(items) != 0 {
+		t.Errorf("Expected no items: got %v", items);
+	};
+	if items := MergeSortedSlices(setA, setA); len(items) != 10 {
+		t.Errorf("Expected every member twice: got %v", items);
+	};
+};
+
+var hashed_calls int;
+
+// hashed implements Hasher with a deliberately poor hash
+type hashed int;
+
+func (this hashed) Precedes(other interface{}) bool {
+	hashed_calls++;
+	return this < other.(hashed);
+};
+
+func (this hashed) Hash() uint64 {
+	return uint64(this);
+};
+
+func TestWithNegativeCache(t *testing.T) {
+	set := Make(WithNegativeCache(10));
+	members := make(map[hashed]bool);
+	for i := 0; i < 20000; i++ {
+		item := hashed(rand.Intn(5000));
+		switch rand.Intn(4) {
+		case 0:
+			set.Remove(item);
+			members[item] = false;
+		case 1:
+			if set.Has(item) != members[item] {
+				t.Fatalf("Has(%v) = %v: expected %v", item, !members[item], members[item]);
+			};
+		default:
+			set.Add(item);
+			members[item] = true;
+			set.Add(Int(item));
+		};
+	};
+	for item, in := range members {
+		if set.Has(item) != in {
+			t.Fatalf("Has(%v) = %v", item, !in);
+		};
+	};
+	if set.negative.stale * 2 > set.negative.added {
+		t.Errorf("Filter should have been rebuilt: %v stale of %v", set.negative.stale, set.negative.added);
+	};
+	// most misses shouldn't search the tree
+	big := Make(WithNegativeCache(10));
+	for i := 0; i < 10000; i++ {
+		big.Add(hashed(2 * i));
+	};
+	hashed_calls = 0;
+	for i := 0; i < 10000; i++ {
+		if big.Has(hashed(2 * i + 1)) {
+			t.Fatalf("Unexpected member %v", 2 * i + 1);
+		};
+	};
+	// a search takes about 2 * 14 calls so this allows ~5% false positives
+	if hashed_calls > 14000 {
+		t.Errorf("Too many calls to Precedes() for misses: %v", hashed_calls);
+	};
+	// removals make the filter stale until they rebuild it
+	for i := 0; i < 8000; i++ {
+		big.Remove(hashed(2 * i));
+	};
+	if big.negative.added >= 10000 || big.negative.stale * 2 > big.negative.added {
+		t.Errorf("Expected the filter to have been rebuilt: %v stale of %v", big.negative.stale, big.negative.added);
+	};
+	// look ups only read the filter
+	filter, words := big.negative, fmt.Sprint(big.negative.bits);
+	if !big.Has(hashed(19998)) || big.Has(hashed(0)) || big.negative != filter || fmt.Sprint(filter.bits) != words {
+		t.Errorf("Expected look ups to leave the filter unchanged");
+	};
+	copied := big.Copy();
+	big.Clear();
+	if big.Has(hashed(19998)) || !copied.Has(hashed(19998)) {
+		t.Errorf("Clear() or Copy() mishandled the filter");
+	};
+	big.Add(hashed(7));
+	if !big.Has(hashed(7)) {
+		t.Errorf("False negative after Clear()");
+	};
+	// custom equality that Hash() doesn't respect
+	odd_even := Make(WithNegativeCache(10), WithOrder(nil, func(a, b Item) bool {
+		return a.(hashed) % 2 == b.(hashed) % 2;
+	}));
+	odd_even.Add(hashed(1));
+	if !odd_even.Has(hashed(3)) {
+		t.Errorf("The filter shouldn't be used with a custom equal function");
+	};
+};
+
+func benchmark_misses(b *testing.B, set *Set) {
+	b.StopTimer();
+	for i := 0; i < 100000; i++ {
+		set.Add(hashed(2 * i));
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		set.Has(hashed(2 * (i % 100000) + 1));
+	};
+};
+
+func BenchmarkMisses(b *testing.B) {
+	benchmark_misses(b, New());
+};
+
+func BenchmarkMissesNegativeCache(b *testing.B) {
+	benchmark_misses(b, Make(WithNegativeCache(10)));
+};
+
+func BenchmarkMissesBloom(b *testing.B) {
+	benchmark_misses(b, NewWithBloom(100000));
+};
+
+func TestNewWithBloom(t *testing.T) {
+	calls := func(set *Set) int {
+		for i := 0; i < 10000; i++ {
+			set.Add(hashed(2 * i));
+		};
+		hashed_calls = 0;
+		for i := 0; i < 10000; i++ {
+			if set.Has(hashed(2 * i + 1)) {
+				t.Fatalf("Unexpected member %v", 2 * i + 1);
+			};
+		};
+		return hashed_calls;
+	};
+	set := NewWithBloom(10000);
+	plain, bloom := calls(New()), calls(set);
+	if bloom * 10 > plain {
+		t.Errorf("Expected far fewer than %v calls of Precedes(): got %v", plain, bloom);
+	};
+	if set.negative.capacity != 10000 || set.negative.added != 10000 {
+		t.Errorf("Filter shouldn't have been resized: capacity %v for %v", set.negative.capacity, set.negative.added);
+	};
+	for i := 0; i < 10000; i += 2 {
+		set.Remove(hashed(2 * i));
+	};
+	for i := 0; i < 10000; i++ {
+		if set.Has(hashed(2 * i)) != (i % 2 == 1) {
+			t.Fatalf("Has(%v) = %v", 2 * i, !(i % 2 == 1));
+		};
+	};
+	if NewWithBloom(-1).Has(hashed(1)) {
+		t.Errorf("Unexpected member");
+	};
+};
+
+func TestAddReportingPrevious(t *testing.T) {
+	set := New();
+	first, second := &event{"a", 1}, &event{"a", 2};
+	if previous, existed := set.AddReportingPrevious(first); previous != nil || existed {
+		t.Errorf("Expected no previous instance: got %v %v", previous, existed);
+	};
+	if previous, existed := set.AddReportingPrevious(second); previous != first || !existed {
+		t.Errorf("Expected %v: got %v %v", first, previous, existed);
+	};
+	if item, _ := set.Find(first); item != second || set.Cardinality() != 1 {
+		t.Errorf("Expected %v to have been replaced", first);
+	};
+	if previous, existed := set.AddReportingPrevious(nil); previous != nil || existed || set.Cardinality() != 1 {
+		t.Errorf("Nil item should be rejected");
+	};
+	full := Make(WithMaxLen(1));
+	full.Add(Int(1));
+	if _, existed := full.AddReportingPrevious(Int(2)); existed || full.Has(Int(2)) {
+		t.Errorf("Full set should refuse new items");
+	};
+	// one search rather than two
+	counted_set := New();
+	for i := 0; i < 1000; i++ {
+		counted_set.Add(counted(i));
+	};
+	counted_calls = 0;
+	for i := 500; i < 1500; i++ {
+		counted_set.AddReportingPrevious(counted(i));
+	};
+	single := counted_calls;
+	counted_calls = 0;
+	for i := 500; i < 1500; i++ {
+		counted_set.Find(counted(i));
+		counted_set.Add(counted(i));
+	};
+	if single * 3 > counted_calls * 2 {
+		t.Errorf("Expected fewer calls to Precedes(): %v versus %v", single, counted_calls);
+	};
+};
+
+func BenchmarkAddReportingPrevious(b *testing.B) {
+	set := New();
+	for i := 0; i < b.N; i++ {
+		set.AddReportingPrevious(Int(i % 10000));
+	};
+};
+
+func BenchmarkFindThenAdd(b *testing.B) {
+	set := New();
+	for i := 0; i < b.N; i++ {
+		item := Int(i % 10000);
+		set.Find(item);
+		set.Add(item);
+	};
+};
+
+func TestWithFinger(t *testing.T) {
+	set, plain := Make(WithFinger(), WithSelfCheck(true)), New();
+	for i := 0; i < 20000; i++ {
+		var item Item = Int(rand.Intn(1000));
+		if i % 3 == 0 {
+			item = String(fmt.Sprint(rand.Intn(100)));
+		};
+		switch rand.Intn(8) {
+		case 0:
+			set.Remove(item);
+			plain.Remove(item);
+		case 1:
+			set.Add(item);
+			plain.Add(item);
+		case 2:
+			got, found := set.Successor(item);
+			if expected, ok := plain.Successor(item); got != expected || found != ok {
+				t.Fatalf("Successor(%v) = %v %v: expected %v %v", item, got, found, expected, ok);
+			};
+		case 3:
+			got, found := set.Predecessor(item);
+			if expected, ok := plain.Predecessor(item); got != expected || found != ok {
+				t.Fatalf("Predecessor(%v) = %v %v: expected %v %v", item, got, found, expected, ok);
+			};
+		case 4:
+			if has, err := set.HasSafe(item); has != plain.Has(item) || err != nil {
+				t.Fatalf("HasSafe(%v) = %v %v", item, has, err);
+			};
+		default:
+			if set.Has(item) != plain.Has(item) {
+				t.Fatalf("Has(%v) = %v", item, !plain.Has(item));
+			};
+		};
+	};
+	if !Equal(set, plain) {
+		t.Errorf("Expected %v: got %v", plain, set);
+	};
+	// a replaced instance must be found rather than the old one
+	events := Make(WithFinger());
+	events.Add(&event{"a", 1});
+	events.Has(&event{"a", 0});
+	events.SnapshotIter();
+	events.Add(&event{"a", 2});
+	if item, _ := events.Find(&event{"a", 0}); item.(*event).at != 2 {
+		t.Errorf("Found the replaced instance %v", item);
+	};
+	// nearby look ups are cheaper than starting from the root
+	fingered, unfingered := Make(WithFinger()), New();
+	for i := 0; i < 100000; i++ {
+		fingered.Add(counted(i));
+		unfingered.Add(counted(i));
+	};
+	calls := make([]int, 2);
+	for j, s := range []*Set{fingered, unfingered} {
+		counted_calls = 0;
+		for i := 0; i < 100000; i += 3 {
+			if !s.Has(counted(i)) {
+				t.Fatalf("Wrong result for %v", i);
+			};
+		};
+		calls[j] = counted_calls;
+	};
+	if calls[0] * 2 > calls[1] {
+		t.Errorf("Expected far fewer calls to Precedes() with a finger: %v versus %v", calls[0], calls[1]);
+	};
+	// as is stepping through the set with Successor()
+	for j, s := range []*Set{fingered, unfingered} {
+		counted_calls = 0;
+		item, found := s.Successor(counted(-1));
+		for i := 0; found; i++ {
+			if item != counted(i) {
+				t.Fatalf("Expected successor %v: got %v", i, item);
+			};
+			item, found = s.Successor(item);
+		};
+		calls[j] = counted_calls;
+	};
+	if calls[0] * 2 > calls[1] {
+		t.Errorf("Expected far fewer calls to Precedes() for Successor() with a finger: %v versus %v", calls[0], calls[1]);
+	};
+};
+
+func benchmark_finger(b *testing.B, set *Set, sequential bool) {
+	b.StopTimer();
+	for i := 0; i < 100000; i++ {
+		set.Add(Int(i));
+	};
+	probes := make([]Int, 100000);
+	for i := range probes {
+		if sequential {
+			probes[i] = Int(i);
+		} else {
+			probes[i] = Int(rand.Intn(100000));
+		};
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		set.Has(probes[i % len(probes)]);
+	};
+};
+
+func BenchmarkSequentialHas(b *testing.B) {
+	benchmark_finger(b, New(), true);
+};
+
+func BenchmarkSequentialHasFinger(b *testing.B) {
+	benchmark_finger(b, Make(WithFinger()), true);
+};
+
+func BenchmarkRandomHas(b *testing.B) {
+	benchmark_finger(b, New(), false);
+};
+
+func BenchmarkRandomHasFinger(b *testing.B) {
+	benchmark_finger(b, Make(WithFinger()), false);
+};
+
+func TestBuilder(t *testing.T) {
+	builder := NewBuilder();
+	for _, item := range []Item{String("b"), Int(2), nil, String("a"), Real(1.5), Int(1), String("a"), Int(2)} {
+		builder.Add(item);
+	};
+	set := builder.Build();
+	expected := []Item{String("a"), String("b"), Int(1), Int(2), Real(1.5)};
+	if got := []Item(set.ToSlice()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	groups := []string{};
+	for group := range set.IterByType() {
+		groups = append(groups, group.Type);
+	};
+	if len(groups) != 3 || groups[0] != "heteroset.String" || groups[1] != "heteroset.Int" {
+		t.Errorf("Expected the first seen types first: got %v", groups);
+	};
+	// types the builder didn't see go last
+	set.Add(&event{"x", 1});
+	set.Add(Int(0));
+	if last, _ := set.Predecessor(&event{"y", 0}); last.(*event).id != "x" || !set.Has(Int(0)) {
+		t.Errorf("Expected the unseen type last: got %v", set.ToSlice());
+	};
+	if first, _ := set.Cursor().Item(); first != String("a") {
+		t.Errorf("Expected String(\"a\") first: got %v", first);
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	if empty := NewBuilder().Build(); empty.Cardinality() != 0 {
+		t.Errorf("Expected an empty set");
+	};
+};
+
+func TestSplitAt(t *testing.T) {
+	set := New();
+	// clustered keys: a pivot in the middle of the range would be lopsided
+	for i := 0; i < 1000; i++ {
+		set.Add(Int(rand.Intn(10)));
+		set.Add(Int(1000000 + rand.Intn(100000)));
+		set.Add(String(fmt.Sprint(rand.Intn(50))));
+	};
+	n := int(set.Cardinality());
+	all := set.ToSlice();
+	for _, k := range []int{-5, 0, 1, n / 3, n / 2, n - 1, n, n + 5} {
+		first, rest := set.SplitAt(k);
+		expected := min(max(k, 0), n);
+		if int(first.Cardinality()) != expected || int(rest.Cardinality()) != n - expected {
+			t.Errorf("SplitAt(%v): got sizes %v and %v", k, first.Cardinality(), rest.Cardinality());
+			continue;
+		};
+		if !reflect.DeepEqual(append(first.ToSlice(), rest.ToSlice()...), all) {
+			t.Errorf("SplitAt(%v): halves are out of order", k);
+		};
+		for _, half := range []*Set{first, rest} {
+			if err := half.CheckInvariants(); err != nil {
+				t.Errorf("SplitAt(%v): %v", k, err);
+			};
+		};
+		// the halves are independent of the original
+		first.Add(Int(-1));
+		rest.Remove(all[n - 1]);
+	};
+	if int(set.Cardinality()) != n || !set.Has(all[n - 1]) || set.Has(Int(-1)) {
+		t.Errorf("SplitAt() changed the original set");
+	};
+	by_time_set := Make(WithOrder(by_time, same_id));
+	by_time_set.Add(&event{"a", 3});
+	by_time_set.Add(&event{"b", 1});
+	by_time_set.Add(&event{"c", 2});
+	if first, rest := by_time_set.SplitAt(1); !first.Has(&event{"b", 0}) || !rest.Has(&event{"a", 0}) {
+		t.Errorf("Expected the custom order to be kept: got %v and %v", first, rest);
+	};
+};
+
+func TestNewInstrumented(t *testing.T) {
+	if stats := New(Int(1)).Stats(); stats.Comparisons != 0 || stats.NodeVisits != 0 {
+		t.Errorf("Expected no counts for an ordinary set: got %v", stats);
+	};
+	set := NewInstrumented();
+	// inserting into a tree of n items takes at most about 2 log2(n)
+	// comparisons so the total for n inserts is O(n log n)
+	last := uint64(0);
+	for n := 1; n <= 1 << 14; n++ {
+		set.Add(Int(rand.Int()));
+		if n & (n - 1) != 0 {
+			continue;
+		};
+		stats := set.Stats();
+		log2 := uint64(0);
+		for i := n; i > 1; i >>= 1 {
+			log2++;
+		};
+		if stats.Comparisons < uint64(n - 1) || stats.Comparisons > uint64(n) * (2 * log2 + 1) {
+			t.Errorf("%v inserts took %v comparisons", n, stats.Comparisons);
+		};
+		if stats.NodeVisits != stats.Comparisons {
+			t.Errorf("Inserts compare once per node: got %v comparisons and %v visits", stats.Comparisons, stats.NodeVisits);
+		};
+		if stats.Comparisons < last {
+			t.Errorf("Counts went down");
+		};
+		last = stats.Comparisons;
+	};
+	before := set.Stats();
+	set.Has(Int(-1));
+	after := set.Stats();
+	if visits := after.NodeVisits - before.NodeVisits; visits == 0 || visits > 2 * 15 {
+		t.Errorf("Look up visited %v nodes", visits);
+	};
+	if item, _ := set.Cursor().Item(); item != nil {
+		set.Remove(item);
+		if removed := set.Stats(); removed.NodeVisits <= after.NodeVisits || removed.Comparisons <= after.Comparisons {
+			t.Errorf("Remove() wasn't counted");
+		};
+	};
+	copied := set.Copy();
+	copied.Add(Int(1));
+	if copied.Stats().Comparisons != 0 {
+		t.Errorf("Copies shouldn't be instrumented");
+	};
+};
+
+func TestBuildBalanced(t *testing.T) {
+	var height func(node *ll_rb_node) int;
+	height = func(node *ll_rb_node) int {
+		if node == nil {
+			return 0;
+		};
+		return max(height(node.left), height(node.right)) + 1;
+	};
+	serial := func(n int, extra ...Item) Seq {
+		return func(yield func(item Item) bool) {
+			for i := 0; i < n; i++ {
+				if !yield(Int(i)) {
+					return;
+				};
+			};
+			for _, item := range extra {
+				yield(item);
+			};
+		};
+	};
+	n := 200000;
+	set := BuildBalanced(serial(n), n);
+	if err := set.CheckInvariants(); err != nil {
+		t.Fatalf("%v", err);
+	};
+	if set.Cardinality() != uint(n) || !Equal(set, make_Int_set_serial(0, Int(n - 1))) {
+		t.Errorf("Wrong contents: %v items", set.Cardinality());
+	};
+	// a perfectly balanced tree has height ceil(log2(n + 1))
+	if h := height(set.root); h != 18 {
+		t.Errorf("Expected height 18: got %v", h);
+	};
+	for _, hint := range []int{-1, 0, 1, 99, 101, 1000} {
+		set := BuildBalanced(serial(100, nil), hint);
+		if err := set.CheckInvariants(); err != nil || !Equal(set, make_Int_set_serial(0, 99)) {
+			t.Errorf("Hint %v: wrong result %v: %v", hint, set, err);
+		};
+	};
+	// not in order
+	set = BuildBalanced(serial(50, Int(3), String("a"), Int(-1)), 53);
+	if err := set.CheckInvariants(); err != nil || set.Cardinality() != 52 || !set.Has(Int(-1)) || !set.Has(String("a")) {
+		t.Errorf("Unordered input mishandled: %v: %v", set, err);
+	};
+	if set := BuildBalanced(serial(0), 0); set.Cardinality() != 0 || set.root != nil {
+		t.Errorf("Expected an empty set: got %v", set);
+	};
+};
+
+// Precedes() panics on the nth call after countdown_left is set to n
+type countdown int;
+
+var countdown_left int;
+
+func (this countdown) Precedes(other interface{}) bool {
+	if countdown_left--; countdown_left == 0 {
+		panic("countdown");
+	};
+	return this < other.(countdown);
+};
+
+func TestAddRemoveSafe(t *testing.T) {
+	// fail at every possible point of insertion and deletion (including
+	// part way through rebalancing) and check that nothing changes
+	failures, successes := 0, 0;
+	for n := 1; n < 200; n++ {
+		for _, remove := range []bool{false, true} {
+			countdown_left = -1;
+			set := Make(WithChecksum());
+			set.BeginJournal(0);
+			for i := 0; i < 100; i += 2 {
+				set.Add(countdown(i));
+			};
+			expected, version := set.ToSlice(), set.Version();
+			countdown_left = n;
+			var err os.Error;
+			if remove {
+				err = set.RemoveSafe(countdown(50));
+			} else {
+				_, err = set.AddSafe(countdown(51));
+			};
+			countdown_left = -1;
+			if e := set.CheckInvariants(); e != nil {
+				t.Fatalf("After failing at comparison %v: %v", n, e);
+			};
+			if err == nil {
+				successes++;
+				if set.Has(countdown(50)) == remove || set.Has(countdown(51)) == remove {
+					t.Errorf("Operation wasn't done");
+				};
+				continue;
+			};
+			failures++;
+			if cerr, ok := err.(*CompareError); !ok || cerr.Panic != "countdown" || cerr.B == nil {
+				t.Errorf("Expected a *CompareError: got %v", err);
+			} else if remove && cerr.A != countdown(50) || !remove && cerr.A != countdown(51) {
+				t.Errorf("Expected the probe to be identified: got %v", err);
+			};
+			if !reflect.DeepEqual(set.ToSlice(), expected) || set.Version() != version || set.Checksum() != set.Hash() {
+				t.Errorf("Failing at comparison %v changed the set: %v", n, set);
+			};
+			if set.Undo(); set.Has(countdown(98)) {
+				t.Errorf("Failed operation was journalled");
+			};
+		};
+	};
+	if failures == 0 || successes == 0 {
+		t.Errorf("Expected both failures and successes: got %v and %v", failures, successes);
+	};
+	set := New(Int(1));
+	if _, err := set.AddSafe(nil); err != ErrNilItem {
+		t.Errorf("Expected ErrNilItem: got %v", err);
+	};
+	if err := set.RemoveSafe(nil); err != ErrNilItem {
+		t.Errorf("Expected ErrNilItem: got %v", err);
+	};
+	// panics that aren't from comparisons are passed on
+	callback := Make(WithOnInsert(func(item Item) { panic("callback"); }));
+	if x := try_add_safe(callback, Int(1)); x != "callback" || callback.Cardinality() != 0 {
+		t.Errorf("Expected the callback's panic after restoring the set: got %v", x);
+	};
+};
+
+func try_add_safe(set *Set, item Item) (x interface{}) {
+	defer func() { x = recover(); }();
+	set.AddSafe(item);
+	return;
+};
+
+func TestTypedNil(t *testing.T) {
+	var nil_event *event;
+	set := New(Int(1), nil, nil_event, &event{"a", 1});
+	if set.Cardinality() != 2 {
+		t.Errorf("Expected nils to be ignored: got %v", set);
+	};
+	for _, item := range []Item{nil, nil_event} {
+		if set.Add(item) || set.Has(item) {
+			t.Errorf("%#v should be rejected", item);
+		};
+		set.Remove(item);
+		if _, err := set.HasSafe(item); err != ErrNilItem {
+			t.Errorf("HasSafe(%#v): expected ErrNilItem: got %v", item, err);
+		};
+		if err := set.AddChecked(item); err != ErrNilItem {
+			t.Errorf("AddChecked(%#v): expected ErrNilItem: got %v", item, err);
+		};
+		if _, err := set.AddSafe(item); err != ErrNilItem {
+			t.Errorf("AddSafe(%#v): expected ErrNilItem: got %v", item, err);
+		};
+		if err := set.RemoveSafe(item); err != ErrNilItem {
+			t.Errorf("RemoveSafe(%#v): expected ErrNilItem: got %v", item, err);
+		};
+		if _, found := set.Successor(item); found {
+			t.Errorf("Successor(%#v) should fail", item);
+		};
+	};
+	// nils among several items (the set is small enough for these to be
+	// checked by walking it)
+	if which := set.ContainsWhich(nil_event, Int(1)); !reflect.DeepEqual(which, []bool{false, true}) || set.ContainsAll(nil_event, Int(1)) {
+		t.Errorf("Expected the nil pointer not to be contained: got %v", which);
+	};
+	cursor := set.Cursor();
+	if cursor.Seek(nil_event) || cursor.Valid() {
+		t.Errorf("Seek(nil_event) should fail");
+	};
+	var from []Item;
+	set.SeekFrom(nil_event)(func(item Item) bool {
+		from = append(from, item);
+		return true;
+	});
+	if !reflect.DeepEqual(SetSlice(from), set.ToSlice()) {
+		t.Errorf("SeekFrom(nil_event) should start at the first member: got %v", from);
+	};
+	if removed := set.Copy().DeleteRange(nil_event, nil_event); removed != 2 {
+		t.Errorf("Nil pointer bounds should be unbounded: removed %v", removed);
+	};
+	if removed := set.Copy().RemoveType(nil_event); removed != 0 {
+		t.Errorf("RemoveType(nil_event) should remove nothing: removed %v", removed);
+	};
+	tracker := NewTopK(2);
+	if tracker.Offer(nil_event) || !tracker.Offer(&event{"b", 2}) || !tracker.Offer(Int(3)) || tracker.Result().Cardinality() != 2 {
+		t.Errorf("The tracker should reject the nil pointer");
+	};
+	builder := NewBuilder();
+	builder.Add(nil_event);
+	if built := builder.Build(); built.Cardinality() != 0 {
+		t.Errorf("The builder should ignore the nil pointer: got %v", built);
+	};
+	// a nil in a batch rejects the whole batch
+	if _, err := set.ApplyPatch([]Item{Int(2), nil_event}, nil); err != ErrNilItem || set.Has(Int(2)) {
+		t.Errorf("Expected ApplyPatch() to fail: got %v", err);
+	};
+	if items := Dedup([]Item{Int(2), nil_event, Int(2)}); len(items) != 1 {
+		t.Errorf("Expected Dedup() to drop the nil pointer: got %v", items);
+	};
+	// nil slices are ordinary values
+	if !set.Add(Bytes(nil)) || !set.Has(Bytes{}) {
+		t.Errorf("Bytes(nil) should be accepted");
+	};
+	if err := set.CheckInvariants(); err != nil || set.Cardinality() != 3 {
+		t.Errorf("Unexpected contents %v: %v", set, err);
+	};
+};
+
+func TestGroupBy(t *testing.T) {
+	set := New();
+	for i, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		set.Add(&event{id, i % 3});
+	};
+	groups := set.GroupBy(func(a, b Item) bool { return a.(*event).at == b.(*event).at; });
+	expected := [][]string{[]string{"a", "d", "g"}, []string{"b", "e"}, []string{"c", "f"}};
+	got := [][]string{};
+	for _, group := range groups {
+		ids := []string{};
+		for _, item := range group {
+			ids = append(ids, item.(*event).id);
+		};
+		got = append(got, ids);
+	};
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if groups := New().GroupBy(same_id); len(groups) != 0 {
+		t.Errorf("Expected no groups: got %v", groups);
+	};
+	// everything related
+	mixed := New(Int(1), Real(2), String("x"));
+	if groups := mixed.GroupBy(func(a, b Item) bool { return true; }); len(groups) != 1 || len(groups[0]) != 3 {
+		t.Errorf("Expected a single group: got %v", groups);
+	};
+};
+
+func TestLongestConsecutive(t *testing.T) {
+	next := func(item Item) Item {
+		if i, ok := item.(Int); ok {
+			return i + 1;
+		};
+		return nil;
+	};
+	equal := func(a, b Item) bool { return a == b; };
+	set := New(String("x"), String("y"));
+	for _, i := range []int{1, 2, 3, 5, 6, 7, 8, 10, 12, 13, 14, 15, 16, 20, 21} {
+		set.Add(Int(i));
+	};
+	expected := []Item{Int(12), Int(13), Int(14), Int(15), Int(16)};
+	if got := set.LongestConsecutive(next, equal); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	// the first of equally long runs
+	expected = []Item{Int(1), Int(2)};
+	if got := New(Int(5), Int(4), Int(2), Int(1)).LongestConsecutive(next, equal); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	expected = []Item{String("x")};
+	if got := New(String("x"), String("y")).LongestConsecutive(next, equal); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if got := New().LongestConsecutive(next, equal); got == nil || len(got) != 0 {
+		t.Errorf("Expected an empty run: got %v", got);
+	};
+};
+
+var cross_type_calls int;
+
+// a wrapped builtin whose Precedes() notes (rather than panics on) being
+// given an item of another type
+type wary int;
+
+func (this wary) Precedes(other interface{}) bool {
+	that, ok := other.(wary);
+	if !ok {
+		cross_type_calls++;
+		return false;
+	};
+	return this < that;
+};
+
+func TestTypeBanding(t *testing.T) {
+	// wrapped builtins and unnamed pointer types (whose package paths are
+	// empty) mixed with named types
+	items := []Item{
+		Int(1), Int(2), String("a"), String("b"), Float64(1.5), Bytes("x"),
+		Real(2.5), wary(1), wary(2), wary(3),
+		&Named{"n", nil}, &Named{"m", nil}, &Labelled{"l"}, &Labelled{"k"},
+		&event{"e", 1}, &event{"d", 2},
+	};
+	cross_type_calls = 0;
+	var first []string;
+	for trial := 0; trial < 20; trial++ {
+		set := New();
+		for _, i := range rand.Perm(len(items)) {
+			set.Add(items[i]);
+		};
+		if set.Cardinality() != uint(len(items)) {
+			t.Fatalf("Expected %v members: got %v", len(items), set.ToSlice());
+		};
+		// each type's members are together and the bands are in the same
+		// order whatever the order of insertion
+		bands := []string{};
+		for group := range set.IterByType() {
+			bands = append(bands, group.Type);
+		};
+		if len(bands) != 9 {
+			t.Errorf("Expected 9 bands: got %v", bands);
+		};
+		if first == nil {
+			first = bands;
+		} else if !reflect.DeepEqual(bands, first) {
+			t.Errorf("Band order changed: %v then %v", first, bands);
+		};
+		for _, item := range items {
+			if !set.Has(item) {
+				t.Errorf("Lost %v", item);
+			};
+		};
+		if err := set.CheckInvariants(); err != nil {
+			t.Errorf("%v", err);
+		};
+	};
+	if cross_type_calls != 0 {
+		t.Errorf("Precedes() was called with another type %v times", cross_type_calls);
+	};
+};
+
+// Precedes() is deliberately broken: it claims both a before b and b before
+// a whenever they differ
+type careless int;
+
+func (this careless) Precedes(other interface{}) bool {
+	return this != other.(careless);
+};
+
+// Precedes() is deliberately broken: it isn't transitive
+type cyclic int;
+
+func (this cyclic) Precedes(other interface{}) bool {
+	return (int(other.(cyclic)) - int(this) + 3) % 3 == 1;
+};
+
+func TestCheckComparator(t *testing.T) {
+	good := []Item{Int(3), Int(1), Int(2), String("a"), Real(1.5), nil, careless(1)};
+	if err := CheckComparator(good); err != nil {
+		t.Errorf("Unexpected error: %v", err);
+	};
+	if err := CheckComparator([]Item{Int(1), careless(1), careless(2)}); err == nil {
+		t.Errorf("Expected antisymmetry violation");
+	} else if !strings.Contains(err.String(), "precede each other") {
+		t.Errorf("Unexpected error: %v", err);
+	};
+	if err := CheckComparator([]Item{cyclic(0), cyclic(1), cyclic(2)}); err == nil {
+		t.Errorf("Expected transitivity violation");
+	} else if !strings.Contains(err.String(), "does not precede") {
+		t.Errorf("Unexpected error: %v", err);
+	};
+};
+
+// Embedded in the local types below to supply a Precedes() that insists on
+// being given an item of its own type
+type guard struct {
+	owner string;
+	n int;
+};
+
+type guarded interface {
+	guarding() *guard;
+};
+
+func (this *guard) guarding() *guard { return this; };
+
+func (this *guard) Precedes(other interface{}) bool {
+	that := other.(guarded).guarding();
+	if that.owner != this.owner {
+		panic(fmt.Sprintf("%v item given a %v item", this.owner, that.owner));
+	};
+	return this.n < that.n;
+};
+
+func make_twin_a(n int) Item {
+	type twin struct {
+		*guard;
+	};
+	return twin{&guard{"a", n}};
+};
+
+func make_twin_b(n int) Item {
+	type twin struct {
+		*guard;
+	};
+	return twin{&guard{"b", n}};
+};
+
+func TestIndistinguishableTypes(t *testing.T) {
+	ta := reflect.Typeof(make_twin_a(0));
+	tb := reflect.Typeof(make_twin_b(0));
+	if ta == tb || ta.PkgPath() != tb.PkgPath() || ta.Name() != tb.Name() || ta.String() != tb.String() {
+		t.Fatalf("Expected distinct but identically described types: got %v and %v", ta, tb);
+	};
+	items := []Item{};
+	for n := 0; n < 50; n++ {
+		items = append(items, make_twin_a(n), make_twin_b(n));
+	};
+	set := New();
+	for _, i := range rand.Perm(len(items)) {
+		set.Add(items[i]);
+	};
+	if set.Cardinality() != uint(len(items)) {
+		t.Fatalf("Expected %v members: got %v", len(items), set.Cardinality());
+	};
+	// the two types occupy one band each
+	changes := 0;
+	var last Item;
+	for item := range set.Iter() {
+		if last != nil && cmp_type(last, item) != 0 {
+			changes++;
+		};
+		last = item;
+	};
+	if changes != 1 {
+		t.Errorf("Expected two bands: got %v", changes + 1);
+	};
+	for _, item := range items {
+		if found, ok := set.Find(item); !ok || found.(guarded).guarding() != item.(guarded).guarding() {
+			t.Errorf("Find(%v) returned %v, %v", item, found, ok);
+		};
+	};
+	for _, i := range rand.Perm(len(items))[0:len(items) / 2] {
+		set.Remove(items[i]);
+		if set.Has(items[i]) {
+			t.Errorf("Failed to remove %v", items[i]);
+		};
+	};
+	if set.Cardinality() != uint(len(items) - len(items) / 2) {
+		t.Errorf("Expected %v members: got %v", len(items) - len(items) / 2, set.Cardinality());
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	if err := set.Validate(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestToByteKeyedMap(t *testing.T) {
+	set := New(Int(1), Int(2), String("1"), String("x"), Real(1.5));
+	serialized := func(item Item) []byte {
+		data, err := json.Marshal(item);
+		if err != nil {
+			t.Fatalf("%v", err);
+		};
+		return data;
+	};
+	m := set.ToByteKeyedMap(serialized);
+	expected := map[string]Item{
+		"1": Int(1), "2": Int(2), `"1"`: String("1"), `"x"`: String("x"), "1.5": Real(1.5),
+	};
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %v: got %v", expected, m);
+	};
+	// colliding keys: the last in set order wins
+	by_type := set.ToByteKeyedMap(func(item Item) []byte {
+		return []byte(reflect.Typeof(item).String());
+	});
+	if len(by_type) != 3 {
+		t.Errorf("Expected 3 keys: got %v", by_type);
+	};
+	for key, item := range by_type {
+		var last Item;
+		for member := range set.Iter() {
+			if reflect.Typeof(member).String() == key {
+				last = member;
+			};
+		};
+		if item != last {
+			t.Errorf("%v: expected %v: got %v", key, last, item);
+		};
+	};
+	if len(New().ToByteKeyedMap(serialized)) != 0 {
+		t.Errorf("Expected empty map");
+	};
+};
+
+// A mutable record ordered by key
+type record struct {
+	key int;
+	note string;
+};
+
+func (this *record) Precedes(other interface{}) bool {
+	return this.key < other.(*record).key;
+};
+
+func (this *record) CloneItem() Item {
+	clone := *this;
+	return &clone;
+};
+
+func TestDeepClone(t *testing.T) {
+	set := New();
+	for i := 0; i < 20; i++ {
+		set.Add(&record{i, "original"});
+		set.Add(&Named{fmt.Sprint(i), nil});
+		set.Add(Int(i));
+	};
+	clone := set.DeepClone();
+	if dump(clone.root, "") != dump(set.root, "") {
+		t.Errorf("Tree shape changed:\n%v\n%v", dump(set.root, ""), dump(clone.root, ""));
+	};
+	if err := clone.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	originals := set.ToSlice();
+	clones := clone.ToSlice();
+	for i, item := range clones {
+		switch c := item.(type) {
+		case *record:
+			if c == originals[i].(*record) {
+				t.Errorf("%v is shared", c);
+			};
+			c.note = "changed";
+			if originals[i].(*record).note != "original" {
+				t.Errorf("Change to clone %v seen by original", c);
+			};
+		case *Named:
+			if c != originals[i].(*Named) {
+				t.Errorf("%v is not shared", c);
+			};
+		};
+	};
+	if !Equal(clone, set) {
+		t.Errorf("Expected %v: got %v", set, clone);
+	};
+};
+
+func TestRoundRobinByType(t *testing.T) {
+	set := New(Int(1), Int(2), Int(3), Int(4), String("a"), String("b"), Real(0.5));
+	expected := []Item{};
+	for group := range set.IterByType() {
+		expected = append(expected, group.Items[0]);
+	};
+	expected = append(expected, Int(2), String("b"), Int(3), Int(4));
+	if expected[0] != Int(1) || expected[1] != Real(0.5) || expected[2] != String("a") {
+		t.Fatalf("Unexpected type order %v", expected);
+	};
+	got := []Item{};
+	set.RoundRobinByType()(func(item Item) bool {
+		got = append(got, item);
+		return true;
+	});
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if !Equal(New(got...), set) {
+		t.Errorf("Expected all of %v: got %v", set, got);
+	};
+	count := 0;
+	set.RoundRobinByType()(func(item Item) bool {
+		count++;
+		return count < 4;
+	});
+	if count != 4 {
+		t.Errorf("Expected to stop after 4: got %v", count);
+	};
+	New().RoundRobinByType()(func(item Item) bool {
+		t.Errorf("Unexpected item %v", item);
+		return true;
+	});
+};
+
+func TestWithValidator(t *testing.T) {
+	negative := os.NewError("negative");
+	set := Make(WithValidator(func(item Item) os.Error {
+		if i, ok := item.(Int); ok && i < 0 {
+			return negative;
+		};
+		return nil;
+	}));
+	if !set.Add(Int(1)) || set.Add(Int(-1)) || set.Has(Int(-1)) {
+		t.Errorf("Expected only Int(1) to be added: got %v", set);
+	};
+	if previous, existed := set.AddReportingPrevious(Int(-2)); existed || previous != nil || set.Has(Int(-2)) {
+		t.Errorf("Expected Int(-2) to be dropped: got %v", set);
+	};
+	if err := set.AddChecked(Int(-3)); err != negative {
+		t.Errorf("Expected %v: got %v", negative, err);
+	};
+	if inserted, err := set.AddSafe(Int(-4)); inserted || err != negative {
+		t.Errorf("Expected %v: got %v, %v", negative, inserted, err);
+	};
+	if err := set.AddChecked(String("x")); err != nil {
+		t.Errorf("Unexpected error: %v", err);
+	};
+	// a rejected item makes the whole patch fail
+	changed, err := set.ApplyPatch([]Item{Int(2), Int(-5), Int(3)}, []Item{Int(1)});
+	if changed != 0 || err != negative {
+		t.Errorf("Expected %v: got %v, %v", negative, changed, err);
+	};
+	if !Equal(set, New(Int(1), String("x"))) {
+		t.Errorf("Expected set unchanged: got %v", set);
+	};
+	if changed, err = set.ApplyPatch([]Item{Int(2), Int(3)}, []Item{Int(1)}); changed != 3 || err != nil {
+		t.Errorf("Expected 3 changes: got %v, %v", changed, err);
+	};
+	if !Equal(set, New(Int(2), Int(3), String("x"))) {
+		t.Errorf("Unexpected result %v", set);
+	};
+};
+
+func TestWithNormalizer(t *testing.T) {
+	normalizations := 0;
+	set := Make(WithNormalizer(func(item Item) Item {
+		normalizations++;
+		if s, ok := item.(String); ok {
+			return String(strings.ToLower(strings.TrimSpace(string(s))));
+		};
+		return item;
+	}));
+	for _, word := range []string{"Foo", " bar", "BAZ ", "qux", "Quux"} {
+		set.Add(String(word));
+	};
+	set.Add(Int(1));
+	if set.Cardinality() != 6 || set.Add(String("FOO")) {
+		t.Errorf("Expected FOO to replace foo: got %v", set);
+	};
+	if instance, found := set.Find(String("foo")); !found || instance != String("foo") {
+		t.Errorf("Expected foo: got %v %v", instance, found);
+	};
+	if instance, found := set.Find(String(" Bar ")); !found || instance != String("bar") {
+		t.Errorf("Expected bar: got %v %v", instance, found);
+	};
+	if has, err := set.HasSafe(String("QUX")); !has || err != nil {
+		t.Errorf("Expected QUX to be found: got %v %v", has, err);
+	};
+	// in order once normalized so they are found by a walk which normalizes
+	// each of them only once
+	normalizations = 0;
+	if !set.ContainsAll(String("BAR"), String("Baz"), String("FOO"), String("QUUX"), String("Qux")) {
+		t.Errorf("Expected all to be found");
+	};
+	if normalizations != 5 {
+		t.Errorf("Expected 5 normalizations: got %v", normalizations);
+	};
+	if !set.Equivalent(String("Foo"), String("fOO")) {
+		t.Errorf("Expected Foo and fOO to be equivalent");
+	};
+	if next, _ := set.Successor(String("BAZ")); next != String("foo") {
+		t.Errorf("Expected foo: got %v", next);
+	};
+	if prev, _ := set.Predecessor(String("Foo")); prev != String("baz") {
+		t.Errorf("Expected baz: got %v", prev);
+	};
+	got := []Item{};
+	set.SeekFrom(String("BAZ"))(func(item Item) bool {
+		got = append(got, item);
+		return true;
+	});
+	if expected := []Item{String("baz"), String("foo"), String("quux"), String("qux")}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v: got %v", expected, got);
+	};
+	if n := set.DeleteRange(String("BAR"), String("Quux")); n != 3 || set.Has(String("baz")) || !set.Has(String("quux")) {
+		t.Errorf("Expected bar, baz and foo to be deleted: got %v %v", n, set);
+	};
+	set.Remove(String("QUX"));
+	if set.Has(String("qux")) {
+		t.Errorf("Expected qux to have been removed");
+	};
+	if item := set.Intern(String("  New")); item != String("new") {
+		t.Errorf("Expected new: got %v", item);
+	};
+	copied := set.Copy();
+	if !copied.Has(String("NEW")) {
+		t.Errorf("Copy should use the normalizer");
+	};
+	normalizations = 0;
+	set.Add(nil);
+	set.Has(nil);
+	if normalizations != 0 {
+		t.Errorf("Normalizer called with nil");
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+};
+
+func TestTypeHistogram(t *testing.T) {
+	set := New(Int(1), Int(2), Int(3), String("a"), Real(1.5), Real(2.5), &Named{"n", nil});
+	expected := map[string]uint64{
+		"heteroset.Int": 3, "heteroset.String": 1, "heteroset.Real": 2, "*heteroset.Named": 1,
+	};
+	if histogram := set.TypeHistogram(); !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("Expected %v: got %v", expected, histogram);
+	};
+	if histogram := New().TypeHistogram(); len(histogram) != 0 {
+		t.Errorf("Expected empty histogram: got %v", histogram);
+	};
+	twins := New(make_twin_a(1), make_twin_a(2), make_twin_b(1));
+	if histogram := twins.TypeHistogram(); len(histogram) != 1 || histogram[reflect.Typeof(make_twin_a(0)).String()] != 3 {
+		t.Errorf("Expected the twins to share a count: got %v", histogram);
+	};
+};
+
+func TestWithArena(t *testing.T) {
+	plain, slabbed := New(), Make(WithArena(16));
+	r := rand.New(rand.NewSource(1));
+	for i := 0; i < 5000; i++ {
+		item := Int(r.Intn(1000));
+		switch r.Intn(10) {
+		case 0, 1, 2:
+			plain.Remove(item);
+			slabbed.Remove(item);
+		case 3:
+			lo, hi := Int(r.Intn(1000)), Int(r.Intn(1000));
+			plain.DeleteRange(lo, hi);
+			slabbed.DeleteRange(lo, hi);
+		case 4:
+			plain.SnapshotIter();
+			slabbed.SnapshotIter();
+		default:
+			plain.Add(item);
+			slabbed.Add(item);
+		};
+		if err := slabbed.CheckInvariants(); err != nil {
+			t.Fatalf("%v", err);
+		};
+		if dump(slabbed.root, "") != dump(plain.root, "") {
+			t.Fatalf("Trees differ after %v operations", i + 1);
+		};
+	};
+	if err := plain.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	set := Make(WithArena(0));
+	for i := 0; i < 10000; i++ {
+		set.Add(Int(i));
+	};
+	if set.arena.slabs != 3 || set.arena.slab_len != default_slab_len {
+		t.Errorf("Expected 3 slabs of %v: got %v of %v", default_slab_len, set.arena.slabs, set.arena.slab_len);
+	};
+	set.Clear();
+	if set.arena.slabs != 0 || len(set.arena.free) != 0 {
+		t.Errorf("Clear() should abandon the slabs");
+	};
+	set.Add(Int(1));
+	if set.arena.slabs != 1 || !set.Has(Int(1)) {
+		t.Errorf("Expected a new slab");
+	};
+	// the nodes unlinked by removals are cleared unless a snapshot shares
+	// them
+	nodes := func(set *Set) map[*ll_rb_node]bool {
+		found := make(map[*ll_rb_node]bool);
+		var walk func(node *ll_rb_node);
+		walk = func(node *ll_rb_node) {
+			if node != nil {
+				found[node] = true;
+				walk(node.left);
+				walk(node.right);
+			};
+		};
+		walk(set.root);
+		return found;
+	};
+	for _, shared := range []bool{false, true} {
+		set := Make(WithArena(16));
+		for i := 0; i < 100; i++ {
+			set.Add(Int(i));
+		};
+		if shared {
+			set.SnapshotIter();
+		};
+		before := nodes(set);
+		for i := 0; i < 100; i += 3 {
+			set.Remove(Int(i));
+		};
+		after := nodes(set);
+		var unlinked, cleared int;
+		for node := range before {
+			if !after[node] {
+				unlinked++;
+				if node.item == nil {
+					cleared++;
+				};
+			};
+		};
+		if shared && cleared != 0 || !shared && (unlinked == 0 || cleared != unlinked) {
+			t.Errorf("Shared %v: %v of %v unlinked nodes cleared", shared, cleared, unlinked);
+		};
+	};
+};
+
+var build_items []Item;
+
+func benchmark_build(b *testing.B, options ...Option) {
+	b.StopTimer();
+	if build_items == nil {
+		build_items = make([]Item, 10000000);
+		for i := range build_items {
+			build_items[i] = Int(i);
+		};
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		set := Make(options...);
+		for _, item := range build_items {
+			set.Add(item);
+		};
+	};
+};
+
+func BenchmarkBuild(b *testing.B) {
+	benchmark_build(b);
+};
+
+func BenchmarkBuildArena(b *testing.B) {
+	benchmark_build(b, WithArena(0));
+};
+
+func TestRemoveType(t *testing.T) {
+	deleted := 0;
+	set := Make(WithSelfCheck(true), WithOnDelete(func(item Item) { deleted++; }));
+	for i := 0; i < 100; i++ {
+		set.Add(Int(i));
+		set.Add(String(fmt.Sprint(i)));
+		set.Add(Real(i));
+	};
+	if removed := set.RemoveType(Int(0)); removed != 100 || deleted != 100 {
+		t.Errorf("Expected 100 removed: got %v (%v reported)", removed, deleted);
+	};
+	if histogram := set.TypeHistogram(); len(histogram) != 2 || histogram["heteroset.String"] != 100 || histogram["heteroset.Real"] != 100 {
+		t.Errorf("Expected only strings and reals: got %v", histogram);
+	};
+	// removed one at a time
+	set.Add(Int(7));
+	if removed := set.RemoveType(Int(-1)); removed != 1 || set.Cardinality() != 200 {
+		t.Errorf("Expected 1 removed: got %v", removed);
+	};
+	if removed := set.RemoveType(Int(0)); removed != 0 || set.RemoveType(nil) != 0 {
+		t.Errorf("Expected nothing removed: got %v", removed);
+	};
+	if removed := set.RemoveType(Real(0)); removed != 100 || set.Cardinality() != 100 || set.Has(Real(1)) || !set.Has(String("1")) {
+		t.Errorf("Expected only strings to remain: got %v %v", removed, set);
+	};
+	if err := set.CheckInvariants(); err != nil {
+		t.Errorf("%v", err);
+	};
+	// members of a type needn't be adjacent in a custom order
+	printed := Make(WithOrder(func(a, b Item) bool {
+		return fmt.Sprint(a) < fmt.Sprint(b);
+	}, nil));
+	printed.Add(Int(1));
+	printed.Add(String("10"));
+	printed.Add(Int(100));
+	if removed := printed.RemoveType(Int(0)); removed != 2 || printed.Cardinality() != 1 {
+		t.Errorf("Expected 2 removed: got %v %v", removed, printed);
+	};
+};
+
+func TestWithBackend(t *testing.T) {
+	llrb, avl := New(), Make(WithBackend(AVL), WithSelfCheck(true), WithChecksum(), WithArena(16));
+	r := rand.New(rand.NewSource(2));
+	var snapshot Seq;
+	var expected []Item;
+	for i := 0; i < 5000; i++ {
+		item := Item(Int(r.Intn(1000)));
+		if r.Intn(4) == 0 {
+			item = String(fmt.Sprint(r.Intn(100)));
+		};
+		switch r.Intn(20) {
+		case 0, 1, 2, 3, 4, 5:
+			llrb.Remove(item);
+			avl.Remove(item);
+		case 6:
+			lo, hi := Int(r.Intn(1000)), Int(r.Intn(1000));
+			llrb.DeleteRange(lo, hi);
+			avl.DeleteRange(lo, hi);
+		case 7:
+			if r.Intn(10) == 0 {
+				llrb.RemoveType(String(""));
+				avl.RemoveType(String(""));
+			};
+		case 8:
+			snapshot, expected = avl.SnapshotIter(), avl.ToSlice();
+		default:
+			llrb.Add(item);
+			avl.Add(item);
+		};
+		if err := avl.CheckInvariants(); err != nil {
+			t.Fatalf("%v", err);
+		};
+		if avl.Checksum() != avl.Hash() {
+			t.Fatalf("Checksum wrong after %v operations", i + 1);
+		};
+		if !reflect.DeepEqual(avl.ToSlice(), llrb.ToSlice()) {
+			t.Fatalf("Sets differ after %v operations", i + 1);
+		};
+		if snapshot != nil && i % 100 == 0 {
+			got := []Item{};
+			snapshot(func(item Item) bool {
+				got = append(got, item);
+				return true;
+			});
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Snapshot changed after %v operations", i + 1);
+			};
+		};
+	};
+	// an AVL tree's height is less than 1.45 log2(n + 2)
+	if n, depth := float64(avl.Cardinality()), max_depth(avl.root); float64(depth) > 1.45 * math.Log2(n + 2) {
+		t.Errorf("Tree too deep: %v for %v members", depth, n);
+	};
+	if red, _ := avl.ColorCounts(); red != 0 {
+		t.Errorf("Expected no red nodes: got %v", red);
+	};
+	for _, derived := range []*Set{avl.Copy(), avl.DeepClone()} {
+		if derived.tree() != AVL || !Equal(derived, avl) || derived.CheckInvariants() != nil {
+			t.Errorf("Copy should use the same backend");
+		};
+	};
+	first, rest := avl.SplitAt(int(avl.Cardinality() / 3));
+	for _, half := range []*Set{first, rest} {
+		if half.tree() != AVL || half.CheckInvariants() != nil {
+			t.Errorf("SplitAt() should use the same backend");
+		};
+		half.Add(Int(-1));
+		if err := half.CheckInvariants(); err != nil {
+			t.Errorf("%v", err);
+		};
+	};
+	other := New(Int(1), Int(2), Int(3000));
+	for _, derived := range []*Set{Union(avl, other), Intersection(avl, other), Difference(avl, other), UnionAll(avl, other)} {
+		if derived.tree() != AVL || derived.CheckInvariants() != nil {
+			t.Errorf("Results should use the first argument's backend");
+		};
+	};
+	if Union(other, avl).tree() != LLRB {
+		t.Errorf("Expected LLRB from an LLRB first argument");
+	};
+	if New().tree() != LLRB || fmt.Sprint(AVL) != "AVL" {
+		t.Errorf("Expected LLRB by default");
+	};
+};
+
+func benchmark_lookups(b *testing.B, backend Backend) {
+	b.StopTimer();
+	set := Make(WithBackend(backend));
+	for i := 0; i < 100000; i++ {
+		set.Add(Int(rand.Intn(1000000)));
+	};
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		set.Has(Int(i % 1000000));
+	};
+};
+
+func BenchmarkLookupsLLRB(b *testing.B) {
+	benchmark_lookups(b, LLRB);
+};
+
+func BenchmarkLookupsAVL(b *testing.B) {
+	benchmark_lookups(b, AVL);
+};
+
+func descending(a, b Item) bool {
+	return a.(Int) > b.(Int);
+};
+
+func event_ids(set *Set) (ids string) {
+	for item := range set.Iter() {
+		ids += item.(*event).id;
+	};
+	return;
+};
+
+func TestAlgebraWithOrder(t *testing.T) {
+	// a custom order alone
+	make_descending := func(lo, hi int) *Set {
+		set := Make(WithOrder(descending, nil), WithBackend(AVL));
+		for i := lo; i <= hi; i++ {
+			set.Add(Int(i));
+		};
+		return set;
+	};
+	a, b := make_descending(1, 10), make_descending(5, 15);
+	results := map[string]*Set{
+		"Union": Union(a, b), "UnionAll": UnionAll(a, b, make_descending(12, 21)),
+		"Intersection": Intersection(a, b), "Difference": Difference(a, b),
+		"SymmetricDifference": SymmetricDifference(a, b),
+	};
+	expected := map[string][]int{
+		"Union": []int{1, 15}, "UnionAll": []int{1, 21},
+		"Intersection": []int{5, 10}, "Difference": []int{1, 4},
+		"SymmetricDifference": []int{1, 15},
+	};
+	for name, set := range results {
+		if err := set.CheckInvariants(); err != nil {
+			t.Errorf("%v: %v", name, err);
+		};
+		if set.tree() != AVL {
+			t.Errorf("%v: expected setA's backend", name);
+		};
+		slice := set.ToSlice();
+		lo, hi := expected[name][0], expected[name][1];
+		if len(slice) == 0 || slice[0] != Int(hi) || slice[len(slice) - 1] != Int(lo) {
+			t.Errorf("%v: expected %v down to %v: got %v", name, hi, lo, slice);
+		};
+		for i := lo; i <= hi; i++ {
+			if set.Has(Int(i)) == (name == "SymmetricDifference" && i >= 5 && i <= 10) {
+				t.Errorf("%v: unexpected membership of %v", name, i);
+			};
+		};
+	};
+	if !Equal(a, make_descending(1, 10)) || Equal(a, b) || !Subset(results["Intersection"], a) || Compare(a, b) <= 0 {
+		t.Errorf("Unexpected comparison results");
+	};
+	// sets given the order by the same Option (or copied) are walked in step
+	// but separate calls of WithOrder() can't be shown to agree
+	shared := WithOrder(descending, nil);
+	c, d := Make(shared), Make(shared);
+	for i := 1; i <= 15; i++ {
+		if i <= 10 {
+			c.Add(Int(i));
+		};
+		if i >= 5 {
+			d.Add(Int(i));
+		};
+	};
+	if _, ordered := in_step(c, d); !ordered {
+		t.Errorf("Expected sets sharing an Option to be in step");
+	};
+	if _, ordered := in_step(c, c.Copy()); !ordered {
+		t.Errorf("Expected a copy to be in step");
+	};
+	if _, ordered := in_step(a, make_descending(1, 10)); ordered {
+		t.Errorf("Expected separate WithOrder() calls not to be in step");
+	};
+	if _, ordered := in_step(New(), Make(WithFallbackOrder(func(a, b Item) int { return 0; }))); ordered {
+		t.Errorf("Expected a fallback order not to be in step with the default");
+	};
+	if !reflect.DeepEqual(Union(c, d).ToSlice(), Union(a, b).ToSlice()) || !reflect.DeepEqual(Intersection(c, d).ToSlice(), Intersection(a, b).ToSlice()) {
+		t.Errorf("Walking in step should give the same results");
+	};
+	// a custom equality (events are equal if they have the same ID whatever
+	// their times)
+	make_events := func(events ...*event) *Set {
+		set := Make(WithOrder(by_time, same_id));
+		for _, e := range events {
+			set.Add(e);
+		};
+		return set;
+	};
+	x := make_events(&event{"a", 1}, &event{"b", 2}, &event{"c", 3});
+	y := make_events(&event{"b", 5}, &event{"c", 0}, &event{"d", 4});
+	if ids := event_ids(Union(x, y)); ids != "abcd" {
+		t.Errorf("Expected abcd: got %v", ids);
+	};
+	if ids := event_ids(UnionAll(x, y, make_events(&event{"a", 9}, &event{"e", 0}))); ids != "eabcd" {
+		t.Errorf("Expected eabcd: got %v", ids);
+	};
+	if ids := event_ids(Intersection(x, y)); ids != "bc" {
+		t.Errorf("Expected bc: got %v", ids);
+	};
+	if ids := event_ids(Difference(x, y)); ids != "a" {
+		t.Errorf("Expected a: got %v", ids);
+	};
+	if ids := event_ids(SymmetricDifference(x, y)); ids != "ad" {
+		t.Errorf("Expected ad: got %v", ids);
+	};
+	if union := Union(x, y); union.Cardinality() != 4 || union.CheckInvariants() != nil || !union.Has(&event{"d", 99}) {
+		t.Errorf("Unexpected union %v", union);
+	};
+	shuffled := make_events(&event{"c", 1}, &event{"a", 2}, &event{"b", 3});
+	if !Equal(x, shuffled) || !Subset(x, shuffled) || Equal(x, y) || Subset(x, y) {
+		t.Errorf("Unexpected comparison results");
+	};
+	// Compare() is positional so Equal() sets with their members in different
+	// orders don't compare as 0
+	if Compare(x, shuffled) == 0 || Compare(x, shuffled) != -Compare(shuffled, x) || Compare(x, x.Copy()) != 0 {
+		t.Errorf("Expected Compare() to be positional: got %v", Compare(x, shuffled));
+	};
+	if onlyA, shared, onlyB := x.CountDiff(y); onlyA != 1 || shared != 2 || onlyB != 1 {
+		t.Errorf("Expected 1, 2, 1: got %v, %v, %v", onlyA, shared, onlyB);
+	};
+	if overlaps, shared := x.Overlaps(y); !overlaps || shared != 2 {
+		t.Errorf("Expected 2 shared: got %v", shared);
+	};
+};
+
+func TestTreapBackend(t *testing.T) {
+	backend := NewTreap(7);
+	r := rand.New(rand.NewSource(7));
+	random_item := func() Item {
+		if r.Intn(4) == 0 {
+			return String(fmt.Sprint(r.Intn(100)));
+		};
+		return Int(r.Intn(1000));
+	};
+	make_pair := func(n int) (treap, llrb *Set) {
+		treap, llrb = Make(WithBackend(backend)), New();
+		for i := 0; i < n; i++ {
+			item := random_item();
+			treap.Add(item);
+			llrb.Add(item);
+		};
+		return;
+	};
+	fns := []func(setA, setB *Set) *Set{Union, Union, Merge, Intersection, Difference, SymmetricDifference};
+	// operands of earlier operations with their LLRB equivalents
+	var treaps, llrbs []*Set;
+	check := func(treap, llrb *Set, i int) {
+		if err := treap.CheckInvariants(); err != nil {
+			t.Fatalf("%v", err);
+		};
+		if treap.tree() != backend || !reflect.DeepEqual(treap.ToSlice(), llrb.ToSlice()) {
+			t.Fatalf("Sets differ after %v operations", i + 1);
+		};
+	};
+	set, mirror := make_pair(0);
+	for i := 0; i < 5000; i++ {
+		item := random_item();
+		switch r.Intn(20) {
+		case 0, 1, 2, 3, 4:
+			set.Remove(item);
+			mirror.Remove(item);
+		case 5:
+			lo, hi := Int(r.Intn(1000)), Int(r.Intn(1000));
+			set.DeleteRange(lo, hi);
+			mirror.DeleteRange(lo, hi);
+		case 6:
+			k := r.Intn(int(set.Cardinality()) + 1);
+			first, rest := set.SplitAt(k);
+			mfirst, mrest := mirror.SplitAt(k);
+			treaps, llrbs = append(treaps, set, first, rest), append(llrbs, mirror, mfirst, mrest);
+			set, mirror = Merge(first, rest), Merge(mfirst, mrest);
+		case 7:
+			below, rest := set.Split(item);
+			mbelow, mrest := mirror.Split(item);
+			treaps, llrbs = append(treaps, set, below, rest), append(llrbs, mirror, mbelow, mrest);
+			set, mirror = Merge(rest, below), Merge(mrest, mbelow);
+		case 8, 9:
+			other, mother := make_pair(r.Intn(300));
+			fn := fns[r.Intn(len(fns))];
+			treaps, llrbs = append(treaps, set, other), append(llrbs, mirror, mother);
+			set, mirror = fn(set, other), fn(mirror, mother);
+		case 10:
+			if len(treaps) > 0 {
+				j := r.Intn(len(treaps));
+				treaps[j].Add(item);
+				llrbs[j].Add(item);
+				item = random_item();
+				treaps[j].Remove(item);
+				llrbs[j].Remove(item);
+			};
+		default:
+			set.Add(item);
+			mirror.Add(item);
+		};
+		check(set, mirror, i);
+		if len(treaps) > 60 {
+			for j := range treaps {
+				check(treaps[j], llrbs[j], i);
+			};
+			treaps, llrbs = treaps[30:], llrbs[30:];
+		};
+	};
+	for j := range treaps {
+		check(treaps[j], llrbs[j], 5000);
+	};
+	if red, _ := set.ColorCounts(); red != 0 {
+		t.Errorf("Expected no red nodes: got %v", red);
+	};
+	// the same seed gives the same shape
+	a, b := Make(WithBackend(NewTreap(1))), Make(WithBackend(NewTreap(1)));
+	for i := 0; i < 10000; i++ {
+		a.Add(Int(i));
+		b.Add(Int(i));
+	};
+	if a.root.item != b.root.item || max_depth(a.root) != max_depth(b.root) {
+		t.Errorf("Expected identical trees from the same seed");
+	};
+	if depth := max_depth(a.root); float64(depth) > 3 * math.Log2(10000) {
+		t.Errorf("Tree too deep: %v for 10000 members", depth);
+	};
+	first, rest := a.Split(Int(2500));
+	if first.Cardinality() != 2500 || rest.Cardinality() != 7500 || a.Cardinality() != 10000 {
+		t.Errorf("Split sizes: %v and %v", first.Cardinality(), rest.Cardinality());
+	};
+	if merged := Merge(first, rest); !Equal(merged, a) || merged.CheckInvariants() != nil {
+		t.Errorf("Merge should restore the split set");
+	};
+	// the running checksum is kept up to date and removed nodes go back to
+	// the arena
+	c := Make(WithBackend(NewTreap(1)), WithChecksum(), WithArena(16));
+	for i := 0; i < 1000; i++ {
+		c.Add(Int(r.Intn(300)));
+		c.Remove(Int(r.Intn(300)));
+	};
+	if c.Checksum() != c.Hash() || c.CheckInvariants() != nil {
+		t.Errorf("Checksum %v but Hash() %v", c.Checksum(), c.Hash());
+	};
+};
+
+func benchmark_split_merge(b *testing.B, backend Backend) {
+	b.StopTimer();
+	items := make([]Item, 1000000);
+	for i := range items {
+		items[i] = Int(i);
+	};
+	set := Make(WithBackend(backend)).similar_from(items);
+	b.StartTimer();
+	for i := 0; i < b.N; i++ {
+		first, rest := set.SplitAt(len(items) / 2 + i % 1000);
+		set = Merge(first, rest);
+	};
+};
+
+func BenchmarkSplitMergeLLRB(b *testing.B) {
+	benchmark_split_merge(b, LLRB);
+};
+
+func BenchmarkSplitMergeTreap(b *testing.B) {
+	benchmark_split_merge(b, NewTreap(1));
+};
@@ -0,0 +1,132 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"bytes";
+	"fmt";
+	"math";
+	"time";
+);
+
+// Ready made Item types wrapping some common builtin types.
+
+// Int is an Item wrapping int.
+type Int int;
+
+func (this Int) Precedes(other interface{}) bool {
+	return this < other.(Int);
+};
+
+func (this Int) String() string {
+	return fmt.Sprint(int(this));
+};
+
+// String is an Item wrapping string.
+type String string;
+
+func (this String) Precedes(other interface{}) bool {
+	return this < other.(String);
+};
+
+func (this String) String() string {
+	return string(this);
+};
+
+// Float64 is an Item wrapping float64.  So that the ordering is total NaNs
+// are equal to each other and precede all other values.  As for == negative
+// zero is equal to (and so will be replaced by) positive zero.
+type Float64 float64;
+
+func (this Float64) Precedes(other interface{}) bool {
+	a, b := float64(this), float64(other.(Float64));
+	if math.IsNaN(a) {
+		return !math.IsNaN(b);
+	};
+	return a < b;
+};
+
+func (this Float64) String() string {
+	return fmt.Sprint(float64(this));
+};
+
+// Bytes is an Item wrapping []byte ordered by bytes.Compare().  The contents
+// of a Bytes must not be modified while it is a member of a Set.
+type Bytes []byte;
+
+func (this Bytes) Precedes(other interface{}) bool {
+	return bytes.Compare(this, other.(Bytes)) < 0;
+};
+
+func (this Bytes) String() string {
+	return string(this);
+};
+
+// Time is an Item wrapping *time.Time ordered by the instant represented
+// (to the nanosecond) so that equal instants in different time zones are
+// equal.  A Time wrapping a nil pointer (such as Time{}) is treated as a nil
+// item (see Item).
+type Time struct {
+	*time.Time;
+};
+
+func (this Time) Precedes(other interface{}) bool {
+	that := other.(Time);
+	if a, b := this.Seconds(), that.Seconds(); a != b {
+		return a < b;
+	};
+	return this.Nanosecond < that.Nanosecond;
+};
+
+// FuncItem is an Item adapting an arbitrary value and a comparison function
+// so that the value can be put in a Set without defining a new type.
+// See ItemOf().
+type FuncItem struct {
+	key string;
+	value interface{};
+	cmp func(a, b interface{}) int;
+};
+
+// ItemOf returns a FuncItem wrapping value whose order is determined by cmp
+// which must return a negative, zero or positive int as a precedes, equals
+// or follows b and satisfy the requirements documented for Item.  E.g.:
+//	by_name := func(a, b interface{}) int {
+//		switch an, bn := a.(*os.Dir).Name, b.(*os.Dir).Name; {
+//		case an < bn:
+//			return -1;
+//		case an > bn:
+//			return 1;
+//		};
+//		return 0;
+//	};
+//	set.Add(heteroset.ItemOf("dir", dir, by_name));
+// All FuncItems are the same type so they are ordered first by key and then
+// (for equal keys only) by cmp.  Since funcs can't be compared, FuncItems
+// with the same key must have the same cmp (the receiver's is used);
+// different comparison functions must be given different keys.
+func ItemOf(key string, value interface{}, cmp func(a, b interface{}) int) *FuncItem {
+	return &FuncItem{key, value, cmp};
+};
+
+func (this *FuncItem) Precedes(other interface{}) bool {
+	that := other.(*FuncItem);
+	if this.key != that.key {
+		return this.key < that.key;
+	};
+	return this.cmp(this.value, that.value) < 0;
+};
+
+// Key returns the key given to ItemOf().
+func (this *FuncItem) Key() string {
+	return this.key;
+};
+
+// Value returns the value wrapped by ItemOf().
+func (this *FuncItem) Value() interface{} {
+	return this.value;
+};
+
+func (this *FuncItem) String() string {
+	return fmt.Sprint(this.value);
+};
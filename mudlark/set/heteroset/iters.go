@@ -0,0 +1,194 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"container/heap";
+);
+
+// A cursor into one of the sets being merged by MergeIter().  index is the
+// set's position in the argument list and is used to break ties.
+type merge_source struct {
+	cursor *Cursor;
+	index int;
+};
+
+type merge_heap struct {
+	sources []merge_source;
+	compare func(a, b Item) int;
+};
+
+func (this *merge_heap) Len() int {
+	return len(this.sources);
+};
+
+func (this *merge_heap) Less(i, j int) bool {
+	a, _ := this.sources[i].cursor.Item();
+	b, _ := this.sources[j].cursor.Item();
+	if cmp := this.compare(a, b); cmp != 0 {
+		return cmp < 0;
+	};
+	return this.sources[i].index < this.sources[j].index;
+};
+
+func (this *merge_heap) Swap(i, j int) {
+	this.sources[i], this.sources[j] = this.sources[j], this.sources[i];
+};
+
+func (this *merge_heap) Push(x interface{}) {
+	this.sources = append(this.sources, x.(merge_source));
+};
+
+func (this *merge_heap) Pop() interface{} {
+	last := this.sources[len(this.sources) - 1];
+	this.sources = this.sources[0:len(this.sources) - 1];
+	return last;
+};
+
+// MergeIter returns a sequence of the members of the union of sets (in the
+// order used by Iter()) without building the union.  Where more than one of
+// the sets has a member the instance from the first of them is used.  Only a
+// cursor per set is kept so the memory needed is O(len(sets) log n).  If the
+// sets can't all be walked in step with the first (see in_step()) they can't
+// be merged so the members of each set are instead visited in its order
+// (skipping those found in an earlier set).  The sets must not be modified while the sequence
+// is in use.
+func MergeIter(sets ...*Set) Seq {
+	return func(yield func(item Item) bool) {
+		if len(sets) == 0 {
+			return;
+		};
+		if !all_in_step(sets) {
+			more := true;
+			for i := 0; i < len(sets) && more; i++ {
+				inorder(sets[i].root, func(item Item) bool {
+					for _, earlier := range sets[0:i] {
+						if _, found := earlier.lookup(item); found {
+							return true;
+						};
+					};
+					more = yield(item);
+					return more;
+				});
+			};
+			return;
+		};
+		h := &merge_heap{make([]merge_source, 0, len(sets)), sets[0].comparator()};
+		for i, set := range sets {
+			if cursor := set.Cursor(); cursor.Valid() {
+				h.sources = append(h.sources, merge_source{cursor, i});
+			};
+		};
+		heap.Init(h);
+		for h.Len() > 0 {
+			item, _ := h.sources[0].cursor.Item();
+			if !yield(item) {
+				return;
+			};
+			// move on every cursor that is at an item equal to item
+			for h.Len() > 0 {
+				if current, _ := h.sources[0].cursor.Item(); h.compare(current, item) != 0 {
+					break;
+				};
+				source := heap.Pop(h).(merge_source);
+				if source.cursor.Next() {
+					heap.Push(h, source);
+				};
+			};
+		};
+	};
+};
+
+// UnionIter returns a sequence of the members of the union of setA and setB
+// (in the order used by Iter()) without building the union.  Where both sets
+// have a member the instance in setA is used.  The sets are walked in tandem
+// using cursors so abandoning the sequence part way through leaves nothing
+// to clean up.  The sets must not be modified while the sequence is in use.
+// If the sets can't be walked in step (see in_step()) setA's members come
+// first followed by those of setB that aren't in setA.
+func UnionIter(setA, setB *Set) Seq {
+	return func(yield func(item Item) bool) {
+		tandem(setA, setB, func(a, b Item) bool {
+			if a == nil {
+				return yield(b);
+			};
+			return yield(a);
+		});
+	};
+};
+
+// IntersectIter returns a sequence of the members of the intersection of
+// setA and setB (in the order used by Iter()) without building the
+// intersection.  The instances in setA are used.  Whichever of the sets'
+// cursors is behind is moved forward with Seek() rather than Next() so large
+// parts of a much bigger set are skipped.  If the sets can't be walked in step
+// (see in_step()) the members of setA are instead visited in its order and
+// looked up in setB.  The sets must not be modified while the sequence is in
+// use.
+func IntersectIter(setA, setB *Set) Seq {
+	return func(yield func(item Item) bool) {
+		compare, ordered := in_step(setA, setB);
+		if !ordered {
+			inorder(setA.root, func(item Item) bool {
+				if _, found := setB.lookup(item); found {
+					return yield(item);
+				};
+				return true;
+			});
+			return;
+		};
+		ca, cb := setA.Cursor(), setB.Cursor();
+		for ca.Valid() && cb.Valid() {
+			a, _ := ca.Item();
+			b, _ := cb.Item();
+			switch cmp := compare(a, b); {
+			case cmp < 0:
+				ca.Seek(b);
+			case cmp > 0:
+				cb.Seek(a);
+			default:
+				if !yield(a) {
+					return;
+				};
+				ca.Next();
+				cb.Next();
+			};
+		};
+	};
+};
+
+// DifferenceIter returns a sequence of the members of setA that aren't in
+// setB (in the order used by Iter()) without building the difference.  The
+// cursor in setB is moved forward with Seek() so large parts of a much
+// bigger setB are skipped.  If the sets can't be walked in step (see
+// in_step()) the members of setA are instead visited in its order and
+// looked up in setB.  The sets must not be modified while the sequence is in
+// use.
+func DifferenceIter(setA, setB *Set) Seq {
+	return func(yield func(item Item) bool) {
+		compare, ordered := in_step(setA, setB);
+		if !ordered {
+			inorder(setA.root, func(item Item) bool {
+				if _, found := setB.lookup(item); !found {
+					return yield(item);
+				};
+				return true;
+			});
+			return;
+		};
+		ca, cb := setA.Cursor(), setB.Cursor();
+		for ; ca.Valid(); ca.Next() {
+			a, _ := ca.Item();
+			if b, valid := cb.Item(); valid && compare(b, a) < 0 {
+				cb.Seek(a);
+			};
+			if b, valid := cb.Item(); valid && compare(b, a) == 0 {
+				continue;
+			};
+			if !yield(a) {
+				return;
+			};
+		};
+	};
+};
@@ -0,0 +1,101 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+// journal_entry records a single mutation of a Set in enough detail for it
+// to be undone and redone.  For OP_ADD previous is the instance replaced by
+// item (nil if item was newly inserted), for OP_REMOVE item is the instance
+// that was deleted and for OP_CLEAR items are the set's former contents.
+type journal_entry struct {
+	op int;
+	item, previous Item;
+	items []Item;
+};
+
+type journal struct {
+	entries []journal_entry;
+	// entries before pos can be undone and those from pos on redone
+	pos int;
+	limit int;
+	// set while Undo() and Redo() are making changes
+	replaying bool;
+};
+
+// BeginJournal starts recording the set's mutations so that they can be
+// reversed with Undo() and reapplied with Redo().  If limit is positive only
+// the most recent limit mutations are kept.  Bulk operations such as
+// ApplyPatch() are recorded as one entry per item changed.  Any existing
+// journal is discarded.
+func (this *Set) BeginJournal(limit int) {
+	this.journal = &journal{limit: limit};
+};
+
+// EndJournal stops recording mutations and discards the journal.
+func (this *Set) EndJournal() {
+	this.journal = nil;
+};
+
+func (this *Set) journal_record(entry journal_entry) {
+	j := this.journal;
+	if j.replaying {
+		return;
+	};
+	// a new mutation makes anything that was undone unredoable
+	j.entries = append(j.entries[0:j.pos], entry);
+	if j.limit > 0 && len(j.entries) > j.limit {
+		j.entries = j.entries[len(j.entries) - j.limit:];
+	};
+	j.pos = len(j.entries);
+};
+
+// Undo reverses the most recent journalled mutation that hasn't already been
+// undone and reports whether there was one.
+func (this *Set) Undo() bool {
+	j := this.journal;
+	if j == nil || j.pos == 0 {
+		return false;
+	};
+	j.pos--;
+	entry := j.entries[j.pos];
+	j.replaying = true;
+	switch entry.op {
+	case OP_ADD:
+		if entry.previous == nil {
+			this.Remove(entry.item);
+		} else {
+			this.Add(entry.previous);
+		};
+	case OP_REMOVE:
+		this.Add(entry.item);
+	case OP_CLEAR:
+		for _, item := range entry.items {
+			this.Add(item);
+		};
+	};
+	j.replaying = false;
+	return true;
+};
+
+// Redo reapplies the most recently undone mutation and reports whether there
+// was one.  Mutations made since the last Undo() make earlier undone
+// mutations unavailable to Redo().
+func (this *Set) Redo() bool {
+	j := this.journal;
+	if j == nil || j.pos == len(j.entries) {
+		return false;
+	};
+	entry := j.entries[j.pos];
+	j.pos++;
+	j.replaying = true;
+	switch entry.op {
+	case OP_ADD:
+		this.Add(entry.item);
+	case OP_REMOVE:
+		this.Remove(entry.item);
+	case OP_CLEAR:
+		this.Clear();
+	};
+	j.replaying = false;
+	return true;
+};
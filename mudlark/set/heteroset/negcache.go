@@ -0,0 +1,161 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+// A Bloom filter of the hashes of the members of a set that implement Hasher
+// (see WithNegativeCache()).  Bits can't be cleared so removals are counted
+// and the filter is rebuilt once too many of its entries are stale.
+type negative_cache struct {
+	bits []uint64;
+	bits_per_item uint;
+	// the number of bits set per item
+	k uint;
+	// the number of items the filter was sized for and the number added
+	capacity, added uint;
+	// the number of items added that have since been removed
+	stale uint;
+};
+
+func new_negative_cache(bits_per_item, capacity uint) *negative_cache {
+	if capacity < 64 {
+		capacity = 64;
+	};
+	// k = bits_per_item * ln(2) minimises the false positive rate
+	k := bits_per_item * 69 / 100;
+	if k < 1 {
+		k = 1;
+	};
+	nbits := bits_per_item * capacity;
+	return &negative_cache{bits: make([]uint64, (nbits + 63) / 64), bits_per_item: bits_per_item, k: k, capacity: capacity};
+};
+
+// Hasher implementations needn't spread their bits so mix them (this is the
+// finaliser from MurmurHash3).
+func mix64(hash uint64) uint64 {
+	hash ^= hash >> 33;
+	hash *= 0xff51afd7ed558ccd;
+	hash ^= hash >> 33;
+	hash *= 0xc4ceb9fe1a85ec53;
+	hash ^= hash >> 33;
+	return hash;
+};
+
+// Call fn with the word index and mask of each of the k bits for hash (using
+// double hashing) until it returns false.
+func (this *negative_cache) probe(hash uint64, fn func(word int, mask uint64) bool) bool {
+	hash = mix64(hash);
+	nbits := uint64(len(this.bits)) * 64;
+	h1, h2 := hash, (hash >> 32) | (hash << 32) | 1;
+	for i := uint(0); i < this.k; i++ {
+		bit := (h1 + uint64(i) * h2) % nbits;
+		if !fn(int(bit / 64), 1 << (bit % 64)) {
+			return false;
+		};
+	};
+	return true;
+};
+
+func (this *negative_cache) add(hash uint64) {
+	this.probe(hash, func(word int, mask uint64) bool {
+		this.bits[word] |= mask;
+		return true;
+	});
+	this.added++;
+};
+
+func (this *negative_cache) may_contain(hash uint64) bool {
+	return this.probe(hash, func(word int, mask uint64) bool {
+		return this.bits[word] & mask != 0;
+	});
+};
+
+// WithNegativeCache(bits_per_item) makes the set keep a Bloom filter of the
+// hashes of its members that implement Hasher so that look ups (Has(),
+// Find(), Remove() etc.) of most absent items of those types are answered
+// without searching the tree.  The filter never causes a member to be
+// missed.  It uses about bits_per_item bits per member: 10 bits gives a false
+// positive rate of about 1%.  As removals can't be taken out of the filter
+// it is rebuilt when more than half of the items it holds have been removed
+// and it is resized as the set grows.  The filter is only used if Hash() is
+// consistent with the set's equality so it is ignored by sets made with
+// WithOrder() with a non nil equal function.
+func WithNegativeCache(bits_per_item uint) Option {
+	return func(set *Set) {
+		set.negative = nil;
+		if bits_per_item > 0 {
+			set.negative = new_negative_cache(bits_per_item, set.count);
+		};
+	};
+};
+
+// NewWithBloom makes an empty set with a negative cache (see
+// WithNegativeCache()) using 10 bits per member and initially sized for
+// expected_n members so that it needn't be rebuilt as the set grows to that
+// size.  Deletions leave the filter conservative (until it's rebuilt) and
+// only items that implement Hasher benefit.
+func NewWithBloom(expected_n int) (set *Set) {
+	set = new(Set);
+	set.negative = new_negative_cache(10, uint(max(expected_n, 0)));
+	return;
+};
+
+func (this *Set) rebuild_negative_cache() {
+	nc := new_negative_cache(this.negative.bits_per_item, 2 * this.count);
+	inorder(this.root, func(member Item) bool {
+		if hasher, ok := member.(Hasher); ok {
+			nc.add(hasher.Hash());
+		};
+		return true;
+	});
+	this.negative = nc;
+};
+
+// definitely_absent returns true if the negative cache shows that item isn't
+// in the set.
+func (this *Set) definitely_absent(item Item) bool {
+	nc := this.negative;
+	if nc == nil || this.equal != nil {
+		return false;
+	};
+	hasher, ok := item.(Hasher);
+	if !ok {
+		return false;
+	};
+	return !nc.may_contain(hasher.Hash());
+};
+
+// Record the insertion of item in the negative cache.
+func (this *Set) negative_cache_insert(item Item) {
+	if this.negative == nil {
+		return;
+	};
+	if hasher, ok := item.(Hasher); ok {
+		if this.negative.added >= this.negative.capacity {
+			// item is already in the tree
+			this.rebuild_negative_cache();
+		} else {
+			this.negative.add(hasher.Hash());
+		};
+	};
+};
+
+// Record the removal of item (which is no longer in the tree) in the negative
+// cache.  This is where the filter is rebuilt so that look ups never change
+// it.
+func (this *Set) negative_cache_delete(item Item) {
+	if this.negative == nil {
+		return;
+	};
+	if _, ok := item.(Hasher); ok {
+		if this.negative.stale++; this.negative.stale * 2 > this.negative.added {
+			this.rebuild_negative_cache();
+		};
+	};
+};
+
+func (this *negative_cache) copy() *negative_cache {
+	clone := *this;
+	clone.bits = append(make([]uint64, 0, len(this.bits)), this.bits...);
+	return &clone;
+};
@@ -0,0 +1,137 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"fmt";
+	"os";
+);
+
+// Kinds of operation for use with ApplyOps()
+const (
+	OP_ADD = iota;
+	OP_REMOVE;
+	OP_FIND;
+	OP_CLEAR;
+	OP_ITERATE;
+);
+
+// Op is an operation for ApplyOps() to execute.  Even keys are wrapped in one
+// Item type and odd keys in another so that the operations exercise sets
+// containing more than one type.
+type Op struct {
+	Kind int;
+	Key uint64;
+};
+
+type op_even_key uint64;
+
+func (this op_even_key) Precedes(other interface{}) bool {
+	return this < other.(op_even_key);
+};
+
+type op_odd_key uint64;
+
+func (this op_odd_key) Precedes(other interface{}) bool {
+	return this < other.(op_odd_key);
+};
+
+func op_item(key uint64) Item {
+	if key & 1 == 0 {
+		return op_even_key(key);
+	};
+	return op_odd_key(key);
+};
+
+func op_key(item Item) uint64 {
+	switch key := item.(type) {
+	case op_even_key:
+		return uint64(key);
+	case op_odd_key:
+		return uint64(key);
+	};
+	panic(fmt.Sprintf("heteroset: unexpected item %v", item));
+};
+
+// OpsFromBytes deterministically converts an arbitrary byte sequence into a
+// sequence of operations (two bytes per operation) suitable for ApplyOps().
+func OpsFromBytes(data []byte) []Op {
+	ops := make([]Op, len(data) / 2);
+	for i := range ops {
+		// bias towards additions so that the set gets some depth
+		switch b := data[2 * i] % 16; {
+		case b < 7:
+			ops[i].Kind = OP_ADD;
+		case b < 11:
+			ops[i].Kind = OP_REMOVE;
+		case b < 14:
+			ops[i].Kind = OP_FIND;
+		case b < 15:
+			ops[i].Kind = OP_ITERATE;
+		default:
+			ops[i].Kind = OP_CLEAR;
+		};
+		ops[i].Key = uint64(data[2 * i + 1]);
+	};
+	return ops;
+};
+
+func op_error(i int, op Op, format string, args ...interface{}) os.Error {
+	return os.NewError(fmt.Sprintf("heteroset: op %v %v: ", i, op) + fmt.Sprintf(format, args...));
+};
+
+// ApplyOps executes ops against both a Set and a simple map based oracle and
+// returns an os.Error describing the first divergence between them or
+// violation of the Set's internal invariants (or nil if there were none).
+// It is exported for use in testing.
+func ApplyOps(ops []Op) os.Error {
+	set := New();
+	oracle := make(map[uint64]bool);
+	var count uint;
+	for i, op := range ops {
+		item := op_item(op.Key);
+		switch op.Kind {
+		case OP_ADD:
+			set.Add(item);
+			if !oracle[op.Key] {
+				oracle[op.Key] = true;
+				count++;
+			};
+		case OP_REMOVE:
+			set.Remove(item);
+			if oracle[op.Key] {
+				oracle[op.Key] = false;
+				count--;
+			};
+		case OP_FIND:
+			if _, found := set.Find(item); found != oracle[op.Key] {
+				return op_error(i, op, "Find() returned %v", found);
+			};
+		case OP_CLEAR:
+			set.Clear();
+			oracle = make(map[uint64]bool);
+			count = 0;
+		case OP_ITERATE:
+			var n uint;
+			for member := range set.Iter() {
+				if !oracle[op_key(member)] {
+					return op_error(i, op, "Iter() produced %v", member);
+				};
+				n++;
+			};
+			if n != count {
+				return op_error(i, op, "Iter() produced %v items instead of %v", n, count);
+			};
+		default:
+			return op_error(i, op, "unknown kind");
+		};
+		if set.Cardinality() != count {
+			return op_error(i, op, "cardinality %v instead of %v", set.Cardinality(), count);
+		};
+		if err := set.CheckInvariants(); err != nil {
+			return op_error(i, op, "%v", err);
+		};
+	};
+	return nil;
+};
@@ -0,0 +1,131 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"expvar";
+	"fmt";
+	"sync/atomic";
+);
+
+// The number of black nodes on the path from node to the first member of its
+// subtree.  For a valid tree this is the black height and the height is at
+// most twice it.
+func left_spine_height(node *ll_rb_node) (height uint64) {
+	for ; node != nil; node = node.left {
+		if !node.red {
+			height++;
+		};
+	};
+	return;
+};
+
+// The usage counters may be read by expvar's HTTP handlers while the set is
+// in use so they are only changed (and read) atomically.  As the tree can't
+// safely be examined while it is being changed the length and height are
+// recorded after each change instead (but only once they are published).
+
+func (this *Set) count_inserts(n uint64) {
+	atomic.AddUint64(&this.inserts, n);
+	this.record_shape();
+};
+
+func (this *Set) count_deletes(n uint64) {
+	atomic.AddUint64(&this.deletes, n);
+	this.record_shape();
+};
+
+func (this *Set) count_failed_find() {
+	atomic.AddUint64(&this.failed_finds, 1);
+};
+
+func (this *Set) count_iterator() {
+	atomic.AddUint64(&this.iterators, 1);
+};
+
+func (this *Set) record_shape() {
+	if this.published {
+		atomic.StoreUint64(&this.length, uint64(this.count));
+		atomic.StoreUint64(&this.height, left_spine_height(this.root));
+	};
+};
+
+// An expvar.Var whose value is read atomically when it is displayed
+type stat_var struct {
+	value *uint64;
+};
+
+func (this stat_var) String() string {
+	return fmt.Sprint(atomic.LoadUint64(this.value));
+};
+
+// PublishExpvar publishes live statistics for the set as an expvar.Map
+// called name with the following entries:
+//	"length": the number of items in the set
+//	"height": the black height of the tree (its height is at most twice
+//	this)
+//	"inserts": the total number of items inserted
+//	"deletes": the total number of items deleted (including by Clear())
+//	"failed_finds": the total number of unsuccessful look ups (by Find(),
+//	Has() etc.)
+//	"iterators": the total number of iterators created
+// The statistics are kept up to date by the set's own operations so reading
+// them (from any goroutine) never examines the set itself.  If an expvar.Map
+// called name has already been published (e.g. by an earlier call) it is
+// reused with its entries replaced by those for this set.  As for
+// expvar.Publish(), it is a fatal error if name is in use by some other type
+// of variable.
+func (this *Set) PublishExpvar(name string) {
+	m, ok := expvar.Get(name).(*expvar.Map);
+	if !ok {
+		m = expvar.NewMap(name);
+	};
+	this.published = true;
+	this.record_shape();
+	m.Set("length", stat_var{&this.length});
+	m.Set("height", stat_var{&this.height});
+	m.Set("inserts", stat_var{&this.inserts});
+	m.Set("deletes", stat_var{&this.deletes});
+	m.Set("failed_finds", stat_var{&this.failed_finds});
+	m.Set("iterators", stat_var{&this.iterators});
+};
+
+// Stats are the counts kept by a Set made with NewInstrumented().
+type Stats struct {
+	// calls of the function that orders the set's members (which calls
+	// Precedes() up to twice)
+	Comparisons uint64;
+	// nodes of the tree examined while searching it (to find, insert or
+	// remove an item)
+	NodeVisits uint64;
+};
+
+// NewInstrumented is like New() except that the set counts the comparisons
+// and node visits made by all of its operations so that the cost of the
+// items' Precedes() can be profiled.  See Stats().  The counting slows the
+// set down a little and copies aren't instrumented.
+func NewInstrumented(items ...Item) (set *Set) {
+	set = new(Set);
+	set.stats = new(Stats);
+	set.visits = &set.stats.NodeVisits;
+	for _, item := range items {
+		set.Add(item);
+	};
+	return;
+};
+
+// Stats returns the counts accumulated so far by a Set made with
+// NewInstrumented() (or zero counts for any other Set).
+func (this *Set) Stats() (stats Stats) {
+	if this.stats != nil {
+		stats = *this.stats;
+	};
+	return;
+};
+
+func count_visit(visits *uint64) {
+	if visits != nil {
+		*visits++;
+	};
+};
@@ -0,0 +1,126 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+// The testutil package provides a conformance suite for types implementing
+// the heteroset.Item interface.  E.g.:
+//	func TestMyItem(t *testing.T) {
+//		testutil.RunItemTests(t, func(r *rand.Rand) heteroset.Item {
+//			return MyItem(r.Intn(1000));
+//		});
+//	}
+// The random number generator is seeded with the value of the -testutil.seed
+// flag (and the seed is included in failure messages) so that any failure can
+// be reproduced.
+package testutil;
+
+import (
+	"flag";
+	"fmt";
+	"rand";
+	"reflect";
+	"testing";
+	"mudlark/set/heteroset";
+);
+
+var seed = flag.Int64("testutil.seed", 1, "seed for heteroset/testutil's random number generator");
+
+// The number of items generated for checking the Precedes() contract.
+var ContractItems = 50;
+
+// The number of randomized operations applied to the Set.
+var SetOperations = 2000;
+
+func same_type(a, b heteroset.Item) bool {
+	return reflect.Typeof(a) == reflect.Typeof(b);
+};
+
+func equivalent(a, b heteroset.Item) bool {
+	return same_type(a, b) && !a.Precedes(b) && !b.Precedes(a);
+};
+
+// Check that Precedes() is irreflexive, antisymmetric and transitive and
+// that equivalence (neither item preceding the other) is transitive.
+func check_contract(t *testing.T, items []heteroset.Item) {
+	if err := heteroset.CheckComparator(items); err != nil {
+		t.Errorf("seed %v: %v", *seed, err);
+	};
+};
+
+// A slow but obviously correct set implementation to check the real one
+// against.
+type reference []heteroset.Item;
+
+func (this reference) index(item heteroset.Item) int {
+	for i, member := range this {
+		if equivalent(member, item) {
+			return i;
+		};
+	};
+	return -1;
+};
+
+// config describes how set was made for the failure messages.
+func check_set(t *testing.T, r *rand.Rand, set *heteroset.Set, config string, items []heteroset.Item) {
+	ref := make(reference, 0, len(items));
+	for op := 0; op < SetOperations; op++ {
+		item := items[r.Intn(len(items))];
+		i := ref.index(item);
+		switch r.Intn(3) {
+		case 0:
+			set.Add(item);
+			if i < 0 {
+				ref = append(ref, item);
+			} else {
+				ref[i] = item;
+			};
+		case 1:
+			found, ok := set.Find(item);
+			if ok != (i >= 0) {
+				t.Fatalf("seed %v: %v: op %v: Find(%v) returned %v", *seed, config, op, item, ok);
+			};
+			if ok && !equivalent(found, item) {
+				t.Fatalf("seed %v: %v: op %v: Find(%v) found %v", *seed, config, op, item, found);
+			};
+		case 2:
+			set.Remove(item);
+			if i >= 0 {
+				ref[i] = ref[len(ref) - 1];
+				ref = ref[0:len(ref) - 1];
+			};
+			if set.Has(item) {
+				t.Fatalf("seed %v: %v: op %v: Remove(%v) left it in the set", *seed, config, op, item);
+			};
+		};
+		if set.Cardinality() != uint(len(ref)) {
+			t.Fatalf("seed %v: %v: op %v: expected cardinality %v got %v", *seed, config, op, len(ref), set.Cardinality());
+		};
+		if err := set.CheckInvariants(); err != nil {
+			t.Fatalf("seed %v: %v: op %v: %v", *seed, config, op, err);
+		};
+	};
+	for _, item := range ref {
+		if !set.Has(item) {
+			t.Errorf("seed %v: %v: %v missing from set", *seed, config, item);
+		};
+	};
+};
+
+// RunItemTests checks that the items produced by gen satisfy the contract
+// documented for heteroset.Item and then drives a heteroset.Set containing
+// such items through a randomized sequence of Add(), Find() and Remove()
+// operations checking the results against a reference implementation (and
+// the set's internal invariants) after every operation.  This is done for
+// each of the backends (see heteroset.WithBackend()) with the nodes
+// allocated individually and from small slabs (see heteroset.WithArena()).
+func RunItemTests(t *testing.T, gen func(r *rand.Rand) heteroset.Item) {
+	r := rand.New(rand.NewSource(*seed));
+	items := make([]heteroset.Item, ContractItems);
+	for i := range items {
+		items[i] = gen(r);
+	};
+	check_contract(t, items);
+	for _, backend := range []heteroset.Backend{heteroset.LLRB, heteroset.AVL, heteroset.NewTreap(1)} {
+		check_set(t, r, heteroset.Make(heteroset.WithBackend(backend)), fmt.Sprint(backend), items);
+		check_set(t, r, heteroset.Make(heteroset.WithBackend(backend), heteroset.WithArena(16)), fmt.Sprint(backend, " with arena"), items);
+	};
+};
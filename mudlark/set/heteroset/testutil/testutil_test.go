@@ -0,0 +1,42 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package testutil;
+
+import (
+	"testing";
+	"rand";
+	"mudlark/set/heteroset";
+)
+
+type Int int;
+
+func (i Int) Precedes(other interface{}) bool {
+	return int(i) < int(other.(Int));
+};
+
+// A (key, value) item where only the key is used for ordering
+type Entry struct {
+	key string;
+	value int;
+};
+
+func (e *Entry) Precedes(other interface{}) bool {
+	return e.key < other.(*Entry).key;
+};
+
+func TestInt(t *testing.T) {
+	RunItemTests(t, func(r *rand.Rand) heteroset.Item {
+		return Int(r.Intn(100));
+	});
+};
+
+func TestMixed(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g"};
+	RunItemTests(t, func(r *rand.Rand) heteroset.Item {
+		if r.Intn(2) == 0 {
+			return Int(r.Intn(20));
+		};
+		return &Entry{keys[r.Intn(len(keys))], r.Int()};
+	});
+};
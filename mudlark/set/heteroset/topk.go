@@ -0,0 +1,48 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+// TopKTracker keeps the k largest (in the order used by Iter()) of the
+// Items offered to it.  It must be created using NewTopK().
+type TopKTracker struct {
+	k uint;
+	set *Set;
+	// the smallest member of set (nil if it's empty)
+	least Item;
+};
+
+// NewTopK makes a TopKTracker that keeps the k largest items offered to it.
+func NewTopK(k int) *TopKTracker {
+	return &TopKTracker{k: uint(max(k, 0)), set: New()};
+};
+
+// Offer item to the tracker and report whether it was admitted i.e. it is
+// now one of the k largest items offered.  Once the tracker is full an item
+// that doesn't follow the smallest of those kept is rejected in O(1) time.
+// An item equal to one already kept replaces it.  Nil items are rejected.
+func (this *TopKTracker) Offer(item Item) bool {
+	if is_nil(item) || this.k == 0 {
+		return false;
+	};
+	full := this.set.count >= this.k;
+	if full && compare_items(item, this.least) < 0 {
+		return false;
+	};
+	if !this.set.Add(item) || !full {
+		// a replacement or room to spare
+		if this.least == nil || compare_items(item, this.least) <= 0 {
+			this.least = item;
+		};
+		return true;
+	};
+	this.set.Remove(this.least);
+	this.least = this.set.TakeSmallest(1)[0];
+	return true;
+};
+
+// Result returns a set containing the items kept by the tracker.  The tracker
+// may continue to be used.
+func (this *TopKTracker) Result() *Set {
+	return this.set.Copy();
+};
@@ -0,0 +1,375 @@
+// Copyright 2010 -- Peter Williams, all rights reserved
+// Use of this source code is governed by the new BSD license.
+
+package heteroset;
+
+import (
+	"fmt";
+	"os";
+	"rand";
+	"sort";
+	"sync";
+)
+
+// A treap keeps its nodes in heap order of random priorities as well as in
+// the set's order which makes its expected depth logarithmic.  Unlike the
+// other backends two treaps can be split and joined in O(log n) time so
+// SplitAt(), Split(), Merge() and the set algebra functions work on the trees
+// directly (sharing their unchanged nodes with the operands) when the sets
+// involved use treaps.
+type treap_backend struct {
+	lock sync.Mutex;
+	source *rand.Rand;
+};
+
+// NewTreap(seed) returns a treap backend (see WithBackend()) whose nodes'
+// priorities are drawn from a random source seeded with seed.  Sets sharing
+// the backend draw from the same source so the shapes of their trees (but
+// never the results of any method) depend on the order in which they are
+// modified.  A single backend may be used by sets in different goroutines.
+//
+// NOTE: unlike those of the other backends the treap's SplitAt(), Split(),
+// Merge() and set algebra functions write to their operands (see share())
+// even though they leave their contents unchanged.  So they must not be
+// called on a treap set while another goroutine is using it in any way, not
+// even when every goroutine involved is only reading.
+func NewTreap(seed int64) Backend {
+	return &treap_backend{source: rand.New(rand.NewSource(seed))};
+};
+
+// A node's priority is kept in its aux field.
+func (this *treap_backend) priority() int32 {
+	this.lock.Lock();
+	defer this.lock.Unlock();
+	return this.source.Int31();
+};
+
+func is_treap(set *Set) bool {
+	_, ok := set.tree().(*treap_backend);
+	return ok;
+};
+
+// Whether the trees of setA and setB can be split and joined directly.
+func treaps(setA, setB *Set) bool {
+	_, ordered := in_step(setA, setB);
+	return ordered && is_treap(setA) && is_treap(setB);
+};
+
+// share prepares sets for having their nodes shared with the results of an
+// operation by moving them to new generations (so that they copy the shared
+// nodes before modifying them) and returns the generation for the results.
+// This writes to sets without any locking: the callers are documented (see
+// NewTreap()) as not being safe to use concurrently with any other use of
+// their operands.
+func share(sets ...*Set) uint {
+	for _, set := range sets {
+		set.generation = new_generation();
+	};
+	return new_generation();
+};
+
+// similar_tree returns a set like this one (see similar()) with root as its
+// tree whose nodes made by the operation that built it belong to generation.
+func (this *Set) similar_tree(root *ll_rb_node, generation uint) (set *Set) {
+	set = this.similar();
+	set.root = root;
+	set.count = size(root);
+	set.inserts = uint64(set.count);
+	set.version = uint64(set.count);
+	set.generation = generation;
+	return;
+};
+
+// As for rotate_left() and rotate_right() node must already have been thawed.
+func treap_rotate_left(node *ll_rb_node, generation uint) *ll_rb_node {
+	tmp := thaw(node.right, generation);
+	node.right = tmp.left;
+	tmp.left = node;
+	update_size(node);
+	update_size(tmp);
+	return tmp;
+};
+
+func treap_rotate_right(node *ll_rb_node, generation uint) *ll_rb_node {
+	tmp := thaw(node.left, generation);
+	node.left = tmp.right;
+	tmp.right = node;
+	update_size(node);
+	update_size(tmp);
+	return tmp;
+};
+
+func (this *treap_backend) insert_node(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item) {
+	if node == nil {
+		node = new_ll_rb_node(item, generation, arena);
+		node.red = false;
+		node.aux = this.priority();
+		rehash(node, sum);
+		return node, nil;
+	};
+	count_visit(visits);
+	node = thaw(node, generation);
+	var previous Item;
+	switch cmp := compare(node.item, item); {
+	case cmp > 0:
+		node.left, previous = this.insert_node(node.left, item, compare, generation, sum, visits, arena);
+		if node.left.aux > node.aux {
+			return treap_rotate_right(node, generation), previous;
+		};
+	case cmp < 0:
+		node.right, previous = this.insert_node(node.right, item, compare, generation, sum, visits, arena);
+		if node.right.aux > node.aux {
+			return treap_rotate_left(node, generation), previous;
+		};
+	default:
+		previous = node.item;
+		node.item = item;
+		rehash(node, sum);
+	};
+	update_size(node);
+	return node, previous;
+};
+
+func treap_delete(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool) {
+	if node == nil {
+		return nil, false;
+	};
+	count_visit(visits);
+	switch cmp := compare(node.item, item); {
+	case cmp > 0:
+		left, deleted := treap_delete(node.left, item, compare, generation, sum, visits, arena);
+		if !deleted {
+			return node, false;
+		};
+		node = thaw(node, generation);
+		node.left = left;
+	case cmp < 0:
+		right, deleted := treap_delete(node.right, item, compare, generation, sum, visits, arena);
+		if !deleted {
+			return node, false;
+		};
+		node = thaw(node, generation);
+		node.right = right;
+	default:
+		unhash(node, sum);
+		left, right := node.left, node.right;
+		arena.release(node, generation);
+		return treap_join(left, right, generation), true;
+	};
+	update_size(node);
+	return node, true;
+};
+
+// Join the treaps left and right every member of which precedes every
+// member of right.
+func treap_join(left, right *ll_rb_node, generation uint) *ll_rb_node {
+	switch {
+	case left == nil:
+		return right;
+	case right == nil:
+		return left;
+	case left.aux > right.aux:
+		left = thaw(left, generation);
+		left.right = treap_join(left.right, right, generation);
+		update_size(left);
+		return left;
+	};
+	right = thaw(right, generation);
+	right.left = treap_join(left, right.left, generation);
+	update_size(right);
+	return right;
+};
+
+// Split the treap rooted at node into the members that precede item and
+// those that follow it.  The node holding the member equal to item (if any)
+// is returned as equal and is in neither part.
+func treap_split(node *ll_rb_node, item Item, compare func(a, b Item) int, generation uint) (left, right, equal *ll_rb_node) {
+	if node == nil {
+		return;
+	};
+	switch cmp := compare(node.item, item); {
+	case cmp < 0:
+		node = thaw(node, generation);
+		node.right, right, equal = treap_split(node.right, item, compare, generation);
+		update_size(node);
+		return node, right, equal;
+	case cmp > 0:
+		node = thaw(node, generation);
+		left, node.left, equal = treap_split(node.left, item, compare, generation);
+		update_size(node);
+		return left, node, equal;
+	};
+	return node.left, node.right, node;
+};
+
+// Split the treap rooted at node into its first k nodes and the others.
+func treap_split_at(node *ll_rb_node, k uint, generation uint) (left, right *ll_rb_node) {
+	if node == nil {
+		return;
+	};
+	node = thaw(node, generation);
+	if n := size(node.left); k <= n {
+		left, node.left = treap_split_at(node.left, k, generation);
+		right = node;
+	} else {
+		node.right, right = treap_split_at(node.right, k - n - 1, generation);
+		left = node;
+	};
+	update_size(node);
+	return;
+};
+
+// The union of the treaps a and b using a's instances of common members.
+func treap_union(a, b *ll_rb_node, compare func(a, b Item) int, generation uint) *ll_rb_node {
+	switch {
+	case a == nil:
+		return b;
+	case b == nil:
+		return a;
+	case a.aux >= b.aux:
+		left, right, _ := treap_split(b, a.item, compare, generation);
+		a = thaw(a, generation);
+		a.left = treap_union(a.left, left, compare, generation);
+		a.right = treap_union(a.right, right, compare, generation);
+		update_size(a);
+		return a;
+	};
+	left, right, equal := treap_split(a, b.item, compare, generation);
+	b = thaw(b, generation);
+	if equal != nil {
+		b.item, b.hash = equal.item, equal.hash;
+	};
+	b.left = treap_union(left, b.left, compare, generation);
+	b.right = treap_union(right, b.right, compare, generation);
+	update_size(b);
+	return b;
+};
+
+// The intersection of the treaps a and b using a's instances.
+func treap_intersection(a, b *ll_rb_node, compare func(a, b Item) int, generation uint) *ll_rb_node {
+	if a == nil || b == nil {
+		return nil;
+	};
+	var node, left, right, equal *ll_rb_node;
+	if a.aux >= b.aux {
+		left, right, equal = treap_split(b, a.item, compare, generation);
+		left = treap_intersection(a.left, left, compare, generation);
+		right = treap_intersection(a.right, right, compare, generation);
+		if equal != nil {
+			equal = a;
+		};
+		node = a;
+	} else {
+		left, right, equal = treap_split(a, b.item, compare, generation);
+		left = treap_intersection(left, b.left, compare, generation);
+		right = treap_intersection(right, b.right, compare, generation);
+		node = b;
+	};
+	if equal == nil {
+		return treap_join(left, right, generation);
+	};
+	node = thaw(node, generation);
+	node.item, node.hash = equal.item, equal.hash;
+	node.left, node.right = left, right;
+	update_size(node);
+	return node;
+};
+
+// The members of the treap a that aren't in the treap b.
+func treap_difference(a, b *ll_rb_node, compare func(a, b Item) int, generation uint) *ll_rb_node {
+	if a == nil || b == nil {
+		return a;
+	};
+	if a.aux >= b.aux {
+		left, right, equal := treap_split(b, a.item, compare, generation);
+		left = treap_difference(a.left, left, compare, generation);
+		right = treap_difference(a.right, right, compare, generation);
+		if equal != nil {
+			return treap_join(left, right, generation);
+		};
+		a = thaw(a, generation);
+		a.left, a.right = left, right;
+		update_size(a);
+		return a;
+	};
+	left, right, _ := treap_split(a, b.item, compare, generation);
+	left = treap_difference(left, b.left, compare, generation);
+	right = treap_difference(right, b.right, compare, generation);
+	return treap_join(left, right, generation);
+};
+
+type descending_priorities []int32;
+
+func (this descending_priorities) Len() int { return len(this); };
+
+func (this descending_priorities) Less(i, j int) bool { return this[i] > this[j]; };
+
+func (this descending_priorities) Swap(i, j int) { this[i], this[j] = this[j], this[i]; };
+
+// Build a perfectly balanced treap by giving the highest of a set of random
+// priorities to the nodes nearest the root.
+func (this *treap_backend) build_nodes(items []Item, arena *arena) *ll_rb_node {
+	root := avl_build(items, arena);
+	priorities := make(descending_priorities, len(items));
+	for i := range priorities {
+		priorities[i] = this.priority();
+	};
+	sort.Sort(priorities);
+	queue := make([]*ll_rb_node, 0, len(items));
+	if root != nil {
+		queue = append(queue, root);
+	};
+	for i := 0; i < len(queue); i++ {
+		node := queue[i];
+		node.red = false;
+		node.aux = priorities[i];
+		if node.left != nil {
+			queue = append(queue, node.left);
+		};
+		if node.right != nil {
+			queue = append(queue, node.right);
+		};
+	};
+	return root;
+};
+
+func check_priorities(node *ll_rb_node) (count uint, err os.Error) {
+	if node == nil {
+		return 0, nil;
+	};
+	for _, child := range []*ll_rb_node{node.left, node.right} {
+		if child != nil && child.aux > node.aux {
+			return 0, os.NewError(fmt.Sprintf("heteroset: priority of %v exceeds that of its parent %v", child.item, node.item));
+		};
+	};
+	lcount, err := check_priorities(node.left);
+	if err != nil {
+		return;
+	};
+	rcount, err := check_priorities(node.right);
+	if err != nil {
+		return;
+	};
+	if node.size != lcount + rcount + 1 {
+		return 0, os.NewError(fmt.Sprintf("heteroset: size %v but %v nodes below %v", node.size, lcount + rcount + 1, node.item));
+	};
+	return node.size, nil;
+};
+
+func (this *treap_backend) insert(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, Item) {
+	return this.insert_node(root, item, compare, generation, sum, visits, arena);
+};
+
+func (this *treap_backend) delete(root *ll_rb_node, item Item, compare func(a, b Item) int, generation uint, sum, visits *uint64, arena *arena) (*ll_rb_node, bool) {
+	return treap_delete(root, item, compare, generation, sum, visits, arena);
+};
+
+func (this *treap_backend) build(items []Item, arena *arena) *ll_rb_node {
+	return this.build_nodes(items, arena);
+};
+
+func (this *treap_backend) check(root *ll_rb_node) (uint, os.Error) {
+	return check_priorities(root);
+};
+
+func (this *treap_backend) String() string { return "Treap"; };